@@ -15,6 +15,7 @@
 package cloudfunction
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
@@ -30,23 +31,53 @@ var logger = log.StdoutLogger().Sugar()
 func Request(w http.ResponseWriter, r *http.Request) {
 	var c config.Config
 	var err error
-	var bucketName string
-	var ok bool
+	if c, err = getCloudFunctionConfig(); err != nil {
+		logCloudFunctionError(w, err)
+		return
+	}
+	if r.URL.Query().Get("plan") == "true" {
+		c.Plan = true
+	}
+	var result rotate.Result
+	result, err = rotate.Rotate("", "", "", c)
+	writeCloudFunctionReport(w, result, err)
+}
+
+// getCloudFunctionConfig reads config from the URI in CKR_CONFIG_URI if it's
+// set, and from the object in the GCS bucket in CKR_BUCKET_NAME otherwise
+func getCloudFunctionConfig() (c config.Config, err error) {
+	if configURI, ok := os.LookupEnv("CKR_CONFIG_URI"); ok {
+		return config.GetConfigFromURI(configURI)
+	}
 	bucketEnvVarName := "CKR_BUCKET_NAME"
-	if bucketName, ok = os.LookupEnv(bucketEnvVarName); !ok {
-		logCloudFunctionError(w, fmt.Errorf("Env var: %s is required", bucketEnvVarName))
+	bucketName, ok := os.LookupEnv(bucketEnvVarName)
+	if !ok {
+		err = fmt.Errorf("Env var: %s or CKR_CONFIG_URI is required", bucketEnvVarName)
 		return
 	}
-	if c, err = config.GetConfigFromGCS(
+	return config.GetConfigFromGCS(
 		bucketName,
 		getEnv("CKR_SECRET_CONFIG_NAME", "ckr-config.json"),
-		getEnv("CKR_CONFIG_TYPE", "json")); err != nil {
-		logCloudFunctionError(w, err)
-		return
+		getEnv("CKR_CONFIG_TYPE", "json"))
+}
+
+// writeCloudFunctionReport writes the rotation report to the response as JSON,
+// with a 500 status code if the rotation failed
+func writeCloudFunctionReport(w http.ResponseWriter, result rotate.Result, err error) {
+	response := struct {
+		Status string        `json:"status"`
+		Error  string        `json:"error,omitempty"`
+		Report rotate.Result `json:"report"`
+	}{Status: "success", Report: result}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		response.Status = "fail"
+		response.Error = err.Error()
+		logger.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
 	}
-	if err = rotate.Rotate("", "", "", c); err != nil {
-		logCloudFunctionError(w, err)
-		return
+	if encodeErr := json.NewEncoder(w).Encode(response); encodeErr != nil {
+		logger.Error(encodeErr)
 	}
 }
 
@@ -0,0 +1,86 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io"
+	"os"
+
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+	"github.com/ovotech/cloud-key-rotator/pkg/log"
+	"github.com/ovotech/cloud-key-rotator/pkg/rotate"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	reportCmd = &cobra.Command{
+		Use:   "report",
+		Short: "Report the age of cloud keys",
+		Long:  `Report the age, threshold and configured locations of cloud keys`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := report(); err != nil {
+				logger.Fatal(err)
+			}
+		},
+	}
+)
+
+// report writes a report of the keys found to stdout, or the output file if
+// one has been specified
+func report() (err error) {
+	if len(output) == 0 {
+		// keep info logs out of the report
+		log.SetStdoutLevel(zapcore.WarnLevel)
+	}
+	var c config.Config
+	if c, err = config.GetConfig(configPath); err != nil {
+		return
+	}
+	var keyReports []rotate.KeyReport
+	if keyReports, err = rotate.Report(account, provider, project, c); err != nil {
+		return
+	}
+	var w io.Writer = os.Stdout
+	if len(output) > 0 {
+		var f *os.File
+		if f, err = os.Create(output); err != nil {
+			return
+		}
+		defer func() {
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		w = f
+	}
+	return rotate.WriteReport(w, keyReports, format)
+}
+
+func init() {
+	reportCmd.Flags().StringVarP(&account, "account", "a", defaultAccount,
+		"Account to report on")
+	reportCmd.Flags().StringVarP(&configPath, "config", "c", defaultConfigPath,
+		"Absolute path of the directory holding application config, or a config URI, e.g. gs://bucket/config.json")
+	reportCmd.Flags().StringVarP(&provider, "provider", "p", defaultProvider,
+		"Provider of account to report on")
+	reportCmd.Flags().StringVarP(&project, "project", "j", defaultProject,
+		"Project of account to report on")
+	reportCmd.Flags().StringVarP(&format, "format", "f", rotate.ReportFormatTable,
+		"Format of the report: table, json or csv")
+	reportCmd.Flags().StringVarP(&output, "output", "o", "",
+		"Path of file to write the report to (defaults to stdout)")
+	rootCmd.AddCommand(reportCmd)
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+	"github.com/ovotech/cloud-key-rotator/pkg/rotate"
+	"github.com/spf13/cobra"
+)
+
+var (
+	revokeCmd = &cobra.Command{
+		Use:   "revoke",
+		Short: "Revoke a compromised cloud key",
+		Long: `Revoke a compromised cloud key immediately, regardless of its age.
+A replacement key is created and written to the account's locations before
+the compromised key is deleted, unless --no-replace is set.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			var err error
+			var c config.Config
+			var result rotate.Result
+			if c, err = config.GetConfig(configPath); err == nil {
+				result, err = rotate.Revoke(account, provider, project, keyID, !noReplace, c)
+				logger.Infow("Revocation report",
+					"summary", result.Summary(),
+					"accounts", result.Accounts)
+			}
+			if err != nil {
+				logger.Fatal(err)
+			}
+		},
+	}
+)
+
+func init() {
+	revokeCmd.Flags().StringVarP(&account, "account", "a", defaultAccount,
+		"Account whose key to revoke")
+	revokeCmd.Flags().StringVarP(&configPath, "config", "c", defaultConfigPath,
+		"Absolute path of the directory holding application config, or a config URI, e.g. gs://bucket/config.json")
+	revokeCmd.Flags().StringVarP(&provider, "provider", "p", defaultProvider,
+		"Provider of account whose key to revoke")
+	revokeCmd.Flags().StringVarP(&project, "project", "j", defaultProject,
+		"Project of account whose key to revoke")
+	revokeCmd.Flags().StringVar(&keyID, "key-id", "",
+		"ID of the key to revoke, required if the account has more than one key")
+	revokeCmd.Flags().BoolVar(&noReplace, "no-replace", false,
+		"Delete the key without creating and distributing a replacement")
+	revokeCmd.MarkFlagRequired("account")
+	revokeCmd.MarkFlagRequired("provider")
+	rootCmd.AddCommand(revokeCmd)
+
+}
@@ -34,6 +34,14 @@ var (
 	defaultAccount    string
 	defaultProvider   string
 	defaultProject    string
+	plan              bool
+	continueOnError   bool
+	concurrency       int
+	format            string
+	output            string
+	address           string
+	keyID             string
+	noReplace         bool
 	logger            = log.StdoutLogger().Sugar()
 )
 
@@ -28,8 +28,21 @@ var (
 		Run: func(cmd *cobra.Command, args []string) {
 			var err error
 			var c config.Config
+			var result rotate.Result
 			if c, err = config.GetConfig(configPath); err == nil {
-				err = rotate.Rotate(account, provider, project, c)
+				if plan {
+					c.Plan = true
+				}
+				if continueOnError {
+					c.ContinueOnError = true
+				}
+				if concurrency > 0 {
+					c.Concurrency = concurrency
+				}
+				result, err = rotate.Rotate(account, provider, project, c)
+				logger.Infow("Rotation report",
+					"summary", result.Summary(),
+					"accounts", result.Accounts)
 			}
 			if err != nil {
 				logger.Fatal(err)
@@ -42,11 +55,17 @@ func init() {
 	rotateCmd.Flags().StringVarP(&account, "account", "a", defaultAccount,
 		"Account to rotate")
 	rotateCmd.Flags().StringVarP(&configPath, "config", "c", defaultConfigPath,
-		"Absolute path of application config")
+		"Absolute path of the directory holding application config, or a config URI, e.g. gs://bucket/config.json")
 	rotateCmd.Flags().StringVarP(&provider, "provider", "p", defaultProvider,
 		"Provider of account to rotate")
 	rotateCmd.Flags().StringVarP(&project, "project", "j", defaultProject,
 		"Project of account to rotate")
+	rotateCmd.Flags().BoolVar(&plan, "plan", false,
+		"Report the rotations that would happen, without performing them")
+	rotateCmd.Flags().BoolVar(&continueOnError, "continue-on-error", false,
+		"Continue rotating remaining accounts when the rotation of an account fails")
+	rotateCmd.Flags().IntVar(&concurrency, "concurrency", 0,
+		"Number of accounts to rotate in parallel (overrides config)")
 	rootCmd.AddCommand(rotateCmd)
 
 }
@@ -0,0 +1,51 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+var (
+	schemaCmd = &cobra.Command{
+		Use:   "schema",
+		Short: "Print the JSON Schema of cloud-key-rotator config",
+		Long:  `Print the JSON Schema of cloud-key-rotator config, for use by editors and CI`,
+		Run: func(cmd *cobra.Command, args []string) {
+			schema, err := config.Schema()
+			if err == nil {
+				schema = append(schema, '\n')
+				if len(output) > 0 {
+					err = ioutil.WriteFile(output, schema, 0644)
+				} else {
+					_, err = os.Stdout.Write(schema)
+				}
+			}
+			if err != nil {
+				logger.Fatal(err)
+			}
+		},
+	}
+)
+
+func init() {
+	schemaCmd.Flags().StringVarP(&output, "output", "o", "",
+		"Path of file to write the schema to (defaults to stdout)")
+	rootCmd.AddCommand(schemaCmd)
+}
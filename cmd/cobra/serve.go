@@ -0,0 +1,66 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+	"github.com/ovotech/cloud-key-rotator/pkg/serve"
+	"github.com/spf13/cobra"
+)
+
+var (
+	serveCmd = &cobra.Command{
+		Use:   "serve",
+		Short: "Rotate cloud keys on a schedule, and serve an HTTP API",
+		Long: `Rotate cloud keys on the cron schedule in config, and serve an HTTP API
+for health checks, metrics, key age reports and ad-hoc rotations`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runServer(); err != nil {
+				logger.Fatal(err)
+			}
+		},
+	}
+)
+
+// runServer serves until it receives SIGINT or SIGTERM
+func runServer() (err error) {
+	var c config.Config
+	if c, err = config.GetConfig(configPath); err != nil {
+		return
+	}
+	if len(address) > 0 {
+		c.Server.Address = address
+	}
+	var server *serve.Server
+	if server, err = serve.NewServer(c); err != nil {
+		return
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return server.ListenAndServe(ctx)
+}
+
+func init() {
+	serveCmd.Flags().StringVarP(&configPath, "config", "c", defaultConfigPath,
+		"Absolute path of the directory holding application config, or a config URI, e.g. gs://bucket/config.json")
+	serveCmd.Flags().StringVar(&address, "address", "",
+		"Address to listen on (overrides config)")
+	rootCmd.AddCommand(serveCmd)
+}
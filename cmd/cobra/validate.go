@@ -26,7 +26,19 @@ var (
 		Long:  `Validate cloud-key-rotator config`,
 		Run: func(cmd *cobra.Command, args []string) {
 			logger.Info("validating cloud-key-rotator config")
-			if _, err := config.GetConfig(configPath); err != nil {
+			c, err := config.GetConfig(configPath)
+			if err == nil {
+				err = config.Validate(c)
+			}
+			if validationErrors, ok := err.(config.ValidationErrors); ok {
+				for _, validationError := range validationErrors {
+					logger.Warnw("Invalid config",
+						"path", validationError.Path,
+						"problem", validationError.Message)
+				}
+				logger.Fatalf("%d problems found in cloud-key-rotator config in %s",
+					len(validationErrors), configPath)
+			} else if err != nil {
 				logger.Fatal(err)
 			} else {
 				logger.Infof("cloud-key-rotator config in %s is valid", configPath)
@@ -37,6 +49,6 @@ var (
 
 func init() {
 	validateCmd.Flags().StringVarP(&configPath, "config", "c", defaultConfigPath,
-		"Absolute path of application config")
+		"Absolute path of the directory holding application config, or a config URI, e.g. gs://bucket/config.json")
 	rootCmd.AddCommand(validateCmd)
 }
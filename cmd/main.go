@@ -28,24 +28,43 @@ import (
 // MyEvent type
 type MyEvent struct {
 	Name string `json:"name"`
+	Plan bool   `json:"plan"`
+}
+
+// Response type is returned from each Lambda invocation
+type Response struct {
+	Status string        `json:"status"`
+	Report rotate.Result `json:"report"`
 }
 
 var logger = log.StdoutLogger().Sugar()
 
 // HandleRequest allows cloud-key-rotator to be used in the Lambda program model
-func HandleRequest(ctx context.Context, name MyEvent) (string, error) {
+func HandleRequest(ctx context.Context, name MyEvent) (Response, error) {
 	var c config.Config
 	var err error
-	status := "fail"
-	if c, err = config.GetConfigFromAWSSecretManager(
-		getEnv("CKR_SECRET_CONFIG_NAME", "ckr-config"),
-		getEnv("CKR_CONFIG_TYPE", "json")); err != nil {
-		return status, err
+	response := Response{Status: "fail"}
+	if configURI, ok := os.LookupEnv("CKR_CONFIG_URI"); ok {
+		c, err = config.GetConfigFromURI(configURI)
+	} else {
+		c, err = config.GetConfigFromAWSSecretManager(
+			getEnv("CKR_SECRET_CONFIG_NAME", "ckr-config"),
+			getEnv("CKR_CONFIG_TYPE", "json"))
+	}
+	if err != nil {
+		return response, err
+	}
+	if name.Plan {
+		c.Plan = true
 	}
-	if err = rotate.Rotate("", "", "", c); err == nil {
-		status = "success"
+	if response.Report, err = rotate.Rotate("", "", "", c); err == nil {
+		response.Status = "success"
 	}
-	return status, err
+	logger.Infow("Rotation report",
+		"status", response.Status,
+		"summary", response.Report.Summary(),
+		"accounts", response.Report.Accounts)
+	return response, err
 }
 
 func main() {
@@ -15,16 +15,6 @@
 package config
 
 import (
-	"bytes"
-	"context"
-	"errors"
-	"io/ioutil"
-	"strings"
-
-	"cloud.google.com/go/storage"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/ovotech/cloud-key-rotator/pkg/cred"
 	"github.com/ovotech/cloud-key-rotator/pkg/location"
 	"github.com/spf13/viper"
@@ -37,9 +27,23 @@ type Config struct {
 	Datadog                         Datadog
 	DatadogAPIKey                   string
 	RotationMode                    bool
+	Plan                            bool
+	ContinueOnError                 bool
+	Concurrency                     int
+	GracePeriodMins                 int
+	StateStore                      string
+	RunLock                         string
+	RunLockTTLMins                  int
+	VerifyNewKeys                   bool
+	VerifyNewKeyTimeoutSecs         int
+	Schedule                        Schedule
+	MaxRotationsPerRun              int
+	ProviderLimits                  []ProviderLimit
+	Server                          Server
 	CloudProviders                  []CloudProvider
 	AccountFilter                   Filter
 	AccountKeyLocations             []KeyLocations
+	Include                         []string
 	Credentials                     cred.Credentials
 	DefaultRotationAgeThresholdMins int
 	EnableKeyAgeLogging             bool
@@ -52,6 +56,23 @@ type CloudProvider struct {
 	Self    string
 }
 
+// ProviderLimit type holds the limits on rotation for a provider, e.g. gcp.
+// APICallIntervalMillis is the minimum interval between calls to create or
+// delete its keys.
+type ProviderLimit struct {
+	Provider              string
+	MaxRotationsPerRun    int
+	APICallIntervalMillis int
+}
+
+// Server type holds the config of the serve command. Rotations are run on
+// the Cron schedule (e.g. "0 9 * * 1-5", or "@every 6h"), if one is set, and
+// the HTTP API listens on Address.
+type Server struct {
+	Cron    string
+	Address string
+}
+
 // Datadog type
 type Datadog struct {
 	MetricEnv     string
@@ -70,18 +91,51 @@ type Filter struct {
 // KeyLocations type
 type KeyLocations struct {
 	RotationAgeThresholdMins int
+	GracePeriodMins          int
 	ServiceAccountName       string
+	ServiceAccountNameRegex  string
+	Schedule                 Schedule
 	Atlas                    []location.Atlas
 	CircleCI                 []location.CircleCI
 	CircleCIContext          []location.CircleCIContext
 	DatadogGCPIntegration    []location.Datadog
 	GCS                      []location.Gcs
+	GcpSecretManager         []location.GcpSecretManager
 	Git                      location.Git
 	GitHub                   []location.GitHub
 	Gocd                     []location.Gocd
 	K8s                      []location.K8s
 	SSM                      []location.Ssm
 	SecretsManager           []location.SecretsManager
+	Vault                    []location.Vault
+	// source is the file (or URI) the KeyLocations were defined in
+	source string
+}
+
+// Schedule type holds the rules for when rotation may happen. Weekdays and
+// Windows are evaluated in TimeZone (UTC by default). Blackouts can also be
+// loaded from FreezeFile, so they can be changed without editing this config.
+type Schedule struct {
+	TimeZone   string
+	Weekdays   []string
+	Windows    []Window
+	Blackouts  []Blackout
+	FreezeFile string
+}
+
+// Window type holds a time of day window, with Start and End in 15:04 format.
+// An End before Start means the window spans midnight.
+type Window struct {
+	Start string
+	End   string
+}
+
+// Blackout type holds a period in which rotation mustn't happen. Start and
+// End are either dates (2006-01-02, with End inclusive) or RFC3339 times.
+type Blackout struct {
+	Start  string
+	End    string
+	Reason string
 }
 
 // ProviderServiceAccounts type
@@ -90,96 +144,50 @@ type ProviderServiceAccounts struct {
 	ProviderAccounts []string
 }
 
-const envVarPrefix = "ckr"
-
-// GetConfig returns the application config
+// GetConfig returns the application config. configPath is either a config
+// URI (see NewSource), or a directory containing a config file named config
+// (e.g. config.json or config.yaml).
 func GetConfig(configPath string) (c Config, err error) {
-	viper.SetEnvPrefix(envVarPrefix)
-	// when viper picks up nested keys from env vars, it uses "." as the
-	// separator. E.g. for AivenAPIToken in the Credentials struct, it looks
-	// for "CKR_CREDENTIALS.AIVENAPITOKEN". Bash won't allow users to set this
-	// though, so we need to replace all "." with "_"
-	// so we can now set CKR_CREDENTIALS_AIVENAPITOKEN for example
-	replacer := strings.NewReplacer(".", "_")
-	viper.SetEnvKeyReplacer(replacer)
-	// setting defaults is required so users can pass values in from env vars
-	viper.SetDefault("credentials.aivenapitoken", "")
-	viper.SetDefault("credentials.circleciapitoken", "")
-	viper.SetDefault("credentials.datadog.apikey", "")
-	viper.SetDefault("credentials.githubapitoken", "")
-	viper.AutomaticEnv()
-	viper.AddConfigPath(configPath)
-	viper.SetConfigName("config")
-	viper.AddConfigPath(".")
-	if err = viper.ReadInConfig(); err != nil {
-		return
-	}
-	if err = viper.Unmarshal(&c); err != nil {
-		return
-	}
-	if !viper.IsSet("cloudProviders") {
-		err = errors.New("cloudProviders is not set")
-		return
-	}
-	return
+	return NewLoader().Load(configPath)
+}
+
+// GetConfigFromURI returns the application config read from the Source the
+// URI refers to, e.g. gs://bucket/config.json
+func GetConfigFromURI(uri string) (c Config, err error) {
+	return NewLoader().LoadURI(uri)
+}
+
+// GetConfigFromSource returns the application config read from the Source
+func GetConfigFromSource(source Source) (c Config, err error) {
+	return NewLoader().LoadSource(source)
 }
 
 // GetConfigFromAWSSecretManager grabs the cloud-key-rotator's config from
 // AWS Secret Manager
 func GetConfigFromAWSSecretManager(secretName, configType string) (c Config, err error) {
-	var secret string
-	if secret, err = GetSecret(secretName); err != nil {
-		return
-	}
-	if len(secret) == 0 {
-		return c, errors.New("Unable to obtain secret value. Check user permissions and secret name")
-	}
-	viper.SetConfigType(configType)
-	if err = viper.ReadConfig(bytes.NewBufferString(secret)); err != nil {
-		return
-	}
-	err = viper.Unmarshal(&c)
-	return
+	return NewLoader().load(awsSecretsManagerSource{secretName: secretName, configType: configType},
+		"awssm://"+secretName)
 }
 
 // GetConfigFromGCS grabs the cloud-key-rotator's config from GCS
 func GetConfigFromGCS(bucketName, objectName, configType string) (c Config, err error) {
-	ctx := context.Background()
-	var client *storage.Client
-	if client, err = storage.NewClient(ctx); err != nil {
-		return
-	}
-	bkt := client.Bucket(bucketName)
-	obj := bkt.Object(objectName)
-	var rc *storage.Reader
-	if rc, err = obj.NewReader(ctx); err != nil {
-		return
-	}
-	defer rc.Close()
-	var data []byte
-	if data, err = ioutil.ReadAll(rc); err != nil {
-		return
-	}
-	viper.SetConfigType(configType)
-	if err = viper.ReadConfig(bytes.NewReader(data)); err != nil {
+	return NewLoader().load(gcsSource{bucketName: bucketName, objectName: objectName, configType: configType},
+		"gs://"+bucketName+"/"+objectName)
+}
+
+// GetFreezeFile reads the Blackouts held in a freeze file, which can be in
+// any format viper supports (e.g. JSON or YAML)
+func GetFreezeFile(path string) (blackouts []Blackout, err error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err = v.ReadInConfig(); err != nil {
 		return
 	}
-	err = viper.Unmarshal(&c)
+	err = v.UnmarshalKey("blackouts", &blackouts)
 	return
 }
 
 // GetSecret gets the value of the secret in AWS SecretsManager with the specified name
 func GetSecret(secretName string) (secretString string, err error) {
-	//Create a Secrets Manager client
-	svc := secretsmanager.New(session.New())
-	input := &secretsmanager.GetSecretValueInput{
-		SecretId:     aws.String(secretName),
-		VersionStage: aws.String("AWSCURRENT"), // VersionStage defaults to AWSCURRENT if unspecified
-	}
-	var result *secretsmanager.GetSecretValueOutput
-	if result, err = svc.GetSecretValue(input); err != nil {
-		return
-	}
-	secretString = *result.SecretString
-	return
+	return awsSecretsManagerSecret(secretName)
 }
@@ -0,0 +1,103 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+)
+
+// Fragment type holds the part of config that can be kept in a file of its
+// own (e.g. one per team), which is merged into the main config when the
+// file matches one of its Include patterns
+type Fragment struct {
+	AccountKeyLocations []KeyLocations
+}
+
+// includeFragments merges the fragments in the files matched by c.Include
+// into c, in order of pattern and then file name. Relative patterns are
+// relative to dir. The KeyLocations of c are marked as coming from source.
+func includeFragments(c *Config, source, dir string) (err error) {
+	for i := range c.AccountKeyLocations {
+		c.AccountKeyLocations[i].source = source
+	}
+	included := map[string]bool{}
+	for _, pattern := range c.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		var matches []string
+		if matches, err = filepath.Glob(pattern); err != nil {
+			return fmt.Errorf("Include pattern: %s is invalid: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("Include pattern: %s doesn't match any files", pattern)
+		}
+		for _, match := range matches {
+			if included[match] {
+				continue
+			}
+			included[match] = true
+			var fragment Fragment
+			if fragment, err = readFragment(match); err != nil {
+				return
+			}
+			for _, keyLocation := range fragment.AccountKeyLocations {
+				keyLocation.source = match
+				c.AccountKeyLocations = append(c.AccountKeyLocations, keyLocation)
+			}
+		}
+	}
+	return duplicateAccount(c.AccountKeyLocations)
+}
+
+// duplicateAccount returns an error if a ServiceAccountName is defined in
+// more than one file, e.g. in two fragments owned by different teams, as
+// only the first definition would ever be used
+func duplicateAccount(keyLocations []KeyLocations) error {
+	firstSources := map[string]string{}
+	for _, keyLocation := range keyLocations {
+		name := keyLocation.ServiceAccountName
+		if len(name) == 0 {
+			continue
+		}
+		firstSource, ok := firstSources[name]
+		if !ok {
+			firstSources[name] = keyLocation.source
+			continue
+		}
+		if firstSource != keyLocation.source {
+			return fmt.Errorf("ServiceAccountName: %s is defined in both %s and %s", name, firstSource,
+				keyLocation.source)
+		}
+	}
+	return nil
+}
+
+// readFragment reads the Fragment in the file, which can be in any format
+// viper supports
+func readFragment(path string) (fragment Fragment, err error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err = v.ReadInConfig(); err == nil {
+		err = unmarshal(v, &fragment)
+	}
+	if err != nil {
+		err = fmt.Errorf("Unable to read config fragment: %s: %w", path, err)
+	}
+	return
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfigFiles writes the files, keyed by their paths relative to dir
+func writeConfigFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIncludeFragments(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigFiles(t, dir, map[string]string{
+		"config.yaml": `
+cloudProviders:
+- name: aws
+include:
+- teams/*.yaml
+- teams/team-a.yaml
+accountKeyLocations:
+- serviceAccountName: ckr
+  gcs:
+  - bucketName: ckr-bucket
+    objectName: key.json
+`,
+		"teams/team-a.yaml": `
+accountKeyLocations:
+- serviceAccountName: team-a-deployer
+  ssm:
+  - keyParamName: team-a-key
+    region: eu-west-1
+`,
+		"teams/team-b.yaml": `
+accountKeyLocations:
+- serviceAccountName: team-b-deployer
+  secretsManager:
+  - keyParamName: team-b-key
+    region: eu-west-1
+- serviceAccountName: team-b-deployer
+  ssm:
+  - keyParamName: team-b-key
+    region: eu-west-1
+`,
+	})
+	c, err := GetConfigFromURI("file://" + filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accounts, sources []string
+	for _, keyLocation := range c.AccountKeyLocations {
+		accounts = append(accounts, keyLocation.ServiceAccountName)
+		sources = append(sources, filepath.Base(keyLocation.source))
+	}
+	expectedAccounts := []string{"ckr", "team-a-deployer", "team-b-deployer", "team-b-deployer"}
+	expectedSources := []string{"config.yaml", "team-a.yaml", "team-b.yaml", "team-b.yaml"}
+	if !reflect.DeepEqual(accounts, expectedAccounts) || !reflect.DeepEqual(sources, expectedSources) {
+		t.Errorf("Incorrect fragments merged, want: %v from %v, got: %v from %v",
+			expectedAccounts, expectedSources, accounts, sources)
+	}
+}
+
+func TestIncludeFragmentsInvalid(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigFiles(t, dir, map[string]string{
+		"missing.yaml":        "cloudProviders:\n- name: aws\ninclude:\n- missing/*.yaml\n",
+		"unknown.yaml":        "cloudProviders:\n- name: aws\ninclude:\n- fragments/*.yaml\n",
+		"fragments/team.yaml": "accountKeyLocations: []\ncredentials:\n  kmsKey: kms\n",
+		"duplicate.yaml": "cloudProviders:\n- name: aws\ninclude:\n- teams/*.yaml\n" +
+			"accountKeyLocations:\n- serviceAccountName: team-a-deployer\n",
+		"teams/team-a.yaml": "accountKeyLocations:\n- serviceAccountName: team-a-deployer\n",
+	})
+	if _, err := GetConfigFromURI("file://" + filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("Expected error including pattern that matches no files")
+	}
+	_, err := GetConfigFromURI("file://" + filepath.Join(dir, "unknown.yaml"))
+	var unknownFields UnknownFieldsError
+	if !errors.As(err, &unknownFields) || unknownFields[0].Path != "credentials" {
+		t.Errorf("Expected fields other than AccountKeyLocations in fragment to be rejected, got: %v", err)
+	}
+
+	_, err = GetConfigFromURI("file://" + filepath.Join(dir, "duplicate.yaml"))
+	if err == nil || !strings.Contains(err.Error(), filepath.Join(dir, "duplicate.yaml")) ||
+		!strings.Contains(err.Error(), filepath.Join(dir, "teams", "team-a.yaml")) {
+		t.Errorf("Expected error naming both files defining a duplicate account, got: %v", err)
+	}
+}
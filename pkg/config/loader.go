@@ -0,0 +1,124 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const envVarPrefix = "ckr"
+
+// Loader type loads config using a viper instance of its own, rather than
+// viper's global instance, so loading one config can't affect another (e.g.
+// when a long-running process reloads config). The same env var overrides,
+// defaults and checks are applied whichever Source config is loaded from.
+// Each Loader is intended to load a single config.
+type Loader struct {
+	v *viper.Viper
+}
+
+// NewLoader returns a Loader, with env var overrides configured
+func NewLoader() *Loader {
+	v := viper.New()
+	v.SetEnvPrefix(envVarPrefix)
+	// when viper picks up nested keys from env vars, it uses "." as the
+	// separator. E.g. for AivenAPIToken in the Credentials struct, it looks
+	// for "CKR_CREDENTIALS.AIVENAPITOKEN". Bash won't allow users to set this
+	// though, so we need to replace all "." with "_"
+	// so we can now set CKR_CREDENTIALS_AIVENAPITOKEN for example
+	replacer := strings.NewReplacer(".", "_")
+	v.SetEnvKeyReplacer(replacer)
+	// setting defaults is required so users can pass values in from env vars
+	v.SetDefault("credentials.aivenapitoken", "")
+	v.SetDefault("credentials.circleciapitoken", "")
+	v.SetDefault("credentials.datadog.apikey", "")
+	v.SetDefault("credentials.githubapitoken", "")
+	v.AutomaticEnv()
+	return &Loader{v: v}
+}
+
+// Load returns the application config. configPath is either a config URI
+// (see NewSource), or a directory containing a config file named config
+// (e.g. config.json or config.yaml).
+func (l *Loader) Load(configPath string) (c Config, err error) {
+	if strings.Contains(configPath, "://") {
+		return l.LoadURI(configPath)
+	}
+	l.v.AddConfigPath(configPath)
+	l.v.SetConfigName("config")
+	l.v.AddConfigPath(".")
+	if err = l.v.ReadInConfig(); err != nil {
+		return
+	}
+	configFile := l.v.ConfigFileUsed()
+	return l.unmarshal(configFile, filepath.Dir(configFile))
+}
+
+// LoadURI returns the application config read from the Source the URI
+// refers to, e.g. gs://bucket/config.json
+func (l *Loader) LoadURI(uri string) (c Config, err error) {
+	var source Source
+	if source, err = NewSource(uri); err != nil {
+		return
+	}
+	return l.load(source, uri)
+}
+
+// LoadSource returns the application config read from the Source
+func (l *Loader) LoadSource(source Source) (c Config, err error) {
+	return l.load(source, "config")
+}
+
+// load returns the application config read from the Source, which is
+// referred to by name when reporting where config came from. Relative
+// Include patterns are relative to the directory of a file Source, and to
+// the working directory otherwise.
+func (l *Loader) load(source Source, name string) (c Config, err error) {
+	var data []byte
+	var configType string
+	if data, configType, err = source.Read(); err != nil {
+		return
+	}
+	l.v.SetConfigType(configType)
+	if err = l.v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return
+	}
+	var dir string
+	if file, ok := source.(fileSource); ok {
+		name, dir = file.path, filepath.Dir(file.path)
+	}
+	return l.unmarshal(name, dir)
+}
+
+// unmarshal decodes the config read from source, merging in any fragments
+// it includes
+func (l *Loader) unmarshal(source, dir string) (c Config, err error) {
+	if err = unmarshal(l.v, &c); err != nil {
+		return
+	}
+	if err = includeFragments(&c, source, dir); err != nil {
+		return
+	}
+	if !l.v.IsSet("cloudProviders") {
+		err = errors.New("cloudProviders is not set")
+		return
+	}
+	return
+}
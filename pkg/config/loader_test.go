@@ -0,0 +1,63 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"testing"
+)
+
+func TestLoaderEnvOverrides(t *testing.T) {
+	t.Setenv("CKR_CREDENTIALS_GITHUBAPITOKEN", "env-token")
+	c, err := NewLoader().LoadSource(fakeSource{
+		data:       `{"cloudProviders": [{"name": "aws"}], "credentials": {"githubApiToken": "config-token"}}`,
+		configType: "json",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Credentials.GitHubAPIToken != "env-token" {
+		t.Errorf("Expected env var to override config, got: %s", c.Credentials.GitHubAPIToken)
+	}
+}
+
+func TestLoadersIndependent(t *testing.T) {
+	loader := NewLoader()
+	c, err := loader.LoadSource(fakeSource{
+		data:       "cloudProviders:\n- name: aws\nrotationMode: true\nconcurrency: 4\n",
+		configType: "yaml",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewLoader().LoadSource(fakeSource{
+		data:       `{"cloudProviders": [{"name": "gcp", "project": "my-project"}]}`,
+		configType: "json",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.RotationMode || other.Concurrency != 0 || other.CloudProviders[0].Name != "gcp" {
+		t.Errorf("Config leaked between loaders: %+v", other)
+	}
+	if !loader.v.GetBool("rotationMode") || loader.v.GetInt("concurrency") != 4 {
+		t.Error("Loading config affected config loaded by another loader")
+	}
+	if !c.RotationMode || c.Concurrency != 4 {
+		t.Errorf("Incorrect config loaded: %+v", c)
+	}
+	if _, err = NewLoader().LoadSource(fakeSource{data: `{"rotationMode": true}`, configType: "json"}); err == nil {
+		t.Error("Expected error loading config without cloudProviders")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"path"
+	"reflect"
+)
+
+const schemaVersion = "http://json-schema.org/draft-07/schema#"
+
+// Schema returns a JSON Schema describing Config, generated from the Config
+// struct and the structs it's made up of, e.g. KeyLocations and the locations
+func Schema() ([]byte, error) {
+	definitions := map[string]interface{}{}
+	schema := structSchema(reflect.TypeOf(Config{}), definitions)
+	schema["$schema"] = schemaVersion
+	schema["title"] = "cloud-key-rotator config"
+	schema["definitions"] = definitions
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// typeSchema returns the schema of the type t, adding the schema of any
+// structs it refers to to definitions
+func typeSchema(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), definitions)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), definitions)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object",
+			"additionalProperties": typeSchema(t.Elem(), definitions)}
+	case reflect.Struct:
+		// qualify names with their package, as e.g. config, cred and location
+		// all have a Datadog type
+		name := path.Base(t.PkgPath()) + "." + t.Name()
+		if _, ok := definitions[name]; !ok {
+			// add a placeholder first, in case the struct refers to itself
+			definitions[name] = nil
+			definitions[name] = structSchema(t, definitions)
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema returns the schema of the struct type t. Fields that aren't
+// in the struct aren't allowed.
+func structSchema(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		properties[field.Name] = typeSchema(field.Type, definitions)
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+const schemaPath = "../../schema/config.schema.json"
+
+// TestSchemaUpToDate fails when the published schema hasn't been regenerated
+// after a change to Config. To regenerate it, run:
+// go run ./cmd schema -o schema/config.schema.json
+func TestSchemaUpToDate(t *testing.T) {
+	schema, err := Schema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	published, err := ioutil.ReadFile(schemaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(published), schema) {
+		t.Errorf("%s is out of date, regenerate it with: go run ./cmd schema -o schema/config.schema.json",
+			schemaPath)
+	}
+}
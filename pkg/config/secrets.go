@@ -0,0 +1,304 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	awsSsm "github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/ovotech/cloud-key-rotator/pkg/cred"
+	gcpsm "google.golang.org/api/secretmanager/v1"
+)
+
+// secretSource type fetches the value of the secret with the name supplied,
+// i.e. the part of a secret reference after the scheme
+type secretSource func(name string) (string, error)
+
+// secretSources maps each secret reference scheme to its secretSource
+var secretSources = map[string]secretSource{
+	"awssm": awsSecretsManagerSecret,
+	"gcpsm": gcpSecretManagerSecret,
+	"ssm":   ssmSecret,
+	"env":   envSecret,
+	"file":  fileSecret,
+}
+
+// secretCacheTTL is how long fetched secrets are cached for
+const secretCacheTTL = 10 * time.Minute
+
+type cachedSecret struct {
+	value     string
+	fetchedAt time.Time
+}
+
+var (
+	secretCache      = map[string]cachedSecret{}
+	secretCacheMutex sync.Mutex
+)
+
+// secretRef type holds a parsed secret reference, e.g. awssm://name#field
+type secretRef struct {
+	scheme string
+	name   string
+	field  string
+}
+
+// parseSecretRef parses the value as a secret reference. The bool returned
+// is false if the value isn't a reference, i.e. it doesn't start with the
+// scheme of a secretSource.
+func parseSecretRef(value string) (ref secretRef, isRef bool, err error) {
+	i := strings.Index(value, "://")
+	if i < 0 {
+		return
+	}
+	if _, isRef = secretSources[value[:i]]; !isRef {
+		return
+	}
+	ref.scheme = value[:i]
+	ref.name = value[i+len("://"):]
+	if j := strings.LastIndex(ref.name, "#"); j >= 0 {
+		ref.name, ref.field = ref.name[:j], ref.name[j+1:]
+	}
+	if len(ref.name) == 0 {
+		err = fmt.Errorf("Secret reference: %s has no secret name", value)
+	}
+	return
+}
+
+// ResolveSecret returns the value the secret reference refers to, or the
+// value itself if it isn't a reference. Fetched secrets are cached, so each
+// is only fetched once however many references there are to it.
+func ResolveSecret(value string) (resolved string, err error) {
+	var ref secretRef
+	var isRef bool
+	if ref, isRef, err = parseSecretRef(value); err != nil || !isRef {
+		resolved = value
+		return
+	}
+	var secret string
+	if secret, err = fetchSecret(ref); err != nil {
+		err = fmt.Errorf("Unable to resolve secret reference: %s: %w", value, err)
+		return
+	}
+	if len(ref.field) == 0 {
+		resolved = secret
+		return
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal([]byte(secret), &fields); err != nil {
+		err = fmt.Errorf("Unable to resolve secret reference: %s, secret isn't a JSON object: %w", value, err)
+		return
+	}
+	fieldValue, ok := fields[ref.field]
+	if !ok {
+		err = fmt.Errorf("Unable to resolve secret reference: %s, secret has no field: %s", value, ref.field)
+		return
+	}
+	if resolved, ok = fieldValue.(string); !ok {
+		resolved = fmt.Sprint(fieldValue)
+	}
+	return
+}
+
+// fetchSecret fetches the secret the reference refers to, from the cache if
+// it was fetched recently enough. The cache is only locked while it's read
+// and written, so a slow fetch doesn't hold up lookups of other secrets.
+func fetchSecret(ref secretRef) (secret string, err error) {
+	cacheKey := ref.scheme + "://" + ref.name
+	secretCacheMutex.Lock()
+	cached, ok := secretCache[cacheKey]
+	secretCacheMutex.Unlock()
+	if ok && time.Since(cached.fetchedAt) < secretCacheTTL {
+		secret = cached.value
+		return
+	}
+	if secret, err = secretSources[ref.scheme](ref.name); err != nil {
+		return
+	}
+	secretCacheMutex.Lock()
+	secretCache[cacheKey] = cachedSecret{value: secret, fetchedAt: time.Now()}
+	secretCacheMutex.Unlock()
+	return
+}
+
+// ResolveCredentials returns a copy of the credentials with every secret
+// reference replaced by the value it refers to
+func ResolveCredentials(creds cred.Credentials) (resolved cred.Credentials, err error) {
+	resolved = creds
+	err = ResolveSecretsIn(&resolved)
+	return
+}
+
+// ResolveSecretsIn replaces the secret references in all string fields
+// reachable from ptr, which must be a pointer, with the values they refer to
+func ResolveSecretsIn(ptr interface{}) error {
+	return resolveSecrets(reflect.ValueOf(ptr).Elem())
+}
+
+// resolveSecrets resolves the secret references in all string fields
+// reachable from v
+func resolveSecrets(v reflect.Value) (err error) {
+	switch v.Kind() {
+	case reflect.String:
+		var resolved string
+		if resolved, err = ResolveSecret(v.String()); err != nil {
+			return
+		}
+		v.SetString(resolved)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Field(i).CanSet() {
+				continue
+			}
+			if err = resolveSecrets(v.Field(i)); err != nil {
+				return
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			return
+		}
+		// resolve into a new map, so the map being resolved isn't modified
+		resolved := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(iter.Value())
+			if err = resolveSecrets(value); err != nil {
+				return
+			}
+			resolved.SetMapIndex(iter.Key(), value)
+		}
+		v.Set(resolved)
+	}
+	return
+}
+
+// awsSecretsManagerSecret fetches a secret from AWS Secrets Manager, e.g.
+// awssm://name, or awssm://name?region=eu-west-1 for a specific region
+func awsSecretsManagerSecret(name string) (secret string, err error) {
+	var region string
+	if name, region, err = splitRegion(name); err != nil {
+		return
+	}
+	config := aws.NewConfig()
+	if len(region) > 0 {
+		config = config.WithRegion(region)
+	}
+	var result *secretsmanager.GetSecretValueOutput
+	if result, err = secretsmanager.New(session.New(), config).GetSecretValue(
+		&secretsmanager.GetSecretValueInput{
+			SecretId:     aws.String(name),
+			VersionStage: aws.String("AWSCURRENT"),
+		}); err != nil {
+		return
+	}
+	secret = aws.StringValue(result.SecretString)
+	return
+}
+
+// gcpSecretManagerSecret fetches a secret version from GCP Secret Manager,
+// e.g. gcpsm://projects/p/secrets/s/versions/latest. The latest version is
+// used if none is specified.
+func gcpSecretManagerSecret(name string) (secret string, err error) {
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	ctx := context.Background()
+	var svc *gcpsm.Service
+	if svc, err = gcpsm.NewService(ctx); err != nil {
+		return
+	}
+	var resp *gcpsm.AccessSecretVersionResponse
+	if resp, err = svc.Projects.Secrets.Versions.Access(name).Context(ctx).Do(); err != nil {
+		return
+	}
+	var data []byte
+	if data, err = b64.StdEncoding.DecodeString(resp.Payload.Data); err != nil {
+		return
+	}
+	secret = string(data)
+	return
+}
+
+// ssmSecret fetches a parameter from AWS SSM Parameter Store, e.g.
+// ssm:///path/to/param, or ssm:///path/to/param?region=eu-west-1
+func ssmSecret(name string) (secret string, err error) {
+	var region string
+	if name, region, err = splitRegion(name); err != nil {
+		return
+	}
+	config := aws.NewConfig()
+	if len(region) > 0 {
+		config = config.WithRegion(region)
+	}
+	var output *awsSsm.GetParameterOutput
+	if output, err = awsSsm.New(session.New(), config).GetParameter(&awsSsm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	}); err != nil {
+		return
+	}
+	secret = aws.StringValue(output.Parameter.Value)
+	return
+}
+
+// envSecret reads an env var, e.g. env://VAR
+func envSecret(name string) (secret string, err error) {
+	var ok bool
+	if secret, ok = os.LookupEnv(name); !ok {
+		err = fmt.Errorf("env var: %s is not set", name)
+	}
+	return
+}
+
+// fileSecret reads a file, e.g. file:///path/to/secret, ignoring any
+// trailing newline
+func fileSecret(name string) (secret string, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(name); err != nil {
+		return
+	}
+	secret = strings.TrimRight(string(data), "\r\n")
+	return
+}
+
+// splitRegion splits the region query parameter from the secret name
+func splitRegion(name string) (nameWithoutRegion, region string, err error) {
+	i := strings.Index(name, "?")
+	if i < 0 {
+		nameWithoutRegion = name
+		return
+	}
+	var query url.Values
+	if query, err = url.ParseQuery(name[i+1:]); err != nil {
+		return
+	}
+	nameWithoutRegion, region = name[:i], query.Get("region")
+	return
+}
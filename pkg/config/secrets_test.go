@@ -0,0 +1,174 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ovotech/cloud-key-rotator/pkg/cred"
+)
+
+var parseSecretRefTests = []struct {
+	value       string
+	isRef       bool
+	expectedRef secretRef
+	shouldError bool
+}{
+	{"plaintext-token", false, secretRef{}, false},
+	{"https://example.com", false, secretRef{}, false},
+	{"awssm://ckr-creds#circleci", true, secretRef{"awssm", "ckr-creds", "circleci"}, false},
+	{"awssm://ckr-creds?region=eu-west-1#circleci", true,
+		secretRef{"awssm", "ckr-creds?region=eu-west-1", "circleci"}, false},
+	{"gcpsm://projects/p/secrets/s/versions/latest", true,
+		secretRef{"gcpsm", "projects/p/secrets/s/versions/latest", ""}, false},
+	{"ssm:///ckr/github-token", true, secretRef{"ssm", "/ckr/github-token", ""}, false},
+	{"env://GITHUB_TOKEN", true, secretRef{"env", "GITHUB_TOKEN", ""}, false},
+	{"file:///var/run/secrets/token", true, secretRef{"file", "/var/run/secrets/token", ""}, false},
+	{"env://", true, secretRef{"env", "", ""}, true},
+}
+
+func TestParseSecretRef(t *testing.T) {
+	for _, parseSecretRefTest := range parseSecretRefTests {
+		ref, isRef, err := parseSecretRef(parseSecretRefTest.value)
+		if actual := err != nil; actual != parseSecretRefTest.shouldError {
+			t.Errorf("Incorrect error behaviour for %s: %v", parseSecretRefTest.value, err)
+		}
+		if isRef != parseSecretRefTest.isRef || ref != parseSecretRefTest.expectedRef {
+			t.Errorf("Incorrect parsing of %s, want: %t %+v, got: %t %+v", parseSecretRefTest.value,
+				parseSecretRefTest.isRef, parseSecretRefTest.expectedRef, isRef, ref)
+		}
+	}
+}
+
+func TestResolveCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ckr-secrets-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "datadog.json")
+	if err = ioutil.WriteFile(secretFile, []byte(`{"api": "dd-api-key", "app": "dd-app-key"}`+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err = ioutil.WriteFile(tokenFile, []byte("gh-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("CKR_TEST_CIRCLECI_TOKEN", "circle-token")
+	defer os.Unsetenv("CKR_TEST_CIRCLECI_TOKEN")
+
+	creds := cred.Credentials{
+		CircleCIAPIToken: "env://CKR_TEST_CIRCLECI_TOKEN",
+		Gocd: map[string]cred.GocdServer{
+			"gocd-a": {Server: "https://gocd-a", Password: "file://" + tokenFile},
+		},
+		GitHubAPIToken: "file://" + tokenFile,
+		KmsKey:         "projects/p/locations/l/keyRings/r/cryptoKeys/k",
+		Datadog: cred.Datadog{
+			APIKey: "file://" + secretFile + "#api",
+			AppKey: "file://" + secretFile + "#app",
+		},
+	}
+	resolved, err := ResolveCredentials(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := cred.Credentials{
+		CircleCIAPIToken: "circle-token",
+		GitHubAPIToken:   "gh-token",
+		KmsKey:           "projects/p/locations/l/keyRings/r/cryptoKeys/k",
+		Datadog:          cred.Datadog{APIKey: "dd-api-key", AppKey: "dd-app-key"},
+		Gocd: map[string]cred.GocdServer{
+			"gocd-a": {Server: "https://gocd-a", Password: "gh-token"},
+		},
+	}
+	if !reflect.DeepEqual(resolved, expected) {
+		t.Errorf("Incorrect credentials resolved, want: %+v, got: %+v", expected, resolved)
+	}
+	if creds.CircleCIAPIToken != "env://CKR_TEST_CIRCLECI_TOKEN" || creds.Gocd["gocd-a"].Password == "gh-token" {
+		t.Error("Credentials supplied shouldn't be modified")
+	}
+
+	for _, invalid := range []string{
+		"env://CKR_TEST_NOT_SET",
+		"file://" + secretFile + "#missing",
+		"file://" + tokenFile + "#field",
+	} {
+		if _, err = ResolveSecret(invalid); err == nil {
+			t.Errorf("Expected error resolving %s", invalid)
+		}
+	}
+}
+
+func TestResolveSecretCaching(t *testing.T) {
+	var fetches int
+	secretSources["fake"] = func(name string) (string, error) {
+		fetches++
+		return `{"a": "1", "b": 2}`, nil
+	}
+	defer delete(secretSources, "fake")
+
+	for _, ref := range []string{"fake://secret#a", "fake://secret#b", "fake://secret#a"} {
+		if _, err := ResolveSecret(ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if value, _ := ResolveSecret("fake://secret#b"); value != "2" {
+		t.Errorf("Incorrect value for non-string field, want: 2, got: %s", value)
+	}
+	if fetches != 1 {
+		t.Errorf("Secret should only have been fetched once, got: %d fetches", fetches)
+	}
+}
+
+func TestResolveSecretDuringSlowFetch(t *testing.T) {
+	fetching, release, done := make(chan bool), make(chan bool), make(chan bool)
+	secretSources["slow"] = func(name string) (string, error) {
+		fetching <- true
+		<-release
+		return "slow-secret", nil
+	}
+	secretSources["fast"] = func(name string) (string, error) {
+		return "fast-secret", nil
+	}
+	defer delete(secretSources, "slow")
+	defer delete(secretSources, "fast")
+
+	go func() {
+		ResolveSecret("slow://secret")
+		done <- true
+	}()
+	<-fetching
+	resolved := make(chan string)
+	go func() {
+		value, _ := ResolveSecret("fast://secret")
+		resolved <- value
+	}()
+	select {
+	case value := <-resolved:
+		if value != "fast-secret" {
+			t.Errorf("Incorrect value, want: fast-secret, got: %s", value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Resolving a secret shouldn't wait for another secret to be fetched")
+	}
+	close(release)
+	<-done
+}
@@ -0,0 +1,268 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// defaultConfigType is the type of config read from a source that doesn't
+// indicate its type, e.g. a secret
+const defaultConfigType = "json"
+
+// Source interface is implemented by the places config can be read from.
+// Read returns the raw config, along with its type (e.g. json or yaml).
+type Source interface {
+	Read() (data []byte, configType string, err error)
+}
+
+// NewSource returns the Source for the URI supplied, which is one of:
+//
+//	file:///path/to/config.json
+//	gs://bucket/object
+//	s3://bucket/key
+//	awssm://secret-name
+//	gcpsm://projects/p/secrets/s[/versions/v]
+//	k8s-configmap://namespace/name
+//
+// The type of config is taken from the file extension (if any), and can be
+// set with the type query parameter, e.g. awssm://ckr-config?type=yaml. s3
+// and awssm URIs also take an optional region query parameter, and
+// k8s-configmap URIs a key query parameter naming the data item holding the
+// config (only needed if the ConfigMap holds more than one).
+func NewSource(uri string) (source Source, err error) {
+	var u *url.URL
+	if u, err = url.Parse(uri); err != nil {
+		return
+	}
+	query := u.Query()
+	objectName := strings.TrimPrefix(u.Path, "/")
+	configType := query.Get("type")
+	switch u.Scheme {
+	case "file":
+		source = fileSource{path: u.Path, configType: configTypeOf(u.Path, configType)}
+	case "gs":
+		source = gcsSource{bucketName: u.Host, objectName: objectName,
+			configType: configTypeOf(objectName, configType)}
+	case "s3":
+		source = s3Source{bucketName: u.Host, key: objectName, region: query.Get("region"),
+			configType: configTypeOf(objectName, configType)}
+	case "awssm":
+		source = awsSecretsManagerSource{secretName: u.Host + u.Path, region: query.Get("region"),
+			configType: configTypeOf("", configType)}
+	case "gcpsm":
+		source = gcpSecretManagerSource{name: u.Host + u.Path, configType: configTypeOf("", configType)}
+	case "k8s-configmap":
+		if len(u.Host) == 0 || len(objectName) == 0 || strings.Contains(objectName, "/") {
+			err = fmt.Errorf("ConfigMap URI: %s should be of the form k8s-configmap://namespace/name", uri)
+			return
+		}
+		source = configMapSource{namespace: u.Host, name: objectName, key: query.Get("key"),
+			configType: configType}
+	default:
+		err = fmt.Errorf("Config URI scheme: %s is not supported", u.Scheme)
+	}
+	return
+}
+
+// configTypeOf returns the config type set explicitly if there is one, and
+// the type implied by the name's extension otherwise
+func configTypeOf(name, configType string) string {
+	if len(configType) > 0 {
+		return configType
+	}
+	if ext := strings.TrimPrefix(path.Ext(name), "."); len(ext) > 0 {
+		return ext
+	}
+	return defaultConfigType
+}
+
+// fileSource type reads config from a local file
+type fileSource struct {
+	path       string
+	configType string
+}
+
+func (f fileSource) Read() (data []byte, configType string, err error) {
+	data, err = ioutil.ReadFile(f.path)
+	return data, f.configType, err
+}
+
+// gcsSource type reads config from a GCS object
+type gcsSource struct {
+	bucketName string
+	objectName string
+	configType string
+}
+
+func (g gcsSource) Read() (data []byte, configType string, err error) {
+	configType = g.configType
+	ctx := context.Background()
+	var client *storage.Client
+	if client, err = storage.NewClient(ctx); err != nil {
+		return
+	}
+	defer client.Close()
+	var rc *storage.Reader
+	if rc, err = client.Bucket(g.bucketName).Object(g.objectName).NewReader(ctx); err != nil {
+		return
+	}
+	defer rc.Close()
+	data, err = ioutil.ReadAll(rc)
+	return
+}
+
+// s3Source type reads config from an S3 object
+type s3Source struct {
+	bucketName string
+	key        string
+	region     string
+	configType string
+}
+
+func (s s3Source) Read() (data []byte, configType string, err error) {
+	configType = s.configType
+	config := aws.NewConfig()
+	if len(s.region) > 0 {
+		config = config.WithRegion(s.region)
+	}
+	var output *s3.GetObjectOutput
+	if output, err = s3.New(session.New(), config).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(s.key),
+	}); err != nil {
+		return
+	}
+	defer output.Body.Close()
+	data, err = ioutil.ReadAll(output.Body)
+	return
+}
+
+// awsSecretsManagerSource type reads config from an AWS Secrets Manager secret
+type awsSecretsManagerSource struct {
+	secretName string
+	region     string
+	configType string
+}
+
+func (a awsSecretsManagerSource) Read() (data []byte, configType string, err error) {
+	configType = a.configType
+	name := a.secretName
+	if len(a.region) > 0 {
+		name += "?region=" + url.QueryEscape(a.region)
+	}
+	var secret string
+	if secret, err = awsSecretsManagerSecret(name); err != nil {
+		return
+	}
+	if len(secret) == 0 {
+		err = fmt.Errorf("Secret: %s is empty. Check user permissions and secret name", a.secretName)
+		return
+	}
+	data = []byte(secret)
+	return
+}
+
+// gcpSecretManagerSource type reads config from a GCP Secret Manager secret
+type gcpSecretManagerSource struct {
+	name       string
+	configType string
+}
+
+func (g gcpSecretManagerSource) Read() (data []byte, configType string, err error) {
+	var secret string
+	secret, err = gcpSecretManagerSecret(g.name)
+	return []byte(secret), g.configType, err
+}
+
+// configMapSource type reads config from a data item in a Kubernetes
+// ConfigMap. The cluster is the one cloud-key-rotator is running in, or the
+// current context of the local kubeconfig otherwise.
+type configMapSource struct {
+	namespace  string
+	name       string
+	key        string
+	configType string
+	client     kubernetes.Interface
+}
+
+func (k configMapSource) Read() (data []byte, configType string, err error) {
+	client := k.client
+	if client == nil {
+		if client, err = kubernetesClient(); err != nil {
+			return
+		}
+	}
+	var configMap *v1.ConfigMap
+	if configMap, err = client.CoreV1().ConfigMaps(k.namespace).Get(
+		context.Background(), k.name, metav1.GetOptions{}); err != nil {
+		return
+	}
+	key := k.key
+	if len(key) == 0 {
+		if len(configMap.Data) != 1 {
+			err = fmt.Errorf("ConfigMap: %s/%s has %d data items, so the key query parameter must be set",
+				k.namespace, k.name, len(configMap.Data))
+			return
+		}
+		key = configMapKeys(configMap)[0]
+	}
+	value, ok := configMap.Data[key]
+	if !ok {
+		err = fmt.Errorf("ConfigMap: %s/%s has no data item: %s, it has: %s",
+			k.namespace, k.name, key, strings.Join(configMapKeys(configMap), ", "))
+		return
+	}
+	return []byte(value), configTypeOf(key, k.configType), nil
+}
+
+// configMapKeys returns the sorted keys of the ConfigMap's data items
+func configMapKeys(configMap *v1.ConfigMap) (keys []string) {
+	for key := range configMap.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// kubernetesClient returns a client for the cluster cloud-key-rotator is
+// running in, falling back to the local kubeconfig
+func kubernetesClient() (client kubernetes.Interface, err error) {
+	var restConfig *rest.Config
+	if restConfig, err = rest.InClusterConfig(); err != nil {
+		if restConfig, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			clientcmd.NewDefaultClientConfigLoadingRules(),
+			&clientcmd.ConfigOverrides{}).ClientConfig(); err != nil {
+			return
+		}
+	}
+	return kubernetes.NewForConfig(restConfig)
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var newSourceTests = []struct {
+	uri      string
+	expected Source
+	errors   bool
+}{
+	{"file:///etc/cloud-key-rotator/config.yaml",
+		fileSource{path: "/etc/cloud-key-rotator/config.yaml", configType: "yaml"}, false},
+	{"gs://my-bucket/path/to/ckr-config.json",
+		gcsSource{bucketName: "my-bucket", objectName: "path/to/ckr-config.json", configType: "json"}, false},
+	{"s3://my-bucket/ckr-config?type=yaml&region=eu-west-1",
+		s3Source{bucketName: "my-bucket", key: "ckr-config", region: "eu-west-1", configType: "yaml"}, false},
+	{"awssm://ckr-config",
+		awsSecretsManagerSource{secretName: "ckr-config", configType: "json"}, false},
+	{"awssm://ckr/config?region=eu-west-1",
+		awsSecretsManagerSource{secretName: "ckr/config", region: "eu-west-1", configType: "json"}, false},
+	{"gcpsm://projects/my-project/secrets/ckr-config?type=yaml",
+		gcpSecretManagerSource{name: "projects/my-project/secrets/ckr-config", configType: "yaml"}, false},
+	{"k8s-configmap://ckr/ckr-config?key=config.yaml",
+		configMapSource{namespace: "ckr", name: "ckr-config", key: "config.yaml"}, false},
+	{"k8s-configmap://ckr", nil, true},
+	{"ftp://my-bucket/config.json", nil, true},
+}
+
+func TestNewSource(t *testing.T) {
+	for _, newSourceTest := range newSourceTests {
+		source, err := NewSource(newSourceTest.uri)
+		if (err != nil) != newSourceTest.errors {
+			t.Errorf("Incorrect error behaviour for %s: %v", newSourceTest.uri, err)
+		}
+		if !reflect.DeepEqual(source, newSourceTest.expected) {
+			t.Errorf("Incorrect source for %s, want: %v, got: %v", newSourceTest.uri, newSourceTest.expected, source)
+		}
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(configFile, []byte("cloudProviders:\n- name: aws\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := GetConfigFromURI("file://" + configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.CloudProviders) != 1 || c.CloudProviders[0].Name != "aws" {
+		t.Errorf("Incorrect config read: %+v", c)
+	}
+}
+
+func TestConfigMapSource(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ckr", Name: "ckr-config"},
+		Data:       map[string]string{"config.yaml": "cloudProviders: []", "README": "ckr config"},
+	})
+	data, configType, err := configMapSource{namespace: "ckr", name: "ckr-config", key: "config.yaml",
+		client: client}.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "cloudProviders: []" || configType != "yaml" {
+		t.Errorf("Incorrect config read from ConfigMap: %s (%s)", data, configType)
+	}
+	if _, _, err = (configMapSource{namespace: "ckr", name: "ckr-config", client: client}).Read(); err == nil {
+		t.Error("Expected error reading ConfigMap with multiple data items and no key")
+	}
+	if _, _, err = (configMapSource{namespace: "ckr", name: "ckr-config", key: "config.json",
+		client: client}).Read(); err == nil {
+		t.Error("Expected error reading missing data item")
+	}
+}
+
+// fakeSource type is a Source that returns fixed config
+type fakeSource struct {
+	data       string
+	configType string
+	err        error
+}
+
+func (f fakeSource) Read() ([]byte, string, error) {
+	return []byte(f.data), f.configType, f.err
+}
+
+func TestGetConfigFromSource(t *testing.T) {
+	c, err := GetConfigFromSource(fakeSource{
+		data:       `{"cloudProviders": [{"name": "gcp", "project": "my-project"}], "rotationMode": true}`,
+		configType: "json",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.RotationMode || c.CloudProviders[0].Project != "my-project" {
+		t.Errorf("Incorrect config read: %+v", c)
+	}
+	readErr := errors.New("unreachable")
+	if _, err = GetConfigFromSource(fakeSource{err: readErr}); !errors.Is(err, readErr) {
+		t.Errorf("Expected source error to be returned, got: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+// UnknownField type holds a field in config that isn't recognised, along
+// with the known field it's most likely a misspelling of (if any)
+type UnknownField struct {
+	Path       string
+	Suggestion string
+}
+
+// UnknownFieldsError type is returned when config contains fields that
+// aren't recognised
+type UnknownFieldsError []UnknownField
+
+func (u UnknownFieldsError) Error() string {
+	descriptions := make([]string, len(u))
+	for i, unknownField := range u {
+		descriptions[i] = unknownField.Path
+		if len(unknownField.Suggestion) > 0 {
+			descriptions[i] += fmt.Sprintf(" (did you mean %s?)", unknownField.Suggestion)
+		}
+	}
+	return "Unrecognised fields in config: " + strings.Join(descriptions, ", ")
+}
+
+// unmarshal decodes the config read by v into c, which is a pointer to a
+// struct (e.g. Config). Unlike viper.Unmarshal, an error is returned if the
+// config contains fields that aren't recognised.
+func unmarshal(v *viper.Viper, c interface{}) (err error) {
+	var metadata mapstructure.Metadata
+	if err = v.Unmarshal(c, func(dc *mapstructure.DecoderConfig) {
+		dc.Metadata = &metadata
+	}); err != nil {
+		return
+	}
+	if len(metadata.Unused) == 0 {
+		return
+	}
+	sort.Strings(metadata.Unused)
+	var unknownFields UnknownFieldsError
+	for _, unused := range metadata.Unused {
+		unknownFields = append(unknownFields, unknownField(reflect.TypeOf(c).Elem(), unused))
+	}
+	return unknownFields
+}
+
+// unknownField resolves the path of an unused key, as reported by
+// mapstructure (e.g. accountkeylocations[0].github[0].filepath), against
+// the type t, so the path can be reported using the names of the fields in
+// config, along with the closest known field name
+func unknownField(t reflect.Type, unused string) (field UnknownField) {
+	segments := strings.Split(unused, ".")
+	var resolved []string
+	for _, segment := range segments[:len(segments)-1] {
+		name := segment
+		var indexes string
+		if i := strings.Index(segment, "["); i >= 0 {
+			name, indexes = segment[:i], segment[i:]
+		}
+		structField, ok := fieldByName(t, name)
+		if !ok {
+			// shouldn't happen, as mapstructure only descends into known fields
+			field.Path = unused
+			return
+		}
+		resolved = append(resolved, structField.Name+indexes)
+		t = structField.Type
+		for i := 0; i < strings.Count(indexes, "["); i++ {
+			t = t.Elem()
+		}
+	}
+	key := segments[len(segments)-1]
+	field.Path = strings.Join(append(resolved, key), ".")
+	if t.Kind() == reflect.Struct {
+		field.Suggestion = closestFieldName(t, key)
+	}
+	return
+}
+
+// fieldByName returns the field of the struct type t with the name supplied,
+// ignoring case as mapstructure does
+func fieldByName(t reflect.Type, name string) (reflect.StructField, bool) {
+	if t.Kind() != reflect.Struct {
+		return reflect.StructField{}, false
+	}
+	return t.FieldByNameFunc(func(fieldName string) bool {
+		return strings.EqualFold(fieldName, name)
+	})
+}
+
+// closestFieldName returns the name of the field of the struct type t that's
+// closest to the name supplied, or an empty string if none are close enough
+// for the name to be a likely misspelling
+func closestFieldName(t reflect.Type, name string) (closest string) {
+	name = strings.ToLower(name)
+	maxDistance := len(name) / 3
+	if maxDistance < 2 {
+		maxDistance = 2
+	}
+	closestDistance := maxDistance + 1
+	for i := 0; i < t.NumField(); i++ {
+		fieldName := t.Field(i).Name
+		if distance := levenshtein(name, strings.ToLower(fieldName)); distance < closestDistance {
+			closest = fieldName
+			closestDistance = distance
+		}
+	}
+	return
+}
+
+// levenshtein returns the number of single character edits needed to turn a
+// into b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+var unmarshalTests = []struct {
+	config        string
+	unknownFields UnknownFieldsError
+}{
+	{`{"RotationMode": true, "AccountKeyLocations": [{"ServiceAccountName": "sa", "K8s": [{"SecretName": "s"}]}]}`, nil},
+	// fields are matched regardless of case, as viper lowercases keys
+	{`{"rotationMode": true, "AccountKeyLocations": [{"Ssm": [{"Region": "eu-west-1"}]}]}`, nil},
+	{`{"Credentials": {"GitHubAccount": {"GitName": "ckr"}}}`, UnknownFieldsError{
+		{Path: "Credentials.githubaccount", Suggestion: "GitAccount"}}},
+	{`{"Credentials": {"GitAccount": {"GitHubAccessToken": "token"}}}`, UnknownFieldsError{
+		{Path: "Credentials.GitAccount.githubaccesstoken", Suggestion: "GitAccessToken"}}},
+	{`{"AccountKeyLocations": [{"ServiceAccountName": "sa"}, {"K8s": [{"SecretNme": "s"}], "Colour": "red"}]}`,
+		UnknownFieldsError{
+			{Path: "AccountKeyLocations[1].K8s[0].secretnme", Suggestion: "SecretName"},
+			{Path: "AccountKeyLocations[1].colour"}}},
+	{`{"Credentials": {"Gocd": {"team-a": {"Server": "gocd", "Pasword": "p"}}}}`, UnknownFieldsError{
+		{Path: "Credentials.Gocd[team-a].pasword", Suggestion: "Password"}}},
+}
+
+func TestUnmarshal(t *testing.T) {
+	for _, unmarshalTest := range unmarshalTests {
+		v := viper.New()
+		v.SetConfigType("json")
+		if err := v.ReadConfig(bytes.NewBufferString(unmarshalTest.config)); err != nil {
+			t.Fatal(err)
+		}
+		var c Config
+		err := unmarshal(v, &c)
+		if unmarshalTest.unknownFields == nil {
+			if err != nil {
+				t.Errorf("Unexpected error for %s: %v", unmarshalTest.config, err)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(err, unmarshalTest.unknownFields) {
+			t.Errorf("Incorrect unknown fields for %s, want: %v, got: %v",
+				unmarshalTest.config, unmarshalTest.unknownFields, err)
+		}
+	}
+}
+
+func TestUnmarshalExamples(t *testing.T) {
+	examples, err := filepath.Glob("../../examples/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	locationExamples, err := filepath.Glob("../../examples/locations/*/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, example := range append(examples, locationExamples...) {
+		v := viper.New()
+		v.SetConfigFile(example)
+		if err = v.ReadInConfig(); err != nil {
+			t.Fatal(err)
+		}
+		var c Config
+		if err = unmarshal(v, &c); err != nil {
+			t.Errorf("Example config %s is invalid: %v", example, err)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	for _, test := range []struct {
+		a, b     string
+		distance int
+	}{
+		{"", "", 0},
+		{"kitten", "sitting", 3},
+		{"githubaccount", "gitaccount", 3},
+		{"ssm", "ssm", 0},
+	} {
+		if actual := levenshtein(test.a, test.b); actual != test.distance {
+			t.Errorf("Incorrect distance between %s and %s, want: %d, got: %d",
+				test.a, test.b, test.distance, actual)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ovotech/cloud-key-rotator/pkg/cred"
+	"github.com/ovotech/cloud-key-rotator/pkg/location"
+	"github.com/robfig/cron/v3"
+)
+
+// ValidationError type holds a single problem found in config, along with
+// the path of the config field it was found in
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (v ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", v.Path, v.Message)
+}
+
+// ValidationErrors type holds every problem found in config
+type ValidationErrors []ValidationError
+
+func (v ValidationErrors) Error() string {
+	messages := make([]string, len(v))
+	for i, validationError := range v {
+		messages[i] = validationError.Error()
+	}
+	return fmt.Sprintf("%d problems found in config:\n%s", len(v), strings.Join(messages, "\n"))
+}
+
+// validator type collects the problems found in config, and the credentials
+// required by the locations that are configured
+type validator struct {
+	errors        ValidationErrors
+	requiredCreds map[string]string
+	creds         map[string]string
+}
+
+var fileTypes = []string{"", "b64", "ini", "json"}
+
+// Validate checks that the config has everything a rotation needs, beyond
+// it being parseable. Every problem found is returned in a ValidationErrors,
+// or nil if there aren't any.
+func Validate(c Config) error {
+	v := validator{requiredCreds: map[string]string{}, creds: credentialPaths(c)}
+	if len(c.CloudProviders) == 0 {
+		v.add("CloudProviders", "at least one cloud provider must be set")
+	}
+	for i, cloudProvider := range c.CloudProviders {
+		p := fmt.Sprintf("CloudProviders[%d]", i)
+		v.required(p+".Name", cloudProvider.Name)
+		if cloudProvider.Name == "gcp" {
+			v.required(p+".Project", cloudProvider.Project)
+		}
+	}
+	switch c.AccountFilter.Mode {
+	case "", "include", "exclude":
+	default:
+		v.add("AccountFilter.Mode", fmt.Sprintf("must be include or exclude, not %q", c.AccountFilter.Mode))
+	}
+	if len(c.Server.Cron) > 0 {
+		if _, err := cron.ParseStandard(c.Server.Cron); err != nil {
+			v.add("Server.Cron", fmt.Sprintf("invalid cron schedule: %s", err))
+		}
+	}
+	v.nonNegative("DefaultRotationAgeThresholdMins", c.DefaultRotationAgeThresholdMins)
+	v.nonNegative("GracePeriodMins", c.GracePeriodMins)
+	v.nonNegative("RunLockTTLMins", c.RunLockTTLMins)
+	gracePeriodSet := c.GracePeriodMins > 0
+	for i, keyLocation := range c.AccountKeyLocations {
+		v.keyLocation(fmt.Sprintf("AccountKeyLocations[%d]", i), keyLocation)
+		gracePeriodSet = gracePeriodSet || keyLocation.GracePeriodMins > 0
+	}
+	if gracePeriodSet && len(c.StateStore) == 0 {
+		v.add("StateStore", "must be set when a grace period is configured")
+	}
+	v.credentials()
+	if len(v.errors) > 0 {
+		return v.errors
+	}
+	return nil
+}
+
+// keyLocation checks an element of AccountKeyLocations
+func (v *validator) keyLocation(p string, keyLocation KeyLocations) {
+	if len(keyLocation.ServiceAccountName) == 0 && len(keyLocation.ServiceAccountNameRegex) == 0 {
+		v.add(p+".ServiceAccountName", "either ServiceAccountName or ServiceAccountNameRegex must be set")
+	}
+	if _, err := path.Match(keyLocation.ServiceAccountName, ""); err != nil {
+		v.add(p+".ServiceAccountName", fmt.Sprintf("invalid glob: %s", err))
+	}
+	if _, err := regexp.Compile(keyLocation.ServiceAccountNameRegex); err != nil {
+		v.add(p+".ServiceAccountNameRegex", fmt.Sprintf("invalid regular expression: %s", err))
+	}
+	v.nonNegative(p+".RotationAgeThresholdMins", keyLocation.RotationAgeThresholdMins)
+	v.nonNegative(p+".GracePeriodMins", keyLocation.GracePeriodMins)
+
+	for i, atlas := range keyLocation.Atlas {
+		lp := fmt.Sprintf("%s.Atlas[%d]", p, i)
+		v.required(lp+".ProjectID", atlas.ProjectID)
+		if len(atlas.CredentialsRef) > 0 {
+			v.requireCreds(lp, namedCredPaths("Atlas", atlas.CredentialsRef, "PublicKey", "PrivateKey")...)
+		} else {
+			v.requireCreds(lp, "Credentials.AtlasKeys.PublicKey", "Credentials.AtlasKeys.PrivateKey")
+		}
+	}
+	for i, circleCI := range keyLocation.CircleCI {
+		lp := fmt.Sprintf("%s.CircleCI[%d]", p, i)
+		v.slashed(lp+".UsernameProject", circleCI.UsernameProject)
+		v.requireCircleCICreds(lp, circleCI.CredentialsRef)
+	}
+	for i, circleCIContext := range keyLocation.CircleCIContext {
+		lp := fmt.Sprintf("%s.CircleCIContext[%d]", p, i)
+		v.required(lp+".ContextID", circleCIContext.ContextID)
+		v.requireCircleCICreds(lp, circleCIContext.CredentialsRef)
+	}
+	for i, datadog := range keyLocation.DatadogGCPIntegration {
+		lp := fmt.Sprintf("%s.DatadogGCPIntegration[%d]", p, i)
+		v.required(lp+".Project", datadog.Project)
+		v.required(lp+".ClientEmail", datadog.ClientEmail)
+		v.requireCreds(lp, "Credentials.Datadog.APIKey", "Credentials.Datadog.AppKey")
+	}
+	for i, gcs := range keyLocation.GCS {
+		lp := fmt.Sprintf("%s.GCS[%d]", p, i)
+		v.required(lp+".BucketName", gcs.BucketName)
+		v.required(lp+".ObjectName", gcs.ObjectName)
+		v.fileType(lp+".FileType", gcs.FileType)
+	}
+	for i, gcpSecretManager := range keyLocation.GcpSecretManager {
+		lp := fmt.Sprintf("%s.GcpSecretManager[%d]", p, i)
+		v.required(lp+".Project", gcpSecretManager.Project)
+		v.fileType(lp+".FileType", gcpSecretManager.FileType)
+		switch gcpSecretManager.OldVersions {
+		case "", location.OldVersionsDisable, location.OldVersionsDestroy:
+		default:
+			v.add(lp+".OldVersions", fmt.Sprintf("must be one of disable or destroy, not %q",
+				gcpSecretManager.OldVersions))
+		}
+	}
+	if git := keyLocation.Git; len(git.OrgRepo) > 0 {
+		lp := p + ".Git"
+		v.slashed(lp+".OrgRepo", git.OrgRepo)
+		v.required(lp+".Filepath", git.Filepath)
+		v.fileType(lp+".FileType", git.FileType)
+		v.requireCreds(lp, "Credentials.KmsKey", "Credentials.AkrPass")
+		if len(git.CredentialsRef) > 0 {
+			v.requireCreds(lp, namedCredPaths("Git", git.CredentialsRef, "GitAccessToken", "GitName", "GitEmail")...)
+		} else {
+			v.requireCreds(lp, "Credentials.GitAccount.GitAccessToken", "Credentials.GitAccount.GitName",
+				"Credentials.GitAccount.GitEmail")
+		}
+		if git.VerifyCircleCISuccess {
+			v.required(lp+".CircleCIDeployJobName", git.CircleCIDeployJobName)
+			v.requireCreds(lp, "Credentials.CircleCIAPIToken")
+		}
+	}
+	for i, gitHub := range keyLocation.GitHub {
+		lp := fmt.Sprintf("%s.GitHub[%d]", p, i)
+		v.required(lp+".Owner", gitHub.Owner)
+		v.required(lp+".Repo", gitHub.Repo)
+		if len(gitHub.CredentialsRef) > 0 {
+			v.requireCreds(lp, namedCredPaths("GitHub", gitHub.CredentialsRef)...)
+		} else {
+			v.requireCreds(lp, "Credentials.GitHubAPIToken")
+		}
+	}
+	for i, gocd := range keyLocation.Gocd {
+		lp := fmt.Sprintf("%s.Gocd[%d]", p, i)
+		v.required(lp+".EnvName", gocd.EnvName)
+		if len(gocd.CredentialsRef) > 0 {
+			v.requireCreds(lp, namedCredPaths("Gocd", gocd.CredentialsRef, "Server")...)
+		} else {
+			v.requireCreds(lp, "Credentials.GocdServer.Server")
+		}
+	}
+	for i, k8s := range keyLocation.K8s {
+		lp := fmt.Sprintf("%s.K8s[%d]", p, i)
+		if k8s.InGKE() {
+			v.required(lp+".Project", k8s.Project)
+			v.required(lp+".Location", k8s.Location)
+			v.required(lp+".ClusterName", k8s.ClusterName)
+		} else if k8s.InCluster && (len(k8s.Kubeconfig) > 0 || len(k8s.Context) > 0) {
+			v.add(lp+".InCluster", "can't be set along with Kubeconfig or Context")
+		}
+		v.required(lp+".Namespace", k8s.Namespace)
+		v.required(lp+".SecretName", k8s.SecretName)
+		v.required(lp+".DataName", k8s.DataName)
+		if len(k8s.KeyIDDataName) > 0 && k8s.KeyIDDataName == k8s.DataName {
+			v.add(lp+".KeyIDDataName", "can't be the same as DataName")
+		}
+		v.fileType(lp+".FileType", k8s.FileType)
+		v.nonNegative(lp+".RolloutTimeoutMins", k8s.RolloutTimeoutMins)
+		for j, workload := range k8s.RestartWorkloads {
+			wp := fmt.Sprintf("%s.RestartWorkloads[%d]", lp, j)
+			switch workload.Kind {
+			case location.K8sDeployment, location.K8sStatefulSet, location.K8sDaemonSet:
+			default:
+				v.add(wp+".Kind", fmt.Sprintf("must be one of Deployment, StatefulSet or DaemonSet, not %q",
+					workload.Kind))
+			}
+			v.required(wp+".Name", workload.Name)
+		}
+	}
+	for i, ssm := range keyLocation.SSM {
+		lp := fmt.Sprintf("%s.SSM[%d]", p, i)
+		v.required(lp+".Region", ssm.Region)
+		v.fileType(lp+".FileType", ssm.FileType)
+	}
+	for i, secretsManager := range keyLocation.SecretsManager {
+		lp := fmt.Sprintf("%s.SecretsManager[%d]", p, i)
+		v.required(lp+".Region", secretsManager.Region)
+		v.fileType(lp+".FileType", secretsManager.FileType)
+	}
+	for i, vault := range keyLocation.Vault {
+		lp := fmt.Sprintf("%s.Vault[%d]", p, i)
+		v.required(lp+".Address", vault.Address)
+		v.required(lp+".Path", vault.Path)
+		if vault.KVVersion != 0 && vault.KVVersion != 1 && vault.KVVersion != 2 {
+			v.add(lp+".KVVersion", fmt.Sprintf("must be 1 or 2, not %d", vault.KVVersion))
+		}
+		v.fileType(lp+".FileType", vault.FileType)
+		v.requireVaultCreds(lp, vault.CredentialsRef)
+	}
+}
+
+// requireCircleCICreds records that the CircleCI location at path p
+// requires the CircleCI API token named by ref, or the default token
+func (v *validator) requireCircleCICreds(p, ref string) {
+	if len(ref) > 0 {
+		v.requireCreds(p, namedCredPaths("CircleCI", ref)...)
+	} else {
+		v.requireCreds(p, "Credentials.CircleCIAPIToken")
+	}
+}
+
+// requireVaultCreds records that the Vault location at path p requires the
+// Vault credentials named by ref, or the default VaultAuth. Whichever auth
+// method is used, its credentials must all be set.
+func (v *validator) requireVaultCreds(p, ref string) {
+	credPath := "Credentials.VaultAuth"
+	if len(ref) > 0 {
+		credPath = namedCredPaths("Vault", ref)[0]
+	}
+	switch {
+	case len(v.creds[credPath+".Token"]) > 0:
+	case len(v.creds[credPath+".RoleID"]) > 0:
+		v.requireCreds(p, credPath+".SecretID")
+	case len(v.creds[credPath+".KubernetesRole"]) > 0:
+	default:
+		// a token is the simplest of the auth methods to ask for
+		v.requireCreds(p, credPath+".Token")
+	}
+}
+
+// namedCredPaths returns the config paths of the fields of the named
+// credentials of the type supplied, e.g. Credentials.Gocd.name.Server, or
+// the path of the named credential itself if there are no fields. Names are
+// lowercased, as they are when config is read.
+func namedCredPaths(credType, name string, fields ...string) (paths []string) {
+	p := fmt.Sprintf("Credentials.%s.%s", credType, strings.ToLower(name))
+	if len(fields) == 0 {
+		return []string{p}
+	}
+	for _, field := range fields {
+		paths = append(paths, p+"."+field)
+	}
+	return
+}
+
+// credentialPaths returns the values of the credentials that locations can
+// require, keyed by their config paths
+func credentialPaths(c Config) map[string]string {
+	creds := c.Credentials
+	paths := map[string]string{
+		"Credentials.AivenAPIToken":             creds.AivenAPIToken,
+		"Credentials.AkrPath":                   creds.AkrPath,
+		"Credentials.AtlasKeys.PublicKey":       creds.AtlasKeys.PublicKey,
+		"Credentials.AtlasKeys.PrivateKey":      creds.AtlasKeys.PrivateKey,
+		"Credentials.AkrPass":                   creds.AkrPass,
+		"Credentials.CircleCIAPIToken":          creds.CircleCIAPIToken,
+		"Credentials.Datadog.APIKey":            creds.Datadog.APIKey,
+		"Credentials.Datadog.AppKey":            creds.Datadog.AppKey,
+		"Credentials.GitAccount.GitAccessToken": creds.GitAccount.GitAccessToken,
+		"Credentials.GitAccount.GitEmail":       creds.GitAccount.GitEmail,
+		"Credentials.GitAccount.GitName":        creds.GitAccount.GitName,
+		"Credentials.GitHubAPIToken":            creds.GitHubAPIToken,
+		"Credentials.GocdServer.Password":       creds.GocdServer.Password,
+		"Credentials.GocdServer.Server":         creds.GocdServer.Server,
+		"Credentials.GocdServer.Username":       creds.GocdServer.Username,
+		"Credentials.KmsKey":                    creds.KmsKey,
+	}
+	addVaultAuthPaths(paths, "Credentials.VaultAuth", creds.VaultAuth)
+	for name, token := range creds.CircleCI {
+		paths[namedCredPaths("CircleCI", name)[0]] = token
+	}
+	for name, token := range creds.GitHub {
+		paths[namedCredPaths("GitHub", name)[0]] = token
+	}
+	for name, gitAccount := range creds.Git {
+		p := namedCredPaths("Git", name)[0]
+		paths[p+".GitAccessToken"] = gitAccount.GitAccessToken
+		paths[p+".GitName"] = gitAccount.GitName
+		paths[p+".GitEmail"] = gitAccount.GitEmail
+	}
+	for name, gocdServer := range creds.Gocd {
+		p := namedCredPaths("Gocd", name)[0]
+		paths[p+".Server"] = gocdServer.Server
+		paths[p+".Username"] = gocdServer.Username
+		paths[p+".Password"] = gocdServer.Password
+	}
+	for name, atlasKeys := range creds.Atlas {
+		p := namedCredPaths("Atlas", name)[0]
+		paths[p+".PublicKey"] = atlasKeys.PublicKey
+		paths[p+".PrivateKey"] = atlasKeys.PrivateKey
+	}
+	for name, vaultAuth := range creds.Vault {
+		addVaultAuthPaths(paths, namedCredPaths("Vault", name)[0], vaultAuth)
+	}
+	return paths
+}
+
+// addVaultAuthPaths adds the paths of the VaultAuth fields that can hold
+// secrets to the paths supplied
+func addVaultAuthPaths(paths map[string]string, p string, vaultAuth cred.VaultAuth) {
+	paths[p+".Token"] = vaultAuth.Token
+	paths[p+".RoleID"] = vaultAuth.RoleID
+	paths[p+".SecretID"] = vaultAuth.SecretID
+	paths[p+".KubernetesRole"] = vaultAuth.KubernetesRole
+}
+
+// requireCreds records that the location at path p requires the credentials
+// at the paths supplied
+func (v *validator) requireCreds(p string, credPaths ...string) {
+	for _, credPath := range credPaths {
+		if _, ok := v.requiredCreds[credPath]; !ok {
+			v.requiredCreds[credPath] = p
+		}
+	}
+}
+
+// credentials checks that every credential required by a location is set,
+// and that any secret references are well formed. Each missing credential is
+// only reported once, against the first location that requires it.
+func (v *validator) credentials() {
+	for _, credPath := range sortedKeys(v.creds) {
+		if _, _, err := parseSecretRef(v.creds[credPath]); err != nil {
+			v.add(credPath, err.Error())
+		}
+	}
+	for _, credPath := range sortedKeys(v.requiredCreds) {
+		if len(v.creds[credPath]) == 0 {
+			v.add(credPath, fmt.Sprintf("must be set, as it's required by %s", v.requiredCreds[credPath]))
+		}
+	}
+}
+
+func (v *validator) add(p, message string) {
+	v.errors = append(v.errors, ValidationError{Path: p, Message: message})
+}
+
+func (v *validator) required(p, value string) {
+	if len(value) == 0 {
+		v.add(p, "must be set")
+	}
+}
+
+func (v *validator) nonNegative(p string, value int) {
+	if value < 0 {
+		v.add(p, "must not be negative")
+	}
+}
+
+// slashed checks the value is in the form owner/name
+func (v *validator) slashed(p, value string) {
+	if parts := strings.Split(value, "/"); len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		v.add(p, fmt.Sprintf("must be in the form owner/name, not %q", value))
+	}
+}
+
+func (v *validator) fileType(p, value string) {
+	for _, fileType := range fileTypes {
+		if value == fileType {
+			return
+		}
+	}
+	v.add(p, fmt.Sprintf("must be one of b64, ini or json, not %q", value))
+}
+
+func sortedKeys(m map[string]string) (keys []string) {
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
@@ -0,0 +1,254 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ovotech/cloud-key-rotator/pkg/cred"
+	"github.com/ovotech/cloud-key-rotator/pkg/location"
+)
+
+func TestValidateValid(t *testing.T) {
+	c := Config{
+		CloudProviders: []CloudProvider{{Name: "gcp", Project: "my-project"}, {Name: "aws"}},
+		AccountFilter:  Filter{Mode: "include"},
+		AccountKeyLocations: []KeyLocations{{
+			ServiceAccountName: "team-*",
+			CircleCI:           []location.CircleCI{{UsernameProject: "ovotech/my-repo"}},
+			K8s: []location.K8s{{Project: "my-project", Location: "europe-west2",
+				ClusterName: "my-cluster", Namespace: "default", SecretName: "key", DataName: "key.json"}},
+			SSM: []location.Ssm{{Region: "eu-west-1", FileType: "json"}},
+		}},
+		Credentials: cred.Credentials{CircleCIAPIToken: "token"},
+	}
+	if err := Validate(c); err != nil {
+		t.Errorf("Expected config to be valid, got: %v", err)
+	}
+}
+
+func TestValidateInvalid(t *testing.T) {
+	c := Config{
+		CloudProviders: []CloudProvider{{Name: "gcp"}},
+		AccountFilter:  Filter{Mode: "ignore"},
+		Server:         Server{Cron: "every day"},
+		AccountKeyLocations: []KeyLocations{
+			{
+				ServiceAccountName: "team-a",
+				GracePeriodMins:    60,
+				CircleCI:           []location.CircleCI{{UsernameProject: "my-repo"}},
+				GitHub:             []location.GitHub{{Owner: "ovotech", Repo: "my-repo"}},
+				K8s:                []location.K8s{{Project: "my-project", Namespace: "default"}},
+			},
+			{
+				ServiceAccountNameRegex: "team-(b",
+				CircleCIContext:         []location.CircleCIContext{{ContextID: "abc"}},
+				Git:                     location.Git{OrgRepo: "ovotech/my-repo", Filepath: "key.enc"},
+				SSM:                     []location.Ssm{{FileType: "xml"}},
+			},
+		},
+		Credentials: cred.Credentials{KmsKey: "kms", AkrPass: "pass",
+			GitAccount: cred.GitAccount{GitAccessToken: "token", GitName: "ckr"}},
+	}
+	err := Validate(c)
+	validationErrors, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got: %v", err)
+	}
+	var paths []string
+	for _, validationError := range validationErrors {
+		paths = append(paths, validationError.Path)
+	}
+	expectedPaths := []string{
+		"CloudProviders[0].Project",
+		"AccountFilter.Mode",
+		"Server.Cron",
+		"AccountKeyLocations[0].CircleCI[0].UsernameProject",
+		"AccountKeyLocations[0].K8s[0].Location",
+		"AccountKeyLocations[0].K8s[0].ClusterName",
+		"AccountKeyLocations[0].K8s[0].SecretName",
+		"AccountKeyLocations[0].K8s[0].DataName",
+		"AccountKeyLocations[1].ServiceAccountNameRegex",
+		"AccountKeyLocations[1].SSM[0].Region",
+		"AccountKeyLocations[1].SSM[0].FileType",
+		"StateStore",
+		"Credentials.CircleCIAPIToken",
+		"Credentials.GitAccount.GitEmail",
+		"Credentials.GitHubAPIToken",
+	}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("Incorrect problems found, want: %v, got: %v", expectedPaths, paths)
+	}
+	if message := validationErrors[len(validationErrors)-1].Message; message !=
+		"must be set, as it's required by AccountKeyLocations[0].GitHub[0]" {
+		t.Errorf("Incorrect message for missing credential: %s", message)
+	}
+}
+
+func TestValidateSecretReference(t *testing.T) {
+	c := Config{
+		CloudProviders: []CloudProvider{{Name: "aws"}},
+		Credentials:    cred.Credentials{CircleCIAPIToken: "awssm://#circleci", GitHubAPIToken: "env://GITHUB_TOKEN"},
+	}
+	err := Validate(c)
+	validationErrors, ok := err.(ValidationErrors)
+	if !ok || len(validationErrors) != 1 || validationErrors[0].Path != "Credentials.CircleCIAPIToken" {
+		t.Errorf("Expected malformed secret reference to be reported, got: %v", err)
+	}
+}
+
+func TestValidateCredentialsRef(t *testing.T) {
+	c := Config{
+		CloudProviders: []CloudProvider{{Name: "aws"}},
+		AccountKeyLocations: []KeyLocations{{
+			ServiceAccountName: "team-a",
+			GitHub: []location.GitHub{
+				{Owner: "platform-org", Repo: "my-repo", CredentialsRef: "Platform-Org"},
+				{Owner: "ovotech", Repo: "my-repo", CredentialsRef: "ovotech"},
+			},
+			Gocd: []location.Gocd{{EnvName: "prd", CredentialsRef: "gocd-b"}},
+		}},
+		Credentials: cred.Credentials{
+			GitHub: map[string]string{"platform-org": "token"},
+			Gocd:   map[string]cred.GocdServer{"gocd-a": {Server: "https://gocd-a"}},
+		},
+	}
+	err := Validate(c)
+	validationErrors, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got: %v", err)
+	}
+	var paths []string
+	for _, validationError := range validationErrors {
+		paths = append(paths, validationError.Path)
+	}
+	expectedPaths := []string{"Credentials.GitHub.ovotech", "Credentials.Gocd.gocd-b.Server"}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("Incorrect problems found, want: %v, got: %v", expectedPaths, paths)
+	}
+}
+
+func TestValidateVault(t *testing.T) {
+	c := Config{
+		CloudProviders: []CloudProvider{{Name: "aws"}},
+		AccountKeyLocations: []KeyLocations{{
+			ServiceAccountName: "team-a",
+			Vault: []location.Vault{
+				{Address: "https://vault", Path: "team-a/aws"},
+				{Address: "https://vault", Path: "team-a/aws", KVVersion: 3, CredentialsRef: "approle"},
+				{Path: "team-a/aws", CredentialsRef: "k8s"},
+			},
+		}},
+		Credentials: cred.Credentials{
+			Vault: map[string]cred.VaultAuth{
+				"approle": {RoleID: "role"},
+				"k8s":     {KubernetesRole: "ckr"},
+			},
+		},
+	}
+	err := Validate(c)
+	validationErrors, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got: %v", err)
+	}
+	var paths []string
+	for _, validationError := range validationErrors {
+		paths = append(paths, validationError.Path)
+	}
+	expectedPaths := []string{
+		"AccountKeyLocations[0].Vault[1].KVVersion",
+		"AccountKeyLocations[0].Vault[2].Address",
+		"Credentials.Vault.approle.SecretID",
+		"Credentials.VaultAuth.Token",
+	}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("Incorrect problems found, want: %v, got: %v", expectedPaths, paths)
+	}
+}
+
+func TestValidateGcpSecretManager(t *testing.T) {
+	c := Config{
+		CloudProviders: []CloudProvider{{Name: "aws"}},
+		AccountKeyLocations: []KeyLocations{{
+			ServiceAccountName: "team-a",
+			GcpSecretManager: []location.GcpSecretManager{
+				{Project: "my-project", OldVersions: location.OldVersionsDestroy},
+				{OldVersions: "delete"},
+			},
+		}},
+	}
+	err := Validate(c)
+	validationErrors, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got: %v", err)
+	}
+	var paths []string
+	for _, validationError := range validationErrors {
+		paths = append(paths, validationError.Path)
+	}
+	expectedPaths := []string{
+		"AccountKeyLocations[0].GcpSecretManager[1].Project",
+		"AccountKeyLocations[0].GcpSecretManager[1].OldVersions",
+	}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("Incorrect problems found, want: %v, got: %v", expectedPaths, paths)
+	}
+}
+
+func TestValidateK8s(t *testing.T) {
+	c := Config{
+		CloudProviders: []CloudProvider{{Name: "aws"}},
+		AccountKeyLocations: []KeyLocations{{
+			ServiceAccountName: "team-a",
+			K8s: []location.K8s{
+				{Context: "eks", Namespace: "default", SecretName: "key", DataName: "key.json"},
+				{InCluster: true, Kubeconfig: "/home/ckr/.kube/config", Namespace: "default",
+					SecretName: "key", DataName: "key.json"},
+				{InCluster: true, Namespace: "default"},
+				{Context: "eks", Namespace: "default", SecretName: "key", DataName: "key",
+					KeyIDDataName: "key", FileType: "yaml"},
+				{Context: "eks", Namespace: "default", SecretName: "key", DataName: "key",
+					RolloutTimeoutMins: -1, RestartWorkloads: []location.K8sWorkload{
+						{Kind: location.K8sDeployment, Name: "api"},
+						{Kind: "Pod", Name: "api-0"},
+						{Kind: location.K8sDaemonSet},
+					}},
+			},
+		}},
+	}
+	err := Validate(c)
+	validationErrors, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got: %v", err)
+	}
+	var paths []string
+	for _, validationError := range validationErrors {
+		paths = append(paths, validationError.Path)
+	}
+	expectedPaths := []string{
+		"AccountKeyLocations[0].K8s[1].InCluster",
+		"AccountKeyLocations[0].K8s[2].SecretName",
+		"AccountKeyLocations[0].K8s[2].DataName",
+		"AccountKeyLocations[0].K8s[3].KeyIDDataName",
+		"AccountKeyLocations[0].K8s[3].FileType",
+		"AccountKeyLocations[0].K8s[4].RolloutTimeoutMins",
+		"AccountKeyLocations[0].K8s[4].RestartWorkloads[1].Kind",
+		"AccountKeyLocations[0].K8s[4].RestartWorkloads[2].Name",
+	}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("Incorrect problems found, want: %v, got: %v", expectedPaths, paths)
+	}
+}
@@ -14,6 +14,11 @@
 
 package cred
 
+import (
+	"fmt"
+	"strings"
+)
+
 // Credentials type
 type Credentials struct {
 	AivenAPIToken    string
@@ -26,6 +31,16 @@ type Credentials struct {
 	KmsKey           string
 	GocdServer       GocdServer
 	AtlasKeys        AtlasKeys
+	ServerAPIToken   string
+	VaultAuth        VaultAuth
+	// named credentials, used instead of the defaults above by locations
+	// that have a CredentialsRef
+	CircleCI map[string]string
+	GitHub   map[string]string
+	Git      map[string]GitAccount
+	Gocd     map[string]GocdServer
+	Atlas    map[string]AtlasKeys
+	Vault    map[string]VaultAuth
 }
 
 // Datadog type holds the API and App key for Datadog authentication
@@ -54,3 +69,112 @@ type AtlasKeys struct {
 	PublicKey  string
 	PrivateKey string
 }
+
+// VaultAuth type holds the credentials used to authenticate with Vault: a
+// Token, an AppRole's RoleID and SecretID, or a KubernetesRole (whose service
+// account token is read from KubernetesJWTPath). AuthMount overrides the
+// path the AppRole or Kubernetes auth method is mounted at.
+type VaultAuth struct {
+	Token             string
+	RoleID            string
+	SecretID          string
+	KubernetesRole    string
+	KubernetesJWTPath string
+	AuthMount         string
+}
+
+// CircleCIAPITokenFor returns the CircleCI API token named by ref, or the
+// default token if ref is empty
+func (c Credentials) CircleCIAPITokenFor(ref string) (string, error) {
+	if len(ref) == 0 {
+		return c.CircleCIAPIToken, nil
+	}
+	token, ok := lookup(c.CircleCI, ref)
+	if !ok {
+		return "", refError("CircleCI", ref)
+	}
+	return token, nil
+}
+
+// GitHubAPITokenFor returns the GitHub API token named by ref, or the
+// default token if ref is empty
+func (c Credentials) GitHubAPITokenFor(ref string) (string, error) {
+	if len(ref) == 0 {
+		return c.GitHubAPIToken, nil
+	}
+	token, ok := lookup(c.GitHub, ref)
+	if !ok {
+		return "", refError("GitHub", ref)
+	}
+	return token, nil
+}
+
+// GitAccountFor returns the GitAccount named by ref, or the default
+// GitAccount if ref is empty
+func (c Credentials) GitAccountFor(ref string) (GitAccount, error) {
+	if len(ref) == 0 {
+		return c.GitAccount, nil
+	}
+	gitAccount, ok := lookup(c.Git, ref)
+	if !ok {
+		return GitAccount{}, refError("Git", ref)
+	}
+	return gitAccount, nil
+}
+
+// GocdServerFor returns the GocdServer named by ref, or the default
+// GocdServer if ref is empty
+func (c Credentials) GocdServerFor(ref string) (GocdServer, error) {
+	if len(ref) == 0 {
+		return c.GocdServer, nil
+	}
+	gocdServer, ok := lookup(c.Gocd, ref)
+	if !ok {
+		return GocdServer{}, refError("Gocd", ref)
+	}
+	return gocdServer, nil
+}
+
+// AtlasKeysFor returns the AtlasKeys named by ref, or the default AtlasKeys
+// if ref is empty
+func (c Credentials) AtlasKeysFor(ref string) (AtlasKeys, error) {
+	if len(ref) == 0 {
+		return c.AtlasKeys, nil
+	}
+	atlasKeys, ok := lookup(c.Atlas, ref)
+	if !ok {
+		return AtlasKeys{}, refError("Atlas", ref)
+	}
+	return atlasKeys, nil
+}
+
+// VaultAuthFor returns the VaultAuth named by ref, or the default VaultAuth
+// if ref is empty
+func (c Credentials) VaultAuthFor(ref string) (VaultAuth, error) {
+	if len(ref) == 0 {
+		return c.VaultAuth, nil
+	}
+	vaultAuth, ok := lookup(c.Vault, ref)
+	if !ok {
+		return VaultAuth{}, refError("Vault", ref)
+	}
+	return vaultAuth, nil
+}
+
+// lookup returns the named credentials. Names are matched regardless of
+// case, as config keys are lowercased when config is read.
+func lookup[T any](named map[string]T, ref string) (value T, ok bool) {
+	if value, ok = named[ref]; ok {
+		return
+	}
+	for name, v := range named {
+		if strings.EqualFold(name, ref) {
+			return v, true
+		}
+	}
+	return
+}
+
+func refError(credentialsType, ref string) error {
+	return fmt.Errorf("No %s credentials named: %s", credentialsType, ref)
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cred
+
+import "testing"
+
+var creds = Credentials{
+	GitHubAPIToken: "default-token",
+	GitHub:         map[string]string{"platform-org": "platform-token"},
+	GocdServer:     GocdServer{Server: "https://gocd"},
+	Gocd:           map[string]GocdServer{"gocd-b": {Server: "https://gocd-b"}},
+}
+
+var gitHubAPITokenForTests = []struct {
+	ref         string
+	expected    string
+	shouldError bool
+}{
+	{"", "default-token", false},
+	{"platform-org", "platform-token", false},
+	// viper lowercases map keys, so refs are matched regardless of case
+	{"Platform-Org", "platform-token", false},
+	{"other-org", "", true},
+}
+
+func TestGitHubAPITokenFor(t *testing.T) {
+	for _, test := range gitHubAPITokenForTests {
+		token, err := creds.GitHubAPITokenFor(test.ref)
+		if (err != nil) != test.shouldError {
+			t.Errorf("Incorrect error behaviour for ref %q: %v", test.ref, err)
+		}
+		if token != test.expected {
+			t.Errorf("Incorrect token for ref %q, want: %s, got: %s", test.ref, test.expected, token)
+		}
+	}
+}
+
+func TestGocdServerFor(t *testing.T) {
+	if gocdServer, err := creds.GocdServerFor(""); err != nil || gocdServer.Server != "https://gocd" {
+		t.Errorf("Expected default GocdServer, got: %v, %v", gocdServer, err)
+	}
+	if gocdServer, err := creds.GocdServerFor("GOCD-B"); err != nil || gocdServer.Server != "https://gocd-b" {
+		t.Errorf("Expected named GocdServer, got: %v, %v", gocdServer, err)
+	}
+	if _, err := creds.AtlasKeysFor("atlas-org"); err == nil {
+		t.Error("Expected error for Atlas ref with no Atlas credentials")
+	}
+}
@@ -29,7 +29,8 @@ const (
 
 // Atlas type
 type Atlas struct {
-	ProjectID string
+	ProjectID      string
+	CredentialsRef string
 }
 
 func newClient(publicKey, privateKey string) (*mongodbatlas.Client, error) {
@@ -50,6 +51,9 @@ func newClient(publicKey, privateKey string) (*mongodbatlas.Client, error) {
 func (atlas Atlas) Write(serviceAccountName string, keyWrapper KeyWrapper,
 	creds cred.Credentials) (updated UpdatedLocation, err error) {
 
+	if creds.AtlasKeys, err = creds.AtlasKeysFor(atlas.CredentialsRef); err != nil {
+		return
+	}
 	var client *mongodbatlas.Client
 	if client, err = newClient(creds.AtlasKeys.PublicKey, creds.AtlasKeys.PrivateKey); err != nil {
 		return
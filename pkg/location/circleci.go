@@ -38,6 +38,7 @@ type CircleCI struct {
 	KeyIDEnvVar     string
 	KeyEnvVar       string
 	Base64Decode    bool
+	CredentialsRef  string
 }
 
 var logger = log.StdoutLogger().Sugar()
@@ -45,6 +46,9 @@ var logger = log.StdoutLogger().Sugar()
 // updateCircleCI updates the circleCI environment variable by deleting and
 // then creating it again with the new key
 func (circle CircleCI) Write(serviceAccountName string, keyWrapper KeyWrapper, creds cred.Credentials) (updated UpdatedLocation, err error) {
+	if creds.CircleCIAPIToken, err = creds.CircleCIAPITokenFor(circle.CredentialsRef); err != nil {
+		return
+	}
 	splitUsernameProject := strings.Split(circle.UsernameProject, "/")
 	username := splitUsernameProject[0]
 	project := splitUsernameProject[1]
@@ -15,17 +15,21 @@ import (
 
 // CircleCIContext type
 type CircleCIContext struct {
-	ContextID    string
-	OrgID        string
-	VcsType      string
-	OrgName      string
-	KeyIDEnvVar  string
-	KeyEnvVar    string
-	Base64Decode bool
+	ContextID      string
+	OrgID          string
+	VcsType        string
+	OrgName        string
+	KeyIDEnvVar    string
+	KeyEnvVar      string
+	Base64Decode   bool
+	CredentialsRef string
 }
 
 func (circleContext CircleCIContext) Write(serviceAccountName string, keyWrapper KeyWrapper, creds cred.Credentials) (updated UpdatedLocation, err error) {
 	logger.Info("Starting CircleCI context env var updates")
+	if creds.CircleCIAPIToken, err = creds.CircleCIAPITokenFor(circleContext.CredentialsRef); err != nil {
+		return
+	}
 	cfg := settings.Config{
 		Host:         "https://circleci.com",
 		HTTPClient:   http.DefaultClient,
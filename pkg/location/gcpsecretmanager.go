@@ -0,0 +1,373 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package location
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ovotech/cloud-key-rotator/pkg/cred"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	gcpsm "google.golang.org/api/secretmanager/v1"
+)
+
+// What to do with a GcpSecretManager secret's older versions, once a new
+// version has been added
+const (
+	OldVersionsDisable = "disable"
+	OldVersionsDestroy = "destroy"
+)
+
+// gcpLatestVersion is appended to a secret's name to make the snapshot entry
+// recorded by Read for a secret without an enabled latest version, holding
+// the name of its latest version (or nil if it has none), so that Restore
+// only disables the versions added after it. It can't be mistaken for a
+// secret name, as those can't contain a "/".
+const gcpLatestVersion = "/latest-version"
+
+// GcpSecretManager type holds secrets in GCP Secret Manager, which a new
+// version is added to on each rotation. If CreateIfMissing is set, secrets
+// that don't exist are created with the Labels supplied, replicated to
+// ReplicationLocations (or automatically, if there are none). OldVersions
+// can be set to disable or destroy the secrets' older versions.
+type GcpSecretManager struct {
+	Project              string
+	KeyParamName         string
+	KeyIDParamName       string
+	ConvertToFile        bool
+	FileType             string
+	CreateIfMissing      bool
+	Labels               map[string]string
+	ReplicationLocations []string
+	OldVersions          string
+}
+
+// gcpSecretManagerOptions are the options Secret Manager clients are created
+// with, so they can be pointed at a fake server in tests
+var gcpSecretManagerOptions []option.ClientOption
+
+func (sm GcpSecretManager) Write(serviceAccountName string, keyWrapper KeyWrapper, creds cred.Credentials) (updated UpdatedLocation, err error) {
+	provider := keyWrapper.KeyProvider
+	var key string
+	var keySecretName string
+	var keyIDSecretName string
+
+	if keySecretName, keyIDSecretName, err = sm.secretNames(provider); err != nil {
+		return
+	}
+
+	if sm.convertToFile(provider) {
+		if key, err = getKeyForFileBasedLocation(keyWrapper, sm.FileType); err != nil {
+			return
+		}
+	} else {
+		key = keyWrapper.Key
+	}
+	ctx := context.Background()
+	var svc *gcpsm.Service
+	if svc, err = sm.client(ctx); err != nil {
+		return
+	}
+
+	// older versions are only disabled or destroyed once every secret has
+	// been written to, so a failure part way through can be rolled back
+	newVersions := map[string]string{}
+	if len(keyIDSecretName) > 0 {
+		if newVersions[keyIDSecretName], err = sm.addVersion(ctx, svc, keyIDSecretName,
+			keyWrapper.KeyID); err != nil {
+			return
+		}
+	}
+	if newVersions[keySecretName], err = sm.addVersion(ctx, svc, keySecretName, key); err != nil {
+		return
+	}
+	if len(sm.OldVersions) > 0 {
+		for secretName, newVersion := range newVersions {
+			if err = sm.retireOldVersions(ctx, svc, secretName, newVersion); err != nil {
+				return
+			}
+		}
+	}
+
+	locationIDs := []string{keySecretName}
+	if len(keyIDSecretName) > 0 {
+		locationIDs = []string{keyIDSecretName, keySecretName}
+	}
+	updated = UpdatedLocation{
+		LocationType: "GcpSecretManager",
+		LocationURI:  sm.Project,
+		LocationIDs:  locationIDs}
+	return
+}
+
+// Read captures the latest values of the secrets that Write updates
+func (sm GcpSecretManager) Read(serviceAccountName, keyProvider string, creds cred.Credentials) (snapshot Snapshot, err error) {
+	var keySecretName string
+	var keyIDSecretName string
+	if keySecretName, keyIDSecretName, err = sm.secretNames(keyProvider); err != nil {
+		return
+	}
+	ctx := context.Background()
+	var svc *gcpsm.Service
+	if svc, err = sm.client(ctx); err != nil {
+		return
+	}
+	snapshot = Snapshot{}
+	for _, secretName := range []string{keyIDSecretName, keySecretName} {
+		if len(secretName) == 0 {
+			continue
+		}
+		if snapshot[secretName], err = sm.latestValue(ctx, svc, secretName); err != nil {
+			return
+		}
+		if snapshot[secretName] == nil {
+			if snapshot[secretName+gcpLatestVersion], err = sm.latestVersion(ctx, svc, secretName); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Restore adds versions holding the values captured by Read. Secrets that
+// had no value beforehand have the versions added since Read disabled
+// instead.
+func (sm GcpSecretManager) Restore(serviceAccountName, keyProvider string, snapshot Snapshot, creds cred.Credentials) (err error) {
+	ctx := context.Background()
+	var svc *gcpsm.Service
+	if svc, err = sm.client(ctx); err != nil {
+		return
+	}
+	for secretName, secretValue := range snapshot {
+		if strings.HasSuffix(secretName, gcpLatestVersion) {
+			continue
+		}
+		if secretValue == nil {
+			if err = sm.disableVersionsAfter(ctx, svc, secretName,
+				snapshot[secretName+gcpLatestVersion]); err != nil {
+				return
+			}
+			continue
+		}
+		if _, err = sm.addVersion(ctx, svc, secretName, *secretValue); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// convertToFile returns true if the key should be written in a file format,
+// which is always the case for GCP keys
+func (sm GcpSecretManager) convertToFile(provider string) bool {
+	return sm.ConvertToFile || provider == "gcp"
+}
+
+// secretNames returns the names of the key and key ID secrets. The key ID
+// secret name is empty when the key is being converted to a file, as the file
+// holds the key ID
+func (sm GcpSecretManager) secretNames(provider string) (keySecretName, keyIDSecretName string, err error) {
+	var idValue bool
+	if keySecretName, err = getVarNameFromProvider(provider, sm.KeyParamName, idValue); err != nil {
+		return
+	}
+	if !sm.convertToFile(provider) {
+		idValue = true
+		keyIDSecretName, err = getVarNameFromProvider(provider, sm.KeyIDParamName, idValue)
+	}
+	return
+}
+
+func (sm GcpSecretManager) client(ctx context.Context) (*gcpsm.Service, error) {
+	return gcpsm.NewService(ctx, gcpSecretManagerOptions...)
+}
+
+func (sm GcpSecretManager) secretPath(secretName string) string {
+	return fmt.Sprintf("projects/%s/secrets/%s", sm.Project, secretName)
+}
+
+// addVersion adds a version holding the value to the secret, creating the
+// secret first if it's missing and CreateIfMissing is set. The name of the
+// new version is returned.
+func (sm GcpSecretManager) addVersion(ctx context.Context, svc *gcpsm.Service,
+	secretName, value string) (versionName string, err error) {
+	request := &gcpsm.AddSecretVersionRequest{
+		Payload: &gcpsm.SecretPayload{Data: b64.StdEncoding.EncodeToString([]byte(value))},
+	}
+	var version *gcpsm.SecretVersion
+	version, err = svc.Projects.Secrets.AddVersion(sm.secretPath(secretName), request).Context(ctx).Do()
+	if isGoogleAPIError(err, http.StatusNotFound) && sm.CreateIfMissing {
+		if err = sm.createSecret(ctx, svc, secretName); err != nil {
+			return
+		}
+		version, err = svc.Projects.Secrets.AddVersion(sm.secretPath(secretName), request).Context(ctx).Do()
+	}
+	if err != nil {
+		return
+	}
+	logger.Infof("Added version: %s to GCP secret: %s", version.Name, secretName)
+	versionName = version.Name
+	return
+}
+
+// createSecret creates the secret, with the configured labels and replication
+func (sm GcpSecretManager) createSecret(ctx context.Context, svc *gcpsm.Service, secretName string) (err error) {
+	replication := &gcpsm.Replication{Automatic: &gcpsm.Automatic{}}
+	if len(sm.ReplicationLocations) > 0 {
+		userManaged := &gcpsm.UserManaged{}
+		for _, replicaLocation := range sm.ReplicationLocations {
+			userManaged.Replicas = append(userManaged.Replicas, &gcpsm.Replica{Location: replicaLocation})
+		}
+		replication = &gcpsm.Replication{UserManaged: userManaged}
+	}
+	secret := &gcpsm.Secret{Labels: sm.Labels, Replication: replication}
+	if _, err = svc.Projects.Secrets.Create("projects/"+sm.Project, secret).
+		SecretId(secretName).Context(ctx).Do(); err != nil {
+		return
+	}
+	logger.Infof("Created GCP secret: %s in project: %s", secretName, sm.Project)
+	return
+}
+
+// latestValue returns the value of the latest version of the secret, or nil
+// if the secret doesn't exist or its latest version isn't enabled
+func (sm GcpSecretManager) latestValue(ctx context.Context, svc *gcpsm.Service,
+	secretName string) (value *string, err error) {
+	var resp *gcpsm.AccessSecretVersionResponse
+	if resp, err = svc.Projects.Secrets.Versions.Access(sm.secretPath(secretName) +
+		"/versions/latest").Context(ctx).Do(); err != nil {
+		// a disabled or destroyed version is a failed precondition
+		if isGoogleAPIError(err, http.StatusNotFound) || isGoogleAPIError(err, http.StatusBadRequest) {
+			err = nil
+		}
+		return
+	}
+	var data []byte
+	if data, err = b64.StdEncoding.DecodeString(resp.Payload.Data); err != nil {
+		return
+	}
+	s := string(data)
+	value = &s
+	return
+}
+
+// latestVersion returns the name of the latest version of the secret,
+// whatever its state, or nil if the secret doesn't exist or has no versions
+func (sm GcpSecretManager) latestVersion(ctx context.Context, svc *gcpsm.Service,
+	secretName string) (versionName *string, err error) {
+	var version *gcpsm.SecretVersion
+	if version, err = svc.Projects.Secrets.Versions.Get(sm.secretPath(secretName) +
+		"/versions/latest").Context(ctx).Do(); err != nil {
+		if isGoogleAPIError(err, http.StatusNotFound) {
+			err = nil
+		}
+		return
+	}
+	versionName = &version.Name
+	return
+}
+
+// enabledVersions returns the names of the secret's enabled versions
+func (sm GcpSecretManager) enabledVersions(ctx context.Context, svc *gcpsm.Service,
+	secretName string) (versionNames []string, err error) {
+	err = svc.Projects.Secrets.Versions.List(sm.secretPath(secretName)).Filter("state:ENABLED").
+		Pages(ctx, func(resp *gcpsm.ListSecretVersionsResponse) error {
+			for _, version := range resp.Versions {
+				versionNames = append(versionNames, version.Name)
+			}
+			return nil
+		})
+	return
+}
+
+// retireOldVersions disables or destroys (according to OldVersions) the
+// secret's enabled versions, other than the new version
+func (sm GcpSecretManager) retireOldVersions(ctx context.Context, svc *gcpsm.Service,
+	secretName, newVersionName string) (err error) {
+	var versionNames []string
+	if versionNames, err = sm.enabledVersions(ctx, svc, secretName); err != nil {
+		return
+	}
+	for _, versionName := range versionNames {
+		if versionName == newVersionName {
+			continue
+		}
+		switch sm.OldVersions {
+		case OldVersionsDisable:
+			_, err = svc.Projects.Secrets.Versions.Disable(versionName,
+				&gcpsm.DisableSecretVersionRequest{}).Context(ctx).Do()
+		case OldVersionsDestroy:
+			_, err = svc.Projects.Secrets.Versions.Destroy(versionName,
+				&gcpsm.DestroySecretVersionRequest{}).Context(ctx).Do()
+		default:
+			err = fmt.Errorf("OldVersions: %s is not supported", sm.OldVersions)
+		}
+		if err != nil {
+			return
+		}
+		logger.Infow("Old version of GCP secret retired",
+			"secret", secretName,
+			"version", versionName,
+			"action", sm.OldVersions)
+	}
+	return
+}
+
+// disableVersionsAfter disables the secret's enabled versions that were
+// added after the version named (all of them, if it's nil), leaving the
+// versions that were enabled before as they are
+func (sm GcpSecretManager) disableVersionsAfter(ctx context.Context, svc *gcpsm.Service,
+	secretName string, lastVersionName *string) (err error) {
+	var lastVersion int
+	if lastVersionName != nil {
+		if lastVersion, err = strconv.Atoi(path.Base(*lastVersionName)); err != nil {
+			return
+		}
+	}
+	var versionNames []string
+	if versionNames, err = sm.enabledVersions(ctx, svc, secretName); err != nil {
+		if isGoogleAPIError(err, http.StatusNotFound) {
+			err = nil
+		}
+		return
+	}
+	for _, versionName := range versionNames {
+		var version int
+		if version, err = strconv.Atoi(path.Base(versionName)); err != nil {
+			return
+		}
+		if version <= lastVersion {
+			continue
+		}
+		if _, err = svc.Projects.Secrets.Versions.Disable(versionName,
+			&gcpsm.DisableSecretVersionRequest{}).Context(ctx).Do(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// isGoogleAPIError returns true if the error is a Google API error with the
+// HTTP status code supplied
+func isGoogleAPIError(err error, code int) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
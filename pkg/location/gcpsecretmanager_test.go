@@ -0,0 +1,274 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package location
+
+import (
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ovotech/cloud-key-rotator/pkg/cred"
+	"google.golang.org/api/option"
+	gcpsm "google.golang.org/api/secretmanager/v1"
+)
+
+const fakeSecretsPath = "/v1/projects/my-project/secrets"
+
+// fakeSecretManager is a GCP Secret Manager server, holding the versions of
+// each secret in my-project
+type fakeSecretManager struct {
+	mutex   sync.Mutex
+	secrets map[string][]*gcpsm.SecretVersion
+	data    map[string]string
+	created map[string]*gcpsm.Secret
+}
+
+func (f *fakeSecretManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	rest := strings.TrimPrefix(r.URL.Path, fakeSecretsPath)
+	var secretName string
+	var versionNum int
+	if parts := strings.Split(strings.Split(strings.Trim(rest, "/"), ":")[0], "/"); len(parts) > 0 {
+		secretName = parts[0]
+		if len(parts) == 3 {
+			versionNum, _ = strconv.Atoi(parts[2])
+		}
+	}
+	versions, exists := f.secrets[secretName]
+	if len(secretName) > 0 && !exists {
+		googleErrorResponse(w, http.StatusNotFound)
+		return
+	}
+	switch {
+	case len(rest) == 0:
+		var secret gcpsm.Secret
+		json.NewDecoder(r.Body).Decode(&secret)
+		f.created[r.URL.Query().Get("secretId")] = &secret
+		f.secrets[r.URL.Query().Get("secretId")] = nil
+		json.NewEncoder(w).Encode(secret)
+	case strings.HasSuffix(rest, ":addVersion"):
+		var request gcpsm.AddSecretVersionRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		version := &gcpsm.SecretVersion{State: "ENABLED",
+			Name: fmt.Sprintf("projects/my-project/secrets/%s/versions/%d", secretName, len(versions)+1)}
+		f.secrets[secretName] = append(versions, version)
+		f.data[version.Name] = request.Payload.Data
+		json.NewEncoder(w).Encode(version)
+	case strings.HasSuffix(rest, "/versions/latest:access"):
+		if len(versions) == 0 {
+			googleErrorResponse(w, http.StatusNotFound)
+			return
+		}
+		latest := versions[len(versions)-1]
+		if latest.State != "ENABLED" {
+			googleErrorResponse(w, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(gcpsm.AccessSecretVersionResponse{Name: latest.Name,
+			Payload: &gcpsm.SecretPayload{Data: f.data[latest.Name]}})
+	case strings.HasSuffix(rest, "/versions/latest"):
+		if len(versions) == 0 {
+			googleErrorResponse(w, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(versions[len(versions)-1])
+	case strings.HasSuffix(rest, "/versions"):
+		response := gcpsm.ListSecretVersionsResponse{}
+		for _, version := range versions {
+			if r.URL.Query().Get("filter") != "state:ENABLED" || version.State == "ENABLED" {
+				response.Versions = append(response.Versions, version)
+			}
+		}
+		json.NewEncoder(w).Encode(response)
+	case strings.HasSuffix(rest, ":disable"), strings.HasSuffix(rest, ":destroy"):
+		version := versions[versionNum-1]
+		version.State = "DISABLED"
+		if strings.HasSuffix(rest, ":destroy") {
+			version.State = "DESTROYED"
+		}
+		json.NewEncoder(w).Encode(version)
+	default:
+		googleErrorResponse(w, http.StatusNotFound)
+	}
+}
+
+func googleErrorResponse(w http.ResponseWriter, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{
+		"code": code, "message": http.StatusText(code)}})
+}
+
+// newFakeSecretManager starts a fake Secret Manager server holding the
+// secrets supplied, each with a single version
+func newFakeSecretManager(t *testing.T, secrets map[string]string) *fakeSecretManager {
+	f := &fakeSecretManager{
+		secrets: map[string][]*gcpsm.SecretVersion{},
+		data:    map[string]string{},
+		created: map[string]*gcpsm.Secret{},
+	}
+	for secretName, value := range secrets {
+		versionName := fmt.Sprintf("projects/my-project/secrets/%s/versions/1", secretName)
+		f.secrets[secretName] = []*gcpsm.SecretVersion{{Name: versionName, State: "ENABLED"}}
+		f.data[versionName] = b64.StdEncoding.EncodeToString([]byte(value))
+	}
+	server := httptest.NewServer(f)
+	gcpSecretManagerOptions = []option.ClientOption{option.WithEndpoint(server.URL + "/"),
+		option.WithoutAuthentication()}
+	t.Cleanup(func() {
+		server.Close()
+		gcpSecretManagerOptions = nil
+	})
+	return f
+}
+
+// latest returns the value of the latest version of the secret, and the
+// states of all its versions
+func (f *fakeSecretManager) latest(secretName string) (value string, states []string) {
+	versions := f.secrets[secretName]
+	for _, version := range versions {
+		states = append(states, version.State)
+	}
+	if len(versions) > 0 {
+		data, _ := b64.StdEncoding.DecodeString(f.data[versions[len(versions)-1].Name])
+		value = string(data)
+	}
+	return
+}
+
+func TestGcpSecretManagerCreateIfMissing(t *testing.T) {
+	f := newFakeSecretManager(t, nil)
+	sm := GcpSecretManager{Project: "my-project", CreateIfMissing: true,
+		Labels: map[string]string{"team": "a"}, ReplicationLocations: []string{"europe-west2"}}
+
+	if _, err := sm.Write("sa", awsKeyWrapper, cred.Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for secretName, expected := range map[string]string{"AWS_ACCESS_KEY_ID": "new-id",
+		"AWS_SECRET_ACCESS_KEY": "new-secret"} {
+		if value, _ := f.latest(secretName); value != expected {
+			t.Errorf("Incorrect value of %s, want: %s, got: %s", secretName, expected, value)
+		}
+		secret := f.created[secretName]
+		if secret == nil || secret.Labels["team"] != "a" || secret.Replication.UserManaged == nil ||
+			secret.Replication.UserManaged.Replicas[0].Location != "europe-west2" {
+			t.Errorf("Incorrect secret created for %s: %+v", secretName, secret)
+		}
+	}
+}
+
+func TestGcpSecretManagerMissing(t *testing.T) {
+	newFakeSecretManager(t, nil)
+	sm := GcpSecretManager{Project: "my-project"}
+	if _, err := sm.Write("sa", awsKeyWrapper, cred.Credentials{}); err == nil {
+		t.Error("Expected error for missing secret, as CreateIfMissing isn't set")
+	}
+}
+
+var gcpSecretManagerOldVersionsTests = []struct {
+	oldVersions    string
+	expectedStates []string
+}{
+	{"", []string{"ENABLED", "ENABLED"}},
+	{OldVersionsDisable, []string{"DISABLED", "ENABLED"}},
+	{OldVersionsDestroy, []string{"DESTROYED", "ENABLED"}},
+}
+
+func TestGcpSecretManagerOldVersions(t *testing.T) {
+	for _, test := range gcpSecretManagerOldVersionsTests {
+		f := newFakeSecretManager(t, map[string]string{"GCLOUD_SERVICE_KEY": "old-key"})
+		sm := GcpSecretManager{Project: "my-project", OldVersions: test.oldVersions}
+
+		keyWrapper := KeyWrapper{Key: b64.StdEncoding.EncodeToString([]byte("new-key")), KeyProvider: "gcp"}
+		updated, err := sm.Write("sa", keyWrapper, cred.Credentials{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// GCP keys are converted to a file, so there's no key ID secret
+		if !reflect.DeepEqual(updated.LocationIDs, []string{"GCLOUD_SERVICE_KEY"}) {
+			t.Errorf("Incorrect location IDs: %v", updated.LocationIDs)
+		}
+
+		value, states := f.latest("GCLOUD_SERVICE_KEY")
+		if value != "new-key" || !reflect.DeepEqual(states, test.expectedStates) {
+			t.Errorf("OldVersions %q: incorrect versions, want: new-key %v, got: %s %v",
+				test.oldVersions, test.expectedStates, value, states)
+		}
+	}
+}
+
+func TestGcpSecretManagerReadRestore(t *testing.T) {
+	f := newFakeSecretManager(t, map[string]string{"AWS_SECRET_ACCESS_KEY": "old-secret"})
+	sm := GcpSecretManager{Project: "my-project", CreateIfMissing: true, OldVersions: OldVersionsDestroy}
+
+	snapshot, err := sm.Read("sa", "aws", cred.Credentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot["AWS_ACCESS_KEY_ID"] != nil || *snapshot["AWS_SECRET_ACCESS_KEY"] != "old-secret" {
+		t.Fatalf("Incorrect snapshot: %v", snapshot)
+	}
+	if _, err = sm.Write("sa", awsKeyWrapper, cred.Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = sm.Restore("sa", "aws", snapshot, cred.Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the old value is restored even though its version was destroyed
+	if value, _ := f.latest("AWS_SECRET_ACCESS_KEY"); value != "old-secret" {
+		t.Errorf("Expected old value to be restored, got: %s", value)
+	}
+	// the key ID secret was created by Write, so has nothing enabled once
+	// restored
+	if _, states := f.latest("AWS_ACCESS_KEY_ID"); !reflect.DeepEqual(states, []string{"DISABLED"}) {
+		t.Errorf("Expected key ID secret's version to be disabled, got: %v", states)
+	}
+}
+
+func TestGcpSecretManagerRestoreDisabledLatest(t *testing.T) {
+	f := newFakeSecretManager(t, map[string]string{"AWS_SECRET_ACCESS_KEY": "old-secret",
+		"AWS_ACCESS_KEY_ID": "old-id"})
+	f.secrets["AWS_ACCESS_KEY_ID"] = append(f.secrets["AWS_ACCESS_KEY_ID"], &gcpsm.SecretVersion{
+		Name: "projects/my-project/secrets/AWS_ACCESS_KEY_ID/versions/2", State: "DISABLED"})
+	sm := GcpSecretManager{Project: "my-project"}
+
+	snapshot, err := sm.Read("sa", "aws", cred.Credentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sm.Write("sa", awsKeyWrapper, cred.Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = sm.Restore("sa", "aws", snapshot, cred.Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the version added by Write is disabled, not the enabled version
+	// before the disabled latest version
+	expected := []string{"ENABLED", "DISABLED", "DISABLED"}
+	if _, states := f.latest("AWS_ACCESS_KEY_ID"); !reflect.DeepEqual(states, expected) {
+		t.Errorf("Incorrect key ID secret versions, want: %v, got: %v", expected, states)
+	}
+}
@@ -16,7 +16,9 @@ package location
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 
 	"cloud.google.com/go/storage"
 	"github.com/ovotech/cloud-key-rotator/pkg/cred"
@@ -54,3 +56,52 @@ func (gcs Gcs) Write(serviceAccountName string, keyWrapper KeyWrapper, creds cre
 		LocationIDs:  []string{gcs.ObjectName}}
 	return
 }
+
+// Read captures the current contents of the GCS object that Write updates
+func (gcs Gcs) Read(serviceAccountName, keyProvider string, creds cred.Credentials) (snapshot Snapshot, err error) {
+	ctx := context.Background()
+	var client *storage.Client
+	if client, err = storage.NewClient(ctx); err != nil {
+		return
+	}
+	snapshot = Snapshot{gcs.ObjectName: nil}
+	var rc *storage.Reader
+	if rc, err = client.Bucket(gcs.BucketName).Object(gcs.ObjectName).NewReader(ctx); err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			err = nil
+		}
+		return
+	}
+	defer rc.Close()
+	var data []byte
+	if data, err = ioutil.ReadAll(rc); err != nil {
+		return
+	}
+	contents := string(data)
+	snapshot[gcs.ObjectName] = &contents
+	return
+}
+
+// Restore puts the GCS object back to the contents captured by Read, deleting
+// the object if it didn't exist beforehand
+func (gcs Gcs) Restore(serviceAccountName, keyProvider string, snapshot Snapshot, creds cred.Credentials) (err error) {
+	ctx := context.Background()
+	var client *storage.Client
+	if client, err = storage.NewClient(ctx); err != nil {
+		return
+	}
+	obj := client.Bucket(gcs.BucketName).Object(gcs.ObjectName)
+	contents, ok := snapshot[gcs.ObjectName]
+	if !ok {
+		return
+	}
+	if contents == nil {
+		return obj.Delete(ctx)
+	}
+	w := obj.NewWriter(ctx)
+	if _, err = w.Write([]byte(*contents)); err != nil {
+		w.Close()
+		return
+	}
+	return w.Close()
+}
@@ -38,10 +38,14 @@ type Git struct {
 	OrgRepo               string
 	VerifyCircleCISuccess bool
 	CircleCIDeployJobName string
+	CredentialsRef        string
 }
 
 func (git Git) Write(serviceAccountName string, keyWrapper KeyWrapper, creds cred.Credentials) (updated UpdatedLocation, err error) {
 
+	if creds.GitAccount, err = creds.GitAccountFor(git.CredentialsRef); err != nil {
+		return
+	}
 	if len(creds.KmsKey) == 0 {
 		err = errors.New("Not updating un-encrypted new key in a Git repository. Use the" +
 			"'KmsKey' field in config to specify the KMS key to use for encryption")
@@ -52,7 +56,11 @@ func (git Git) Write(serviceAccountName string, keyWrapper KeyWrapper, creds cre
 		return
 	}
 
-	const localDir = "/etc/cloud-key-rotator/cloud-key-rotator-tmp-repo"
+	// each write uses its own directory, so concurrent rotations don't clash
+	var localDir string
+	if localDir, err = ioutil.TempDir("", "cloud-key-rotator-tmp-repo"); err != nil {
+		return
+	}
 
 	defer os.RemoveAll(localDir)
 
@@ -24,17 +24,21 @@ type GitHubActionsService interface {
 
 // GitHub type
 type GitHub struct {
-	Base64Decode bool
-	Env          string
-	KeyIDEnvVar  string
-	KeyEnvVar    string
-	Owner        string
-	Repo         string
+	Base64Decode   bool
+	Env            string
+	KeyIDEnvVar    string
+	KeyEnvVar      string
+	Owner          string
+	Repo           string
+	CredentialsRef string
 }
 
 func (github GitHub) Write(serviceAccountName string, keyWrapper KeyWrapper, creds cred.Credentials) (updated UpdatedLocation, err error) {
 
 	logger.Infof("Starting GitHub env var updates, owner: %s, repo: %s", github.Owner, github.Repo)
+	if creds.GitHubAPIToken, err = creds.GitHubAPITokenFor(github.CredentialsRef); err != nil {
+		return
+	}
 	ctx, client, err := githubAuth(creds.GitHubAPIToken)
 	provider := keyWrapper.KeyProvider
 	key := keyWrapper.Key
@@ -24,12 +24,16 @@ import (
 
 // Gocd type
 type Gocd struct {
-	EnvName     string
-	KeyIDEnvVar string
-	KeyEnvVar   string
+	EnvName        string
+	KeyIDEnvVar    string
+	KeyEnvVar      string
+	CredentialsRef string
 }
 
 func (gocd Gocd) Write(serviceAccountName string, keyWrapper KeyWrapper, creds cred.Credentials) (updated UpdatedLocation, err error) {
+	if creds.GocdServer, err = creds.GocdServerFor(gocd.CredentialsRef); err != nil {
+		return
+	}
 	keyIDEnvVarName := gocd.KeyIDEnvVar
 	envName := gocd.EnvName
 	// only support secure Gocd env vars
@@ -25,20 +25,46 @@ import (
 	"golang.org/x/oauth2/google"
 	gkev1 "google.golang.org/api/container/v1"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
-// K8s type
+// K8s type holds a secret in a Kubernetes cluster. The cluster is either a
+// GKE cluster looked up via the GKE API, using Project, Location and
+// ClusterName, or any other cluster, reached using Context in the Kubeconfig
+// file (either of which can be left unset, to use the default kubeconfig or
+// its current context), or using the service account of the pod
+// cloud-key-rotator runs in, if InCluster is set.
+//
+// The key is written to DataName, and the key ID to KeyIDDataName (if it's
+// set and the key isn't converted to a file, as GCP keys always are). Unless
+// Merge is set, any other data in the secret is removed. If CreateIfMissing is
+// set, a secret that doesn't exist is created with the Labels and Annotations
+// supplied. Once the secret is updated, the RestartWorkloads are restarted,
+// and the write only succeeds if they roll out within RolloutTimeoutMins.
 type K8s struct {
-	Project     string
-	Location    string
-	ClusterName string
-	Namespace   string
-	SecretName  string
-	DataName    string
+	Project            string
+	Location           string
+	ClusterName        string
+	Kubeconfig         string
+	Context            string
+	InCluster          bool
+	Namespace          string
+	SecretName         string
+	DataName           string
+	KeyIDDataName      string
+	ConvertToFile      bool
+	FileType           string
+	Merge              bool
+	CreateIfMissing    bool
+	Labels             map[string]string
+	Annotations        map[string]string
+	RestartWorkloads   []K8sWorkload
+	RolloutTimeoutMins int
 }
 
 // googleAuthProvider type
@@ -54,8 +80,19 @@ var (
 	// logger                   = log.StdoutLogger()
 )
 
+// newK8sClient creates the clientset for a K8s location, and is replaced in
+// tests by one returning a fake clientset
+var newK8sClient = func(ctx context.Context, k8s K8s) (kubernetes.Interface, error) {
+	return k8s.client(ctx)
+}
+
 const googleAuthPlugin = "google" // so that this is different than "gcp" that's already in client-go tree.
 
+// k8sSecretMissing is the snapshot entry recorded by Read when the secret
+// doesn't exist yet (and will be created by Write), so that Restore deletes
+// it. It can't be mistaken for a data name, as those can't contain a "/".
+const k8sSecretMissing = "/secret-missing"
+
 func init() {
 	if err := rest.RegisterAuthProviderPlugin(googleAuthPlugin, newGoogleAuthProvider); err != nil {
 		logger.Fatalf("Failed to register %s auth plugin: %v", googleAuthPlugin, err)
@@ -63,19 +100,35 @@ func init() {
 }
 
 func (k8s K8s) Write(serviceAccountName string, keyWrapper KeyWrapper, creds cred.Credentials) (updated UpdatedLocation, err error) {
-	var cluster *gkev1.Cluster
 	ctx := context.Background()
 
-	if cluster, err = gkeCluster(ctx, k8s.Project, k8s.Location, k8s.ClusterName); err != nil {
-		return
+	var key string
+	data := map[string][]byte{}
+	if k8s.convertToFile(keyWrapper.KeyProvider) {
+		if key, err = getKeyForFileBasedLocation(keyWrapper, k8s.FileType); err != nil {
+			return
+		}
+	} else {
+		key = keyWrapper.Key
+		if len(k8s.KeyIDDataName) > 0 {
+			data[k8s.KeyIDDataName] = []byte(keyWrapper.KeyID)
+		}
 	}
+	data[k8s.DataName] = []byte(key)
 
-	var k8sClient *kubernetes.Clientset
-	if k8sClient, err = kubernetesClient(cluster); err != nil {
+	var k8sClient kubernetes.Interface
+	if k8sClient, err = newK8sClient(ctx, k8s); err != nil {
 		return
 	}
 
-	if _, err = updateK8sSecret(ctx, k8s.SecretName, k8s.DataName, k8s.Namespace, keyWrapper.Key, k8sClient); err != nil {
+	// the secret isn't updated if its workloads can't be restarted
+	if err = k8s.checkWorkloads(ctx, k8sClient); err != nil {
+		return
+	}
+	if _, err = k8s.updateSecret(ctx, k8sClient, data); err != nil {
+		return
+	}
+	if err = k8s.restartWorkloads(ctx, k8sClient); err != nil {
 		return
 	}
 
@@ -83,10 +136,161 @@ func (k8s K8s) Write(serviceAccountName string, keyWrapper KeyWrapper, creds cre
 		LocationType: "K8S",
 		LocationURI:  k8s.Project,
 		LocationIDs:  []string{k8s.Location}}
+	if !k8s.InGKE() {
+		updated.LocationURI = k8s.clusterDescription()
+		updated.LocationIDs = []string{k8s.Namespace + "/" + k8s.SecretName}
+	}
+
+	return
+}
+
+// Read captures the data that Write updates: the whole of the secret's data,
+// or just the data names that are written to if Merge is set
+func (k8s K8s) Read(serviceAccountName, keyProvider string, creds cred.Credentials) (snapshot Snapshot, err error) {
+	ctx := context.Background()
+
+	var k8sClient kubernetes.Interface
+	if k8sClient, err = newK8sClient(ctx, k8s); err != nil {
+		return
+	}
+
+	var secret *v1.Secret
+	if secret, err = k8sClient.CoreV1().Secrets(k8s.Namespace).Get(ctx, k8s.SecretName,
+		metav1.GetOptions{}); err != nil {
+		if !apierrors.IsNotFound(err) || !k8s.CreateIfMissing {
+			return
+		}
+		err = nil
+		snapshot = Snapshot{k8sSecretMissing: nil}
+		return
+	}
+	snapshot = Snapshot{}
+	for _, dataName := range k8s.dataNames(keyProvider) {
+		snapshot[dataName] = nil
+	}
+	for dataName, data := range secret.Data {
+		if _, written := snapshot[dataName]; written || !k8s.Merge {
+			value := string(data)
+			snapshot[dataName] = &value
+		}
+	}
+	return
+}
+
+// Restore puts the secret's data back to that captured by Read, or deletes
+// the secret if Write created it
+func (k8s K8s) Restore(serviceAccountName, keyProvider string, snapshot Snapshot, creds cred.Credentials) (err error) {
+	ctx := context.Background()
+
+	var k8sClient kubernetes.Interface
+	if k8sClient, err = newK8sClient(ctx, k8s); err != nil {
+		return
+	}
+
+	if _, missing := snapshot[k8sSecretMissing]; missing {
+		err = k8sClient.CoreV1().Secrets(k8s.Namespace).Delete(ctx, k8s.SecretName, metav1.DeleteOptions{})
+		switch {
+		case apierrors.IsNotFound(err):
+			// the write failed before the secret was created
+			return nil
+		case err != nil:
+			return
+		}
+		logger.Infof("Deleted k8s secret: %s/%s, which didn't exist before it was written to",
+			k8s.Namespace, k8s.SecretName)
+		return k8s.restartWorkloads(ctx, k8sClient)
+	}
+
+	var secret *v1.Secret
+	if secret, err = k8sClient.CoreV1().Secrets(k8s.Namespace).Get(ctx, k8s.SecretName,
+		metav1.GetOptions{}); err != nil {
+		return
+	}
+	if !k8s.Merge || secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	for dataName, value := range snapshot {
+		if value == nil {
+			delete(secret.Data, dataName)
+			continue
+		}
+		secret.Data[dataName] = []byte(*value)
+	}
+	if _, err = k8s.update(ctx, k8sClient, secret); err != nil {
+		return
+	}
+	// the workloads are restarted again, so their pods go back to the old key
+	return k8s.restartWorkloads(ctx, k8sClient)
+}
 
+// convertToFile returns true if the key should be written in a file format,
+// which is always the case for GCP keys
+func (k8s K8s) convertToFile(provider string) bool {
+	return k8s.ConvertToFile || provider == "gcp"
+}
+
+// dataNames returns the names of the secret's data that Write updates. The
+// key ID isn't written separately when the key is being converted to a file,
+// as the file holds the key ID
+func (k8s K8s) dataNames(provider string) (dataNames []string) {
+	dataNames = []string{k8s.DataName}
+	if len(k8s.KeyIDDataName) > 0 && !k8s.convertToFile(provider) {
+		dataNames = append(dataNames, k8s.KeyIDDataName)
+	}
 	return
 }
 
+// InGKE returns true if the secret is in a GKE cluster that's looked up via
+// the GKE API, rather than reached using a kubeconfig or in-cluster config
+func (k8s K8s) InGKE() bool {
+	return !k8s.InCluster && len(k8s.Kubeconfig) == 0 && len(k8s.Context) == 0
+}
+
+// clusterDescription describes the cluster holding the secret, for a cluster
+// that isn't looked up via the GKE API
+func (k8s K8s) clusterDescription() string {
+	if k8s.InCluster {
+		return "in-cluster"
+	}
+	kubeconfig := k8s.Kubeconfig
+	if len(kubeconfig) == 0 {
+		kubeconfig = "default kubeconfig"
+	}
+	kubeContext := k8s.Context
+	if len(kubeContext) == 0 {
+		kubeContext = "current context"
+	}
+	return fmt.Sprintf("%s (%s)", kubeconfig, kubeContext)
+}
+
+// client creates a kubernetes clientset for the cluster holding the secret
+func (k8s K8s) client(ctx context.Context) (k8sClient kubernetes.Interface, err error) {
+	if !k8s.InGKE() {
+		var restConfig *rest.Config
+		if restConfig, err = k8s.restConfig(); err != nil {
+			return
+		}
+		return kubernetes.NewForConfig(restConfig)
+	}
+	var cluster *gkev1.Cluster
+	if cluster, err = gkeCluster(ctx, k8s.Project, k8s.Location, k8s.ClusterName); err != nil {
+		return
+	}
+	return kubernetesClient(cluster)
+}
+
+// restConfig returns the config for a cluster that isn't looked up via the
+// GKE API, which is either the in-cluster config or from a kubeconfig
+func (k8s K8s) restConfig() (*rest.Config, error) {
+	if k8s.InCluster {
+		return rest.InClusterConfig()
+	}
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = k8s.Kubeconfig
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules,
+		&clientcmd.ConfigOverrides{CurrentContext: k8s.Context}).ClientConfig()
+}
+
 // kubernetesClient creates a kubernetes clientset
 func kubernetesClient(cluster *gkev1.Cluster) (k8sclient *kubernetes.Clientset, err error) {
 	var decodedClientCertificate []byte
@@ -136,21 +340,51 @@ func newGoogleAuthProvider(addr string, config map[string]string,
 	return &googleAuthProvider{tokenSource: ts}, nil
 }
 
-// updateK8sSecret updates a specific namespace/secret/data with the key string
-func updateK8sSecret(ctx context.Context, secretName, dataName, namespace, key string,
-	k8sclient *kubernetes.Clientset) (newSecret *v1.Secret, err error) {
+// updateSecret writes the data to the secret, creating the secret (with the
+// configured labels and annotations) if it's missing and CreateIfMissing is
+// set. Unless Merge is set, the data replaces everything the secret held.
+func (k8s K8s) updateSecret(ctx context.Context, k8sClient kubernetes.Interface,
+	data map[string][]byte) (secret *v1.Secret, err error) {
 	logger.Info("Starting k8s secret updates")
-	var secret *v1.Secret
-	if secret, err = k8sclient.CoreV1().Secrets(namespace).Get(ctx, secretName,
-		metav1.GetOptions{}); err != nil {
+	secrets := k8sClient.CoreV1().Secrets(k8s.Namespace)
+	if secret, err = secrets.Get(ctx, k8s.SecretName, metav1.GetOptions{}); err != nil {
+		if !apierrors.IsNotFound(err) || !k8s.CreateIfMissing {
+			return
+		}
+		secret = &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        k8s.SecretName,
+				Namespace:   k8s.Namespace,
+				Labels:      k8s.Labels,
+				Annotations: k8s.Annotations,
+			},
+			Data: data,
+		}
+		if secret, err = secrets.Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+			return
+		}
+		logger.Infof("Created k8s secret: %s in namespace: %s", k8s.SecretName, k8s.Namespace)
 		return
 	}
-	var decodedKey []byte
-	if decodedKey, err = b64.StdEncoding.DecodeString(key); err != nil {
-		return
+	if !k8s.Merge || secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	for dataName, value := range data {
+		secret.Data[dataName] = value
 	}
-	secret.Data = map[string][]byte{dataName: decodedKey}
-	return k8sclient.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	return k8s.update(ctx, k8sClient, secret)
+}
+
+// update updates the secret. The resourceVersion it was read with is kept, so
+// the update fails if the secret has been changed since.
+func (k8s K8s) update(ctx context.Context, k8sClient kubernetes.Interface,
+	secret *v1.Secret) (updated *v1.Secret, err error) {
+	if updated, err = k8sClient.CoreV1().Secrets(k8s.Namespace).Update(ctx, secret,
+		metav1.UpdateOptions{}); apierrors.IsConflict(err) {
+		err = fmt.Errorf("k8s secret: %s/%s was changed by someone else while it was being updated: %w",
+			k8s.Namespace, k8s.SecretName, err)
+	}
+	return
 }
 
 // gkeCluster creates a GKE cluster struct
@@ -0,0 +1,306 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package location
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ovotech/cloud-key-rotator/pkg/cred"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+current-context: kind
+clusters:
+- name: kind
+  cluster:
+    server: https://127.0.0.1:6443
+- name: eks
+  cluster:
+    server: https://eks.example.com
+contexts:
+- name: kind
+  context:
+    cluster: kind
+    user: ckr
+- name: eks
+  context:
+    cluster: eks
+    user: ckr
+users:
+- name: ckr
+  user:
+    token: token
+`
+
+// useFakeK8sClient makes K8s locations use a fake clientset, holding the
+// objects supplied
+func useFakeK8sClient(t *testing.T, objects ...runtime.Object) *fake.Clientset {
+	client := fake.NewSimpleClientset(objects...)
+	newK8sClient = func(ctx context.Context, k8s K8s) (kubernetes.Interface, error) {
+		return client, nil
+	}
+	t.Cleanup(func() {
+		newK8sClient = func(ctx context.Context, k8s K8s) (kubernetes.Interface, error) {
+			return k8s.client(ctx)
+		}
+	})
+	return client
+}
+
+func testSecret(data map[string][]byte) *v1.Secret {
+	return &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "ckr-key", Namespace: "default"}, Data: data}
+}
+
+func getTestSecret(t *testing.T, client kubernetes.Interface) *v1.Secret {
+	secret, err := client.CoreV1().Secrets("default").Get(context.Background(), "ckr-key", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+var gcpKeyWrapper = KeyWrapper{Key: b64.StdEncoding.EncodeToString([]byte(`{"private_key_id": "new"}`)),
+	KeyID: "new", KeyProvider: "gcp"}
+
+func TestK8sWrite(t *testing.T) {
+	client := useFakeK8sClient(t, testSecret(map[string][]byte{"key.json": []byte("old")}))
+	k8s := K8s{Context: "eks", Namespace: "default", SecretName: "ckr-key", DataName: "key.json"}
+
+	updated, err := k8s.Write("sa", gcpKeyWrapper, cred.Credentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data := getTestSecret(t, client).Data; string(data["key.json"]) != `{"private_key_id": "new"}` {
+		t.Errorf("Incorrect secret data: %s", data)
+	}
+	if updated.LocationURI != "default kubeconfig (eks)" ||
+		!reflect.DeepEqual(updated.LocationIDs, []string{"default/ckr-key"}) {
+		t.Errorf("Incorrect updated location: %+v", updated)
+	}
+}
+
+func TestK8sReadRestore(t *testing.T) {
+	client := useFakeK8sClient(t, testSecret(map[string][]byte{"key.json": []byte("old"), "other": []byte("x")}))
+	k8s := K8s{InCluster: true, Namespace: "default", SecretName: "ckr-key", DataName: "key.json"}
+
+	snapshot, err := k8s.Read("sa", "gcp", cred.Credentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = k8s.Write("sa", gcpKeyWrapper, cred.Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = k8s.Restore("sa", "gcp", snapshot, cred.Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]byte{"key.json": []byte("old"), "other": []byte("x")}
+	if data := getTestSecret(t, client).Data; !reflect.DeepEqual(data, expected) {
+		t.Errorf("Incorrect restored secret data, want: %s, got: %s", expected, data)
+	}
+}
+
+func TestK8sWriteMissingSecret(t *testing.T) {
+	useFakeK8sClient(t)
+	k8s := K8s{InCluster: true, Namespace: "default", SecretName: "ckr-key", DataName: "key.json"}
+	if _, err := k8s.Write("sa", gcpKeyWrapper, cred.Credentials{}); err == nil {
+		t.Error("Expected error for missing secret")
+	}
+}
+
+var k8sWriteDataTests = []struct {
+	k8s          K8s
+	keyWrapper   KeyWrapper
+	expectedData map[string]string
+}{
+	{
+		K8s{DataName: "key.json"},
+		gcpKeyWrapper,
+		map[string]string{"key.json": `{"private_key_id": "new"}`},
+	},
+	{
+		K8s{DataName: "key.json", KeyIDDataName: "key-id", Merge: true},
+		gcpKeyWrapper,
+		map[string]string{"key.json": `{"private_key_id": "new"}`, "other": "x"},
+	},
+	{
+		K8s{DataName: "secret", KeyIDDataName: "id", Merge: true},
+		awsKeyWrapper,
+		map[string]string{"secret": "new-secret", "id": "new-id", "key.json": "old", "other": "x"},
+	},
+	{
+		K8s{DataName: "credentials", KeyIDDataName: "id", ConvertToFile: true},
+		awsKeyWrapper,
+		map[string]string{"credentials": "[default]\naws_access_key_id     = new-id\n" +
+			"aws_secret_access_key = new-secret\n"},
+	},
+	{
+		K8s{DataName: "credentials.json", ConvertToFile: true, FileType: "json"},
+		awsKeyWrapper,
+		map[string]string{"credentials.json": `{"aws_access_key_id":"new-id","aws_secret_access_key":"new-secret"}`},
+	},
+}
+
+func TestK8sWriteData(t *testing.T) {
+	for _, test := range k8sWriteDataTests {
+		client := useFakeK8sClient(t, testSecret(map[string][]byte{"key.json": []byte("old"), "other": []byte("x")}))
+		k8s := test.k8s
+		k8s.InCluster, k8s.Namespace, k8s.SecretName = true, "default", "ckr-key"
+
+		if _, err := k8s.Write("sa", test.keyWrapper, cred.Credentials{}); err != nil {
+			t.Fatal(err)
+		}
+
+		data := map[string]string{}
+		for dataName, value := range getTestSecret(t, client).Data {
+			data[dataName] = string(value)
+		}
+		if !reflect.DeepEqual(data, test.expectedData) {
+			t.Errorf("Incorrect secret data for %+v, want: %q, got: %q", test.k8s, test.expectedData, data)
+		}
+	}
+}
+
+func TestK8sCreateIfMissing(t *testing.T) {
+	client := useFakeK8sClient(t)
+	k8s := K8s{InCluster: true, Namespace: "default", SecretName: "ckr-key", DataName: "secret",
+		KeyIDDataName: "id", Merge: true, CreateIfMissing: true,
+		Labels: map[string]string{"team": "a"}, Annotations: map[string]string{"owner": "ckr"}}
+
+	snapshot, err := k8s.Read("sa", "aws", cred.Credentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snapshot, Snapshot{k8sSecretMissing: nil}) {
+		t.Errorf("Incorrect snapshot of missing secret: %v", snapshot)
+	}
+	if _, err = k8s.Write("sa", awsKeyWrapper, cred.Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := getTestSecret(t, client)
+	if string(secret.Data["secret"]) != "new-secret" || string(secret.Data["id"]) != "new-id" ||
+		secret.Labels["team"] != "a" || secret.Annotations["owner"] != "ckr" {
+		t.Errorf("Incorrect secret created: %+v", secret)
+	}
+
+	if err = k8s.Restore("sa", "aws", snapshot, cred.Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+	// the secret didn't exist beforehand, so is deleted
+	if _, err = client.CoreV1().Secrets("default").Get(context.Background(), "ckr-key",
+		metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected restored secret to be deleted, got: %v", err)
+	}
+}
+
+func TestK8sMergeReadRestore(t *testing.T) {
+	client := useFakeK8sClient(t, testSecret(map[string][]byte{"secret": []byte("old-secret"), "other": []byte("x")}))
+	k8s := K8s{InCluster: true, Namespace: "default", SecretName: "ckr-key", DataName: "secret",
+		KeyIDDataName: "id", Merge: true}
+
+	snapshot, err := k8s.Read("sa", "aws", cred.Credentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = k8s.Write("sa", awsKeyWrapper, cred.Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+	// data that isn't written to is changed by someone else in the meantime,
+	// which restoring mustn't undo
+	secret := getTestSecret(t, client)
+	secret.Data["other"] = []byte("y")
+	if _, err = client.CoreV1().Secrets("default").Update(context.Background(), secret,
+		metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = k8s.Restore("sa", "aws", snapshot, cred.Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]byte{"secret": []byte("old-secret"), "other": []byte("y")}
+	if data := getTestSecret(t, client).Data; !reflect.DeepEqual(data, expected) {
+		t.Errorf("Incorrect restored secret data, want: %s, got: %s", expected, data)
+	}
+}
+
+func TestK8sWriteConflict(t *testing.T) {
+	client := useFakeK8sClient(t, testSecret(map[string][]byte{"key.json": []byte("old")}))
+	client.PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "secrets"}, "ckr-key", nil)
+	})
+	k8s := K8s{InCluster: true, Namespace: "default", SecretName: "ckr-key", DataName: "key.json"}
+
+	_, err := k8s.Write("sa", gcpKeyWrapper, cred.Credentials{})
+	if err == nil || !strings.Contains(err.Error(), "changed by someone else") {
+		t.Errorf("Expected conflict error, got: %v", err)
+	}
+}
+
+func TestK8sRestConfig(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(kubeconfig, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for context, expectedHost := range map[string]string{
+		"":    "https://127.0.0.1:6443",
+		"eks": "https://eks.example.com",
+	} {
+		restConfig, err := K8s{Kubeconfig: kubeconfig, Context: context}.restConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restConfig.Host != expectedHost || restConfig.BearerToken != "token" {
+			t.Errorf("Incorrect config for context %q: %s", context, restConfig.Host)
+		}
+	}
+	if _, err := (K8s{Kubeconfig: kubeconfig, Context: "gke"}).restConfig(); err == nil {
+		t.Error("Expected error for unknown context")
+	}
+}
+
+var inGKETests = []struct {
+	k8s      K8s
+	expected bool
+}{
+	{K8s{Project: "my-project", Location: "europe-west2", ClusterName: "my-cluster"}, true},
+	{K8s{Kubeconfig: "/home/ckr/.kube/config"}, false},
+	{K8s{Context: "eks"}, false},
+	{K8s{InCluster: true}, false},
+}
+
+func TestInGKE(t *testing.T) {
+	for _, test := range inGKETests {
+		if inGKE := test.k8s.InGKE(); inGKE != test.expected {
+			t.Errorf("Incorrect InGKE for %+v, want: %t, got: %t", test.k8s, test.expected, inGKE)
+		}
+	}
+}
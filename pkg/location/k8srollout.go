@@ -0,0 +1,263 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package location
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Kinds of workload that can be restarted once a K8s secret is updated
+const (
+	K8sDeployment  = "Deployment"
+	K8sStatefulSet = "StatefulSet"
+	K8sDaemonSet   = "DaemonSet"
+)
+
+const (
+	// restartedAtAnnotation is the pod template annotation that
+	// `kubectl rollout restart` sets, to make a workload roll out new pods
+	restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+	// defaultRolloutTimeoutMins is how long restarted workloads have to roll
+	// out, if not configured
+	defaultRolloutTimeoutMins = 10
+)
+
+// rolloutPollInterval is how often the rollout status of restarted workloads
+// is checked
+var rolloutPollInterval = 5 * time.Second
+
+// K8sWorkload type is a Deployment, StatefulSet or DaemonSet that's restarted
+// once its K8s location's secret has been updated, so its pods pick up the
+// new key. Namespace defaults to the namespace of the secret.
+type K8sWorkload struct {
+	Kind      string
+	Name      string
+	Namespace string
+}
+
+func (workload K8sWorkload) String() string {
+	return fmt.Sprintf("%s %s/%s", workload.Kind, workload.Namespace, workload.Name)
+}
+
+// workloads returns the workloads to restart, with their namespaces defaulted
+func (k8s K8s) workloads() (workloads []K8sWorkload) {
+	for _, workload := range k8s.RestartWorkloads {
+		if len(workload.Namespace) == 0 {
+			workload.Namespace = k8s.Namespace
+		}
+		workloads = append(workloads, workload)
+	}
+	return
+}
+
+// restartWorkloads restarts each of the workloads in RestartWorkloads, then
+// waits for all of them to roll out. None of them are restarted unless all
+// of them can be.
+func (k8s K8s) restartWorkloads(ctx context.Context, k8sClient kubernetes.Interface) (err error) {
+	if len(k8s.RestartWorkloads) == 0 {
+		return
+	}
+	if err = k8s.checkWorkloads(ctx, k8sClient); err != nil {
+		return
+	}
+	restartedAt := time.Now().Format(time.RFC3339)
+	for _, workload := range k8s.workloads() {
+		if err = restartWorkload(ctx, k8sClient, workload, restartedAt); err != nil {
+			return
+		}
+		logger.Infof("Restarted k8s workload: %s", workload)
+	}
+	timeoutMins := k8s.RolloutTimeoutMins
+	if timeoutMins == 0 {
+		timeoutMins = defaultRolloutTimeoutMins
+	}
+	return k8s.waitForRollouts(ctx, k8sClient, time.Duration(timeoutMins)*time.Minute)
+}
+
+// checkWorkloads returns an error if any of the workloads in
+// RestartWorkloads can't be restarted, i.e. it doesn't exist, or is a
+// StatefulSet or DaemonSet that uses the OnDelete update strategy (so
+// patching it wouldn't replace its pods)
+func (k8s K8s) checkWorkloads(ctx context.Context, k8sClient kubernetes.Interface) (err error) {
+	apps := k8sClient.AppsV1()
+	for _, workload := range k8s.workloads() {
+		onDelete := false
+		switch workload.Kind {
+		case K8sDeployment:
+			_, err = apps.Deployments(workload.Namespace).Get(ctx, workload.Name, metav1.GetOptions{})
+		case K8sStatefulSet:
+			var statefulSet *appsv1.StatefulSet
+			if statefulSet, err = apps.StatefulSets(workload.Namespace).Get(ctx, workload.Name,
+				metav1.GetOptions{}); err == nil {
+				onDelete = statefulSet.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType
+			}
+		case K8sDaemonSet:
+			var daemonSet *appsv1.DaemonSet
+			if daemonSet, err = apps.DaemonSets(workload.Namespace).Get(ctx, workload.Name,
+				metav1.GetOptions{}); err == nil {
+				onDelete = daemonSet.Spec.UpdateStrategy.Type == appsv1.OnDeleteDaemonSetStrategyType
+			}
+		default:
+			err = fmt.Errorf("k8s workload kind: %s is not supported", workload.Kind)
+		}
+		if err != nil {
+			return
+		}
+		if onDelete {
+			return fmt.Errorf("k8s workload: %s uses the OnDelete update strategy, so can't be restarted",
+				workload)
+		}
+	}
+	return
+}
+
+// restartWorkload sets the restart annotation on the workload's pod template,
+// in the same way as `kubectl rollout restart`
+func restartWorkload(ctx context.Context, k8sClient kubernetes.Interface, workload K8sWorkload,
+	restartedAt string) (err error) {
+	patch := []byte(fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{%q:%q}}}}}`,
+		restartedAtAnnotation, restartedAt))
+	apps := k8sClient.AppsV1()
+	switch workload.Kind {
+	case K8sDeployment:
+		_, err = apps.Deployments(workload.Namespace).Patch(ctx, workload.Name,
+			types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	case K8sStatefulSet:
+		_, err = apps.StatefulSets(workload.Namespace).Patch(ctx, workload.Name,
+			types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	case K8sDaemonSet:
+		_, err = apps.DaemonSets(workload.Namespace).Patch(ctx, workload.Name,
+			types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	default:
+		err = fmt.Errorf("k8s workload kind: %s is not supported", workload.Kind)
+	}
+	return
+}
+
+// waitForRollouts waits for each of the workloads in RestartWorkloads to
+// finish rolling out, failing if they haven't all done so within the timeout
+func (k8s K8s) waitForRollouts(ctx context.Context, k8sClient kubernetes.Interface,
+	timeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for _, workload := range k8s.workloads() {
+		if err = wait.PollUntilContextCancel(ctx, rolloutPollInterval, true,
+			func(ctx context.Context) (bool, error) {
+				return rolledOut(ctx, k8sClient, workload)
+			}); err != nil {
+			if wait.Interrupted(err) {
+				err = fmt.Errorf("rollout of k8s workload: %s didn't complete within %s", workload, timeout)
+			}
+			return
+		}
+		logger.Infof("Rollout of k8s workload: %s complete", workload)
+	}
+	return
+}
+
+// rolledOut returns true if the workload has finished rolling out, using the
+// same checks as `kubectl rollout status`. An error is returned if the
+// rollout has failed, or can't be waited for.
+func rolledOut(ctx context.Context, k8sClient kubernetes.Interface, workload K8sWorkload) (done bool, err error) {
+	apps := k8sClient.AppsV1()
+	switch workload.Kind {
+	case K8sDeployment:
+		var deployment *appsv1.Deployment
+		if deployment, err = apps.Deployments(workload.Namespace).Get(ctx, workload.Name,
+			metav1.GetOptions{}); err != nil {
+			return
+		}
+		return deploymentRolledOut(deployment)
+	case K8sStatefulSet:
+		var statefulSet *appsv1.StatefulSet
+		if statefulSet, err = apps.StatefulSets(workload.Namespace).Get(ctx, workload.Name,
+			metav1.GetOptions{}); err != nil {
+			return
+		}
+		return statefulSetRolledOut(statefulSet)
+	case K8sDaemonSet:
+		var daemonSet *appsv1.DaemonSet
+		if daemonSet, err = apps.DaemonSets(workload.Namespace).Get(ctx, workload.Name,
+			metav1.GetOptions{}); err != nil {
+			return
+		}
+		return daemonSetRolledOut(daemonSet)
+	}
+	err = fmt.Errorf("k8s workload kind: %s is not supported", workload.Kind)
+	return
+}
+
+func deploymentRolledOut(deployment *appsv1.Deployment) (done bool, err error) {
+	if deployment.Generation > deployment.Status.ObservedGeneration {
+		return
+	}
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Reason == "ProgressDeadlineExceeded" {
+			err = fmt.Errorf("rollout of Deployment: %s/%s exceeded its progress deadline",
+				deployment.Namespace, deployment.Name)
+			return
+		}
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	status := deployment.Status
+	done = status.UpdatedReplicas >= replicas && status.Replicas <= status.UpdatedReplicas &&
+		status.AvailableReplicas >= status.UpdatedReplicas
+	return
+}
+
+// statefulSetRolledOut returns true once the StatefulSet's pods have all been
+// updated or, if it has a partition, just those with an ordinal at or above
+// the partition
+func statefulSetRolledOut(statefulSet *appsv1.StatefulSet) (done bool, err error) {
+	if statefulSet.Generation > statefulSet.Status.ObservedGeneration {
+		return
+	}
+	replicas := int32(1)
+	if statefulSet.Spec.Replicas != nil {
+		replicas = *statefulSet.Spec.Replicas
+	}
+	status := statefulSet.Status
+	if status.ReadyReplicas < replicas {
+		return
+	}
+	if rollingUpdate := statefulSet.Spec.UpdateStrategy.RollingUpdate; rollingUpdate != nil &&
+		rollingUpdate.Partition != nil && *rollingUpdate.Partition > 0 {
+		done = status.UpdatedReplicas >= replicas-*rollingUpdate.Partition
+		return
+	}
+	done = status.UpdatedReplicas >= replicas && status.CurrentRevision == status.UpdateRevision
+	return
+}
+
+func daemonSetRolledOut(daemonSet *appsv1.DaemonSet) (done bool, err error) {
+	if daemonSet.Generation > daemonSet.Status.ObservedGeneration {
+		return
+	}
+	status := daemonSet.Status
+	done = status.UpdatedNumberScheduled >= status.DesiredNumberScheduled &&
+		status.NumberAvailable >= status.DesiredNumberScheduled
+	return
+}
@@ -0,0 +1,195 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package location
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ovotech/cloud-key-rotator/pkg/cred"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testDeployment(name string, status appsv1.DeploymentStatus) *appsv1.Deployment {
+	return &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}, Status: status}
+}
+
+var rolledOutDeploymentStatus = appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+
+func TestK8sRestartWorkloads(t *testing.T) {
+	client := useFakeK8sClient(t,
+		testSecret(map[string][]byte{"key.json": []byte("old")}),
+		testDeployment("api", rolledOutDeploymentStatus),
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+			Status: appsv1.StatefulSetStatus{ReadyReplicas: 1, UpdatedReplicas: 1}},
+		&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "monitoring"}},
+	)
+	k8s := K8s{InCluster: true, Namespace: "default", SecretName: "ckr-key", DataName: "key.json",
+		RestartWorkloads: []K8sWorkload{
+			{Kind: K8sDeployment, Name: "api"},
+			{Kind: K8sStatefulSet, Name: "db"},
+			{Kind: K8sDaemonSet, Name: "agent", Namespace: "monitoring"},
+		}}
+
+	if _, err := k8s.Write("sa", gcpKeyWrapper, cred.Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	deployment, _ := client.AppsV1().Deployments("default").Get(ctx, "api", metav1.GetOptions{})
+	statefulSet, _ := client.AppsV1().StatefulSets("default").Get(ctx, "db", metav1.GetOptions{})
+	daemonSet, _ := client.AppsV1().DaemonSets("monitoring").Get(ctx, "agent", metav1.GetOptions{})
+	for workload, annotations := range map[string]map[string]string{
+		"api":   deployment.Spec.Template.Annotations,
+		"db":    statefulSet.Spec.Template.Annotations,
+		"agent": daemonSet.Spec.Template.Annotations,
+	} {
+		if _, err := time.Parse(time.RFC3339, annotations[restartedAtAnnotation]); err != nil {
+			t.Errorf("Expected %s to be restarted, got annotations: %v", workload, annotations)
+		}
+	}
+}
+
+func TestK8sRolloutFailure(t *testing.T) {
+	useFakeK8sClient(t,
+		testSecret(map[string][]byte{"key.json": []byte("old")}),
+		testDeployment("api", appsv1.DeploymentStatus{Conditions: []appsv1.DeploymentCondition{
+			{Type: appsv1.DeploymentProgressing, Reason: "ProgressDeadlineExceeded"}}}),
+	)
+	k8s := K8s{InCluster: true, Namespace: "default", SecretName: "ckr-key", DataName: "key.json",
+		RestartWorkloads: []K8sWorkload{{Kind: K8sDeployment, Name: "api"}}}
+
+	_, err := k8s.Write("sa", gcpKeyWrapper, cred.Credentials{})
+	if err == nil || !strings.Contains(err.Error(), "progress deadline") {
+		t.Errorf("Expected failed rollout to fail the write, got: %v", err)
+	}
+}
+
+func TestK8sRestartMissingWorkload(t *testing.T) {
+	useFakeK8sClient(t, testSecret(map[string][]byte{"key.json": []byte("old")}))
+	k8s := K8s{InCluster: true, Namespace: "default", SecretName: "ckr-key", DataName: "key.json",
+		RestartWorkloads: []K8sWorkload{{Kind: K8sDeployment, Name: "api"}}}
+
+	if _, err := k8s.Write("sa", gcpKeyWrapper, cred.Credentials{}); err == nil {
+		t.Error("Expected error for missing workload")
+	}
+}
+
+func TestK8sRestartOnDeleteWorkload(t *testing.T) {
+	client := useFakeK8sClient(t,
+		testSecret(map[string][]byte{"key.json": []byte("old")}),
+		testDeployment("api", rolledOutDeploymentStatus),
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+			Spec: appsv1.StatefulSetSpec{UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type: appsv1.OnDeleteStatefulSetStrategyType}}},
+	)
+	k8s := K8s{InCluster: true, Namespace: "default", SecretName: "ckr-key", DataName: "key.json",
+		RestartWorkloads: []K8sWorkload{
+			{Kind: K8sDeployment, Name: "api"},
+			{Kind: K8sStatefulSet, Name: "db"},
+		}}
+
+	_, err := k8s.Write("sa", gcpKeyWrapper, cred.Credentials{})
+	if err == nil || !strings.Contains(err.Error(), "OnDelete") {
+		t.Errorf("Expected OnDelete StatefulSet to fail the write, got: %v", err)
+	}
+
+	// nothing is changed, as the StatefulSet's pods wouldn't be replaced
+	if data := getTestSecret(t, client).Data["key.json"]; string(data) != "old" {
+		t.Errorf("Expected secret to be unchanged, got: %s", data)
+	}
+	deployment, _ := client.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if _, restarted := deployment.Spec.Template.Annotations[restartedAtAnnotation]; restarted {
+		t.Error("Expected Deployment not to be restarted")
+	}
+}
+
+func TestK8sRolloutTimeout(t *testing.T) {
+	interval := rolloutPollInterval
+	rolloutPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { rolloutPollInterval = interval })
+	client := useFakeK8sClient(t, testDeployment("api", appsv1.DeploymentStatus{Replicas: 2, UpdatedReplicas: 1}))
+	k8s := K8s{Namespace: "default", RestartWorkloads: []K8sWorkload{{Kind: K8sDeployment, Name: "api"}}}
+
+	err := k8s.waitForRollouts(context.Background(), client, 50*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "didn't complete") {
+		t.Errorf("Expected rollout to time out, got: %v", err)
+	}
+}
+
+var deploymentRolledOutTests = []struct {
+	status   appsv1.DeploymentStatus
+	expected bool
+}{
+	{rolledOutDeploymentStatus, true},
+	// old pods are still running
+	{appsv1.DeploymentStatus{Replicas: 2, UpdatedReplicas: 1, AvailableReplicas: 1}, false},
+	// new pods aren't available yet
+	{appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1}, false},
+	// the new generation hasn't been picked up yet
+	{appsv1.DeploymentStatus{ObservedGeneration: -1, Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}, false},
+}
+
+func TestDeploymentRolledOut(t *testing.T) {
+	for _, test := range deploymentRolledOutTests {
+		done, err := deploymentRolledOut(testDeployment("api", test.status))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done != test.expected {
+			t.Errorf("Incorrect rollout status for %+v, want: %t, got: %t", test.status, test.expected, done)
+		}
+	}
+}
+
+var statefulSetRolledOutTests = []struct {
+	partition int32
+	status    appsv1.StatefulSetStatus
+	expected  bool
+}{
+	{0, appsv1.StatefulSetStatus{ReadyReplicas: 3, UpdatedReplicas: 3}, true},
+	// old pods are still running
+	{0, appsv1.StatefulSetStatus{ReadyReplicas: 3, UpdatedReplicas: 1}, false},
+	// the pods below the partition aren't updated
+	{2, appsv1.StatefulSetStatus{ReadyReplicas: 3, UpdatedReplicas: 1, CurrentRevision: "a",
+		UpdateRevision: "b"}, true},
+	{1, appsv1.StatefulSetStatus{ReadyReplicas: 3, UpdatedReplicas: 1, CurrentRevision: "a",
+		UpdateRevision: "b"}, false},
+	// updated pods aren't ready yet
+	{2, appsv1.StatefulSetStatus{ReadyReplicas: 2, UpdatedReplicas: 1}, false},
+}
+
+func TestStatefulSetRolledOut(t *testing.T) {
+	replicas := int32(3)
+	for _, test := range statefulSetRolledOutTests {
+		partition := test.partition
+		statefulSet := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+			Spec: appsv1.StatefulSetSpec{Replicas: &replicas, UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition}}},
+			Status: test.status}
+		done, err := statefulSetRolledOut(statefulSet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done != test.expected {
+			t.Errorf("Incorrect rollout status for partition %d, %+v, want: %t, got: %t",
+				test.partition, test.status, test.expected, done)
+		}
+	}
+}
@@ -21,3 +21,27 @@ import "github.com/ovotech/cloud-key-rotator/pkg/cred"
 type KeyWriter interface {
 	Write(serviceAccountName string, keyWrapper KeyWrapper, creds cred.Credentials) (UpdatedLocation, error)
 }
+
+// KeyRestorer interface is implemented by locations that are able to capture
+// the values they hold before being written to, so they can be restored if a
+// rotation has to be rolled back
+type KeyRestorer interface {
+	KeyWriter
+	Read(serviceAccountName, keyProvider string, creds cred.Credentials) (Snapshot, error)
+	Restore(serviceAccountName, keyProvider string, snapshot Snapshot, creds cred.Credentials) error
+}
+
+// locations that are able to restore themselves
+var (
+	_ KeyRestorer = Gcs{}
+	_ KeyRestorer = GcpSecretManager{}
+	_ KeyRestorer = K8s{}
+	_ KeyRestorer = SecretsManager{}
+	_ KeyRestorer = Ssm{}
+	_ KeyRestorer = Vault{}
+)
+
+// Snapshot type holds the values held by a location before it was written to,
+// keyed by name (e.g. an SSM parameter name). A nil value means that nothing
+// was held under that name.
+type Snapshot map[string]*string
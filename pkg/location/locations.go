@@ -19,6 +19,7 @@ import (
 	b64 "encoding/base64"
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"gopkg.in/ini.v1"
 )
@@ -141,3 +142,59 @@ func getVarNameFromProvider(provider, suppliedVarName string, idValue bool) (env
 	}
 	return
 }
+
+// Describe returns a description of the location that names only its type and
+// the target it writes to (for the key provider supplied), so that it can be
+// logged or shown in a plan without exposing any of its other settings
+func Describe(keyWriter KeyWriter, provider string) string {
+	var locationType, target string
+	switch kw := keyWriter.(type) {
+	case Atlas:
+		locationType, target = "Atlas", "project "+kw.ProjectID
+	case CircleCI:
+		locationType, target = "CircleCI", kw.UsernameProject
+	case CircleCIContext:
+		locationType, target = "CircleCIContext", kw.ContextID
+	case Datadog:
+		locationType, target = "Datadog", kw.Project
+	case Gcs:
+		locationType, target = "GCS", fmt.Sprintf("gs://%s/%s", kw.BucketName, kw.ObjectName)
+	case GcpSecretManager:
+		locationType, target = "GcpSecretManager", kw.Project+" "+describeNames(kw.secretNames(provider))
+	case Git:
+		locationType, target = "Git", fmt.Sprintf("%s/%s", kw.OrgRepo, kw.Filepath)
+	case GitHub:
+		locationType, target = "GitHub", fmt.Sprintf("%s/%s", kw.Owner, kw.Repo)
+	case Gocd:
+		locationType, target = "Gocd", kw.EnvName
+	case K8s:
+		locationType, target = "K8s", fmt.Sprintf("%s/%s", kw.Namespace, kw.SecretName)
+		if kw.InGKE() {
+			target += " in cluster " + kw.ClusterName
+		} else if len(kw.Context) > 0 {
+			target += " in context " + kw.Context
+		}
+	case Ssm:
+		locationType, target = "SSM", kw.Region+" "+describeNames(kw.paramNames(provider))
+	case SecretsManager:
+		locationType, target = "SecretsManager", kw.Region+" "+describeNames(kw.secretNames(provider))
+	case Vault:
+		locationType, target = "Vault", fmt.Sprintf("%s %s", kw.Address, kw.Path)
+	default:
+		return strings.TrimPrefix(fmt.Sprintf("%T", keyWriter), "location.")
+	}
+	return fmt.Sprintf("%s (%s)", locationType, target)
+}
+
+// describeNames joins the names of the key and key ID params or secrets that
+// a location writes to, leaving out the key ID when it isn't written
+// separately
+func describeNames(keyName, keyIDName string, err error) string {
+	if err != nil {
+		return "(unsupported key provider)"
+	}
+	if len(keyIDName) == 0 {
+		return keyName
+	}
+	return keyName + ", " + keyIDName
+}
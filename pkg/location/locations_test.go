@@ -0,0 +1,45 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package location
+
+import "testing"
+
+var describeTests = []struct {
+	keyWriter KeyWriter
+	provider  string
+	expected  string
+}{
+	{CircleCI{UsernameProject: "ovotech/my-repo", KeyEnvVar: "KEY"}, "aws", "CircleCI (ovotech/my-repo)"},
+	{Gcs{BucketName: "bucket", ObjectName: "key.json"}, "gcp", "GCS (gs://bucket/key.json)"},
+	{K8s{Kubeconfig: "/home/ckr/.kube/config", Context: "eks", Namespace: "default", SecretName: "key"}, "gcp",
+		"K8s (default/key in context eks)"},
+	{Vault{Address: "https://vault", Path: "team-a/aws", CredentialsRef: "approle"}, "aws",
+		"Vault (https://vault team-a/aws)"},
+	{Ssm{Region: "eu-west-1", KeyParamName: "/ckr/key", KeyIDParamName: "/ckr/key-id"}, "aws",
+		"SSM (eu-west-1 /ckr/key, /ckr/key-id)"},
+	{SecretsManager{Region: "eu-west-1"}, "aws",
+		"SecretsManager (eu-west-1 AWS_SECRET_ACCESS_KEY, AWS_ACCESS_KEY_ID)"},
+	// GCP keys are written as a file, so there's no key ID secret
+	{GcpSecretManager{Project: "my-project", KeyParamName: "ckr-key"}, "gcp",
+		"GcpSecretManager (my-project ckr-key)"},
+}
+
+func TestDescribe(t *testing.T) {
+	for _, test := range describeTests {
+		if description := Describe(test.keyWriter, test.provider); description != test.expected {
+			t.Errorf("Incorrect description, want: %s, got: %s", test.expected, description)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	awsSm "github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/ovotech/cloud-key-rotator/pkg/cred"
@@ -23,29 +24,19 @@ func (sm SecretsManager) Write(serviceAccountName string, keyWrapper KeyWrapper,
 	var key string
 	var keyEnvVar string
 	var keyIDEnvVar string
-	var idValue bool
 
-	if keyEnvVar, err = getVarNameFromProvider(provider, sm.KeyParamName, idValue); err != nil {
+	if keyEnvVar, keyIDEnvVar, err = sm.secretNames(provider); err != nil {
 		return
 	}
 
-	if sm.ConvertToFile || provider == "gcp" {
+	if sm.convertToFile(provider) {
 		if key, err = getKeyForFileBasedLocation(keyWrapper, sm.FileType); err != nil {
 			return
 		}
 	} else {
 		key = keyWrapper.Key
-		idValue = true
-		if keyIDEnvVar, err = getVarNameFromProvider(provider, sm.KeyIDParamName, idValue); err != nil {
-			return
-		}
 	}
-	svc := awsSm.New(
-		session.New(),
-		aws.NewConfig().
-			WithRegion(sm.Region).
-			WithEndpoint(fmt.Sprintf("secretsmanager.%s.amazonaws.com", sm.Region)),
-	)
+	svc := sm.client()
 
 	if len(keyIDEnvVar) > 0 {
 		if err = updateSecretsManagerSecret(keyIDEnvVar, keyWrapper.KeyID, *svc); err != nil {
@@ -63,8 +54,88 @@ func (sm SecretsManager) Write(serviceAccountName string, keyWrapper KeyWrapper,
 	return
 }
 
+// Read captures the current values of the secrets that Write updates
+func (sm SecretsManager) Read(serviceAccountName, keyProvider string, creds cred.Credentials) (snapshot Snapshot, err error) {
+	var keySecretName string
+	var keyIDSecretName string
+	if keySecretName, keyIDSecretName, err = sm.secretNames(keyProvider); err != nil {
+		return
+	}
+	svc := sm.client()
+	snapshot = Snapshot{}
+	for _, secretName := range []string{keyIDSecretName, keySecretName} {
+		if len(secretName) == 0 {
+			continue
+		}
+		if snapshot[secretName], err = getSecretsManagerSecret(secretName, *svc); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Restore puts the secrets back to the values captured by Read. Secrets that
+// didn't exist beforehand are left alone, as Write is unable to create them.
+func (sm SecretsManager) Restore(serviceAccountName, keyProvider string, snapshot Snapshot, creds cred.Credentials) (err error) {
+	svc := sm.client()
+	for secretName, secretValue := range snapshot {
+		if secretValue == nil {
+			continue
+		}
+		if err = updateSecretsManagerSecret(secretName, *secretValue, *svc); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// convertToFile returns true if the key should be written in a file format,
+// which is always the case for GCP keys
+func (sm SecretsManager) convertToFile(provider string) bool {
+	return sm.ConvertToFile || provider == "gcp"
+}
+
+// secretNames returns the names of the key and key ID secrets. The key ID
+// secret name is empty when the key is being converted to a file, as the file
+// holds the key ID
+func (sm SecretsManager) secretNames(provider string) (keySecretName, keyIDSecretName string, err error) {
+	var idValue bool
+	if keySecretName, err = getVarNameFromProvider(provider, sm.KeyParamName, idValue); err != nil {
+		return
+	}
+	if !sm.convertToFile(provider) {
+		idValue = true
+		keyIDSecretName, err = getVarNameFromProvider(provider, sm.KeyIDParamName, idValue)
+	}
+	return
+}
+
+func (sm SecretsManager) client() *awsSm.SecretsManager {
+	return awsSm.New(
+		session.New(),
+		aws.NewConfig().
+			WithRegion(sm.Region).
+			WithEndpoint(fmt.Sprintf("secretsmanager.%s.amazonaws.com", sm.Region)),
+	)
+}
+
 func updateSecretsManagerSecret(paramName, paramValue string, svc awsSm.SecretsManager) (err error) {
 	input := &awsSm.PutSecretValueInput{SecretId: &paramName, SecretString: &paramValue}
 	_, err = svc.PutSecretValue(input)
 	return
 }
+
+// getSecretsManagerSecret returns the current value of the secret, or nil if
+// the secret doesn't exist
+func getSecretsManagerSecret(secretName string, svc awsSm.SecretsManager) (secretValue *string, err error) {
+	input := &awsSm.GetSecretValueInput{SecretId: aws.String(secretName)}
+	var output *awsSm.GetSecretValueOutput
+	if output, err = svc.GetSecretValue(input); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == awsSm.ErrCodeResourceNotFoundException {
+			err = nil
+		}
+		return
+	}
+	secretValue = output.SecretString
+	return
+}
@@ -16,6 +16,7 @@ package location
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	awsSsm "github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/ovotech/cloud-key-rotator/pkg/cred"
@@ -35,26 +36,20 @@ func (ssm Ssm) Write(serviceAccountName string, keyWrapper KeyWrapper, creds cre
 	var key string
 	var keyEnvVar string
 	var keyIDEnvVar string
-	var idValue bool
 
-	if keyEnvVar, err = getVarNameFromProvider(provider, ssm.KeyParamName, idValue); err != nil {
+	if keyEnvVar, keyIDEnvVar, err = ssm.paramNames(provider); err != nil {
 		return
 	}
 
-	if ssm.ConvertToFile || provider == "gcp" {
+	if ssm.convertToFile(provider) {
 		if key, err = getKeyForFileBasedLocation(keyWrapper, ssm.FileType); err != nil {
 			return
 		}
 	} else {
 		key = keyWrapper.Key
-		idValue = true
-		if keyIDEnvVar, err = getVarNameFromProvider(provider, ssm.KeyIDParamName, idValue); err != nil {
-			return
-		}
 	}
 
-	svc := awsSsm.New(session.New())
-	svc.Config.Region = aws.String(ssm.Region)
+	svc := ssm.client()
 
 	if len(keyIDEnvVar) > 0 {
 		if err = updateSSMParameter(keyIDEnvVar, keyWrapper.KeyID, "String", *svc); err != nil {
@@ -72,6 +67,79 @@ func (ssm Ssm) Write(serviceAccountName string, keyWrapper KeyWrapper, creds cre
 	return
 }
 
+// Read captures the current values of the SSM parameters that Write updates
+func (ssm Ssm) Read(serviceAccountName, keyProvider string, creds cred.Credentials) (snapshot Snapshot, err error) {
+	var keyParamName string
+	var keyIDParamName string
+	if keyParamName, keyIDParamName, err = ssm.paramNames(keyProvider); err != nil {
+		return
+	}
+	svc := ssm.client()
+	snapshot = Snapshot{}
+	for _, paramName := range []string{keyIDParamName, keyParamName} {
+		if len(paramName) == 0 {
+			continue
+		}
+		if snapshot[paramName], err = getSSMParameter(paramName, *svc); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Restore puts the SSM parameters back to the values captured by Read,
+// deleting any parameters that didn't exist beforehand
+func (ssm Ssm) Restore(serviceAccountName, keyProvider string, snapshot Snapshot, creds cred.Credentials) (err error) {
+	var keyIDParamName string
+	if _, keyIDParamName, err = ssm.paramNames(keyProvider); err != nil {
+		return
+	}
+	svc := ssm.client()
+	for paramName, paramValue := range snapshot {
+		if paramValue == nil {
+			if err = deleteSSMParameter(paramName, *svc); err != nil {
+				return
+			}
+			continue
+		}
+		paramType := "SecureString"
+		if paramName == keyIDParamName {
+			paramType = "String"
+		}
+		if err = updateSSMParameter(paramName, *paramValue, paramType, *svc); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// convertToFile returns true if the key should be written in a file format,
+// which is always the case for GCP keys
+func (ssm Ssm) convertToFile(provider string) bool {
+	return ssm.ConvertToFile || provider == "gcp"
+}
+
+// paramNames returns the names of the key and key ID parameters. The key ID
+// parameter name is empty when the key is being converted to a file, as the
+// file holds the key ID
+func (ssm Ssm) paramNames(provider string) (keyParamName, keyIDParamName string, err error) {
+	var idValue bool
+	if keyParamName, err = getVarNameFromProvider(provider, ssm.KeyParamName, idValue); err != nil {
+		return
+	}
+	if !ssm.convertToFile(provider) {
+		idValue = true
+		keyIDParamName, err = getVarNameFromProvider(provider, ssm.KeyIDParamName, idValue)
+	}
+	return
+}
+
+func (ssm Ssm) client() *awsSsm.SSM {
+	svc := awsSsm.New(session.New())
+	svc.Config.Region = aws.String(ssm.Region)
+	return svc
+}
+
 func updateSSMParameter(paramName, paramValue, paramType string, svc awsSsm.SSM) (err error) {
 	input := &awsSsm.PutParameterInput{
 		Overwrite: aws.Bool(true),
@@ -82,3 +150,26 @@ func updateSSMParameter(paramName, paramValue, paramType string, svc awsSsm.SSM)
 	_, err = svc.PutParameter(input)
 	return
 }
+
+// getSSMParameter returns the decrypted value of the parameter, or nil if the
+// parameter doesn't exist
+func getSSMParameter(paramName string, svc awsSsm.SSM) (paramValue *string, err error) {
+	input := &awsSsm.GetParameterInput{
+		Name:           aws.String(paramName),
+		WithDecryption: aws.Bool(true),
+	}
+	var output *awsSsm.GetParameterOutput
+	if output, err = svc.GetParameter(input); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == awsSsm.ErrCodeParameterNotFound {
+			err = nil
+		}
+		return
+	}
+	paramValue = output.Parameter.Value
+	return
+}
+
+func deleteSSMParameter(paramName string, svc awsSsm.SSM) (err error) {
+	_, err = svc.DeleteParameter(&awsSsm.DeleteParameterInput{Name: aws.String(paramName)})
+	return
+}
@@ -0,0 +1,438 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package location
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ovotech/cloud-key-rotator/pkg/cred"
+)
+
+// Vault type holds a secret in a HashiCorp Vault KV secrets engine, mounted at
+// Mount ("secret" by default). KVVersion is 1 or 2 (the default). The key and
+// key ID are written to the KeyField and KeyIDField fields of the secret,
+// leaving its other fields as they are.
+type Vault struct {
+	Address        string
+	Namespace      string
+	Mount          string
+	Path           string
+	KVVersion      int
+	KeyField       string
+	KeyIDField     string
+	ConvertToFile  bool
+	FileType       string
+	CredentialsRef string
+}
+
+const (
+	defaultVaultMount             = "secret"
+	defaultVaultKVVersion         = 2
+	defaultVaultKubernetesJWTPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// vaultTokenCacheTTL is the longest a token from a login is reused for. A
+// token is reused for no more than half of its lease.
+const vaultTokenCacheTTL = 10 * time.Minute
+
+// vaultLogin type identifies the Vault server and credentials a token was
+// logged in with
+type vaultLogin struct {
+	address   string
+	namespace string
+	auth      cred.VaultAuth
+}
+
+type cachedVaultToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// vaultTokens caches the tokens returned by logins, so that reading, writing
+// and restoring a secret doesn't log in each time (using up an AppRole
+// SecretID's uses)
+var (
+	vaultTokens      = map[vaultLogin]cachedVaultToken{}
+	vaultTokensMutex sync.Mutex
+)
+
+// vaultClient type makes authenticated requests to the Vault HTTP API
+type vaultClient struct {
+	address    string
+	namespace  string
+	token      string
+	login      vaultLogin
+	httpClient *http.Client
+}
+
+// vaultSecret type holds the fields of a KV secret, as the JSON Vault
+// returned them so that values that aren't strings are kept as they are,
+// and, for KV v2, the version they were read from (0 if the secret doesn't
+// exist)
+type vaultSecret struct {
+	data    map[string]json.RawMessage
+	version int
+}
+
+// vaultError type is returned when Vault responds with an error
+type vaultError struct {
+	StatusCode int
+	Errors     []string
+}
+
+func (e vaultError) Error() string {
+	return fmt.Sprintf("Vault returned status %d: %s", e.StatusCode, strings.Join(e.Errors, ", "))
+}
+
+func (vault Vault) Write(serviceAccountName string, keyWrapper KeyWrapper, creds cred.Credentials) (updated UpdatedLocation, err error) {
+	provider := keyWrapper.KeyProvider
+	var keyField string
+	var keyIDField string
+	if keyField, keyIDField, err = vault.fieldNames(provider); err != nil {
+		return
+	}
+	key := keyWrapper.Key
+	if vault.convertToFile(provider) {
+		if key, err = getKeyForFileBasedLocation(keyWrapper, vault.FileType); err != nil {
+			return
+		}
+	}
+	var client *vaultClient
+	if client, err = vault.client(creds); err != nil {
+		return
+	}
+	values := map[string]json.RawMessage{}
+	if values[keyField], err = json.Marshal(key); err != nil {
+		return
+	}
+	locationIDs := []string{keyField}
+	if len(keyIDField) > 0 {
+		if values[keyIDField], err = json.Marshal(keyWrapper.KeyID); err != nil {
+			return
+		}
+		locationIDs = []string{keyIDField, keyField}
+	}
+	if err = vault.update(client, values); err != nil {
+		return
+	}
+	logger.Infof("Updated Vault secret: %s", vault.uri())
+
+	updated = UpdatedLocation{
+		LocationType: "Vault",
+		LocationURI:  vault.uri(),
+		LocationIDs:  locationIDs}
+	return
+}
+
+// Read captures the current values of the fields that Write updates, as
+// JSON, so that values that aren't strings are restored as they were
+func (vault Vault) Read(serviceAccountName, keyProvider string, creds cred.Credentials) (snapshot Snapshot, err error) {
+	var keyField string
+	var keyIDField string
+	if keyField, keyIDField, err = vault.fieldNames(keyProvider); err != nil {
+		return
+	}
+	var client *vaultClient
+	if client, err = vault.client(creds); err != nil {
+		return
+	}
+	var secret vaultSecret
+	if secret, err = vault.read(client); err != nil {
+		return
+	}
+	snapshot = Snapshot{}
+	for _, field := range []string{keyIDField, keyField} {
+		if len(field) == 0 {
+			continue
+		}
+		snapshot[field] = nil
+		if value, ok := secret.data[field]; ok {
+			s := string(value)
+			snapshot[field] = &s
+		}
+	}
+	return
+}
+
+// Restore puts the fields back to the values captured by Read. Fields that
+// didn't exist beforehand are removed.
+func (vault Vault) Restore(serviceAccountName, keyProvider string, snapshot Snapshot, creds cred.Credentials) (err error) {
+	var client *vaultClient
+	if client, err = vault.client(creds); err != nil {
+		return
+	}
+	values := map[string]json.RawMessage{}
+	for field, value := range snapshot {
+		values[field] = nil
+		if value != nil {
+			values[field] = json.RawMessage(*value)
+		}
+	}
+	return vault.update(client, values)
+}
+
+// convertToFile returns true if the key should be written in a file format,
+// which is always the case for GCP keys
+func (vault Vault) convertToFile(provider string) bool {
+	return vault.ConvertToFile || provider == "gcp"
+}
+
+// fieldNames returns the names of the key and key ID fields. The key ID
+// field name is empty when the key is being converted to a file, as the file
+// holds the key ID
+func (vault Vault) fieldNames(provider string) (keyField, keyIDField string, err error) {
+	var idValue bool
+	if keyField, err = getVarNameFromProvider(provider, vault.KeyField, idValue); err != nil {
+		return
+	}
+	if !vault.convertToFile(provider) {
+		idValue = true
+		keyIDField, err = getVarNameFromProvider(provider, vault.KeyIDField, idValue)
+	}
+	return
+}
+
+func (vault Vault) mount() string {
+	if len(vault.Mount) > 0 {
+		return strings.Trim(vault.Mount, "/")
+	}
+	return defaultVaultMount
+}
+
+func (vault Vault) kvVersion() int {
+	if vault.KVVersion > 0 {
+		return vault.KVVersion
+	}
+	return defaultVaultKVVersion
+}
+
+// apiPath returns the API path of the secret, which for KV v2 is under the
+// data/ prefix
+func (vault Vault) apiPath() string {
+	secretPath := strings.Trim(vault.Path, "/")
+	if vault.kvVersion() == 2 {
+		return fmt.Sprintf("/v1/%s/data/%s", vault.mount(), secretPath)
+	}
+	return fmt.Sprintf("/v1/%s/%s", vault.mount(), secretPath)
+}
+
+// uri returns the URI of the secret, for logging
+func (vault Vault) uri() string {
+	return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(vault.Address, "/"), vault.mount(),
+		strings.Trim(vault.Path, "/"))
+}
+
+// client returns a vaultClient that's logged in with the credentials named
+// by the CredentialsRef, or the default Vault credentials, reusing the token
+// from an earlier login with them if it hasn't expired
+func (vault Vault) client(creds cred.Credentials) (client *vaultClient, err error) {
+	var auth cred.VaultAuth
+	if auth, err = creds.VaultAuthFor(vault.CredentialsRef); err != nil {
+		return
+	}
+	client = &vaultClient{
+		address:    strings.TrimSuffix(vault.Address, "/"),
+		namespace:  vault.Namespace,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	client.login = vaultLogin{address: client.address, namespace: client.namespace, auth: auth}
+	vaultTokensMutex.Lock()
+	cached, ok := vaultTokens[client.login]
+	vaultTokensMutex.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		client.token = cached.token
+		return
+	}
+	err = client.logIn(auth)
+	return
+}
+
+// read reads the secret, returning an empty secret if it doesn't exist
+func (vault Vault) read(client *vaultClient) (secret vaultSecret, err error) {
+	if vault.kvVersion() == 1 {
+		var response struct {
+			Data map[string]json.RawMessage
+		}
+		if err = client.do(http.MethodGet, vault.apiPath(), nil, &response, true); err != nil {
+			return
+		}
+		secret.data = response.Data
+	} else {
+		// a secret whose latest version has been deleted is a 404, but its
+		// version is still needed for check-and-set
+		var response struct {
+			Data struct {
+				Data     map[string]json.RawMessage
+				Metadata struct {
+					Version int
+				}
+			}
+		}
+		if err = client.do(http.MethodGet, vault.apiPath(), nil, &response, true); err != nil {
+			return
+		}
+		secret.data = response.Data.Data
+		secret.version = response.Data.Metadata.Version
+	}
+	if secret.data == nil {
+		secret.data = map[string]json.RawMessage{}
+	}
+	return
+}
+
+// update sets the fields of the secret to the JSON values supplied (removing
+// those whose value is nil), leaving its other fields as they are. KV v2
+// writes use check-and-set, so the write fails if the secret has been
+// changed since it was read.
+func (vault Vault) update(client *vaultClient, values map[string]json.RawMessage) (err error) {
+	var secret vaultSecret
+	if secret, err = vault.read(client); err != nil {
+		return
+	}
+	for field, value := range values {
+		if value == nil {
+			delete(secret.data, field)
+		} else {
+			secret.data[field] = value
+		}
+	}
+	var body interface{} = secret.data
+	if vault.kvVersion() == 2 {
+		body = map[string]interface{}{
+			"data":    secret.data,
+			"options": map[string]int{"cas": secret.version},
+		}
+	}
+	if err = client.do(http.MethodPost, vault.apiPath(), body, nil, false); err != nil {
+		var vErr vaultError
+		if errors.As(err, &vErr) && vErr.StatusCode == http.StatusBadRequest &&
+			strings.Contains(strings.Join(vErr.Errors, " "), "check-and-set") {
+			err = fmt.Errorf("Vault secret: %s was changed by someone else while it was being updated: %w",
+				vault.uri(), err)
+		}
+	}
+	return
+}
+
+// logIn sets the client's token, logging in with the AppRole or Kubernetes
+// auth method if a token isn't supplied. The token from a login is cached
+// for the rest of its lease (up to the vaultTokenCacheTTL).
+func (client *vaultClient) logIn(auth cred.VaultAuth) (err error) {
+	var mount string
+	var body map[string]string
+	switch {
+	case len(auth.Token) > 0:
+		client.token = auth.Token
+		return
+	case len(auth.RoleID) > 0:
+		mount = "approle"
+		body = map[string]string{"role_id": auth.RoleID, "secret_id": auth.SecretID}
+	case len(auth.KubernetesRole) > 0:
+		jwtPath := auth.KubernetesJWTPath
+		if len(jwtPath) == 0 {
+			jwtPath = defaultVaultKubernetesJWTPath
+		}
+		var jwt []byte
+		if jwt, err = ioutil.ReadFile(jwtPath); err != nil {
+			return
+		}
+		mount = "kubernetes"
+		body = map[string]string{"role": auth.KubernetesRole, "jwt": strings.TrimSpace(string(jwt))}
+	default:
+		return errors.New("No Vault credentials set, a Token, RoleID or KubernetesRole is required")
+	}
+	if len(auth.AuthMount) > 0 {
+		mount = strings.Trim(auth.AuthMount, "/")
+	}
+	var response struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		}
+	}
+	if err = client.do(http.MethodPost, fmt.Sprintf("/v1/auth/%s/login", mount), body, &response,
+		false); err != nil {
+		return
+	}
+	if len(response.Auth.ClientToken) == 0 {
+		return fmt.Errorf("No token returned by Vault login to auth/%s", mount)
+	}
+	client.token = response.Auth.ClientToken
+	ttl := vaultTokenCacheTTL
+	if lease := time.Duration(response.Auth.LeaseDuration) * time.Second / 2; lease > 0 && lease < ttl {
+		ttl = lease
+	}
+	vaultTokensMutex.Lock()
+	vaultTokens[client.login] = cachedVaultToken{token: client.token, expiresAt: time.Now().Add(ttl)}
+	vaultTokensMutex.Unlock()
+	return
+}
+
+// do makes a request to the Vault API, decoding the response into the value
+// supplied (if it's not nil). A 404 is only not an error if allowNotFound is
+// true, i.e. when reading a secret that might not exist yet.
+func (client *vaultClient) do(method, path string, body, response interface{},
+	allowNotFound bool) (err error) {
+	var reqBody io.Reader
+	if body != nil {
+		var data []byte
+		if data, err = json.Marshal(body); err != nil {
+			return
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	var req *http.Request
+	if req, err = http.NewRequest(method, client.address+path, reqBody); err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(client.token) > 0 {
+		req.Header.Set("X-Vault-Token", client.token)
+	}
+	if len(client.namespace) > 0 {
+		req.Header.Set("X-Vault-Namespace", client.namespace)
+	}
+	var resp *http.Response
+	if resp, err = client.httpClient.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 && !(allowNotFound && resp.StatusCode == http.StatusNotFound) {
+		vErr := vaultError{StatusCode: resp.StatusCode}
+		json.NewDecoder(resp.Body).Decode(&vErr)
+		if resp.StatusCode == http.StatusForbidden {
+			// the token may have been revoked, so the next request logs in again
+			vaultTokensMutex.Lock()
+			delete(vaultTokens, client.login)
+			vaultTokensMutex.Unlock()
+		}
+		return vErr
+	}
+	if response != nil {
+		if err = json.NewDecoder(resp.Body).Decode(response); err == io.EOF {
+			err = nil
+		}
+	}
+	return
+}
@@ -0,0 +1,291 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package location
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ovotech/cloud-key-rotator/pkg/cred"
+)
+
+const testVaultToken = "vault-token"
+
+// fakeVault is a Vault server holding a single KV secret, at secret/my/path
+// for KV v2 or kv/my/path for KV v1
+type fakeVault struct {
+	mutex      sync.Mutex
+	data       map[string]interface{}
+	version    int
+	logins     map[string]map[string]string
+	loginCount int
+	casValues  []int
+	// concurrentEdit makes the secret change after every read
+	concurrentEdit bool
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if strings.HasPrefix(r.URL.Path, "/v1/auth/") {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		f.logins[r.URL.Path] = body
+		f.loginCount++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]string{"client_token": testVaultToken}})
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != testVaultToken {
+		vaultErrorResponse(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	switch {
+	case r.URL.Path == "/v1/secret/data/my/path" && r.Method == http.MethodGet:
+		if f.data == nil {
+			vaultErrorResponse(w, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"data": f.data, "metadata": map[string]int{"version": f.version}}})
+		if f.concurrentEdit {
+			f.version++
+		}
+	case r.URL.Path == "/v1/secret/data/my/path":
+		var body struct {
+			Data    map[string]interface{}
+			Options struct{ Cas int }
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.casValues = append(f.casValues, body.Options.Cas)
+		if body.Options.Cas != f.version {
+			vaultErrorResponse(w, http.StatusBadRequest,
+				"check-and-set parameter did not match the current version")
+			return
+		}
+		f.data = body.Data
+		f.version++
+	case r.URL.Path == "/v1/kv/my/path" && r.Method == http.MethodGet:
+		if f.data == nil {
+			vaultErrorResponse(w, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": f.data})
+	case r.URL.Path == "/v1/kv/my/path":
+		json.NewDecoder(r.Body).Decode(&f.data)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		vaultErrorResponse(w, http.StatusNotFound)
+	}
+}
+
+func vaultErrorResponse(w http.ResponseWriter, statusCode int, errors ...string) {
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string][]string{"errors": errors})
+}
+
+func newFakeVault(t *testing.T, data map[string]interface{}, version int) (*fakeVault, *httptest.Server) {
+	f := &fakeVault{data: data, version: version, logins: map[string]map[string]string{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+var awsKeyWrapper = KeyWrapper{Key: "new-secret", KeyID: "new-id", KeyProvider: "aws"}
+
+var tokenCreds = cred.Credentials{VaultAuth: cred.VaultAuth{Token: testVaultToken}}
+
+func TestVaultWriteKVv2(t *testing.T) {
+	f, server := newFakeVault(t, map[string]interface{}{
+		"AWS_SECRET_ACCESS_KEY": "old-secret", "OTHER": "keep"}, 3)
+	vault := Vault{Address: server.URL, Path: "my/path"}
+
+	updated, err := vault.Write("sa", awsKeyWrapper, tokenCreds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"AWS_ACCESS_KEY_ID":     "new-id",
+		"AWS_SECRET_ACCESS_KEY": "new-secret",
+		"OTHER":                 "keep",
+	}
+	if !reflect.DeepEqual(f.data, expected) {
+		t.Errorf("Incorrect secret data, want: %v, got: %v", expected, f.data)
+	}
+	if !reflect.DeepEqual(f.casValues, []int{3}) {
+		t.Errorf("Expected write with check-and-set of version 3, got: %v", f.casValues)
+	}
+	if updated.LocationURI != server.URL+"/secret/my/path" {
+		t.Errorf("Incorrect location URI: %s", updated.LocationURI)
+	}
+}
+
+func TestVaultWriteConcurrentEdit(t *testing.T) {
+	f, server := newFakeVault(t, map[string]interface{}{"AWS_SECRET_ACCESS_KEY": "old-secret"}, 1)
+	f.concurrentEdit = true
+	vault := Vault{Address: server.URL, Path: "my/path"}
+
+	_, err := vault.Write("sa", awsKeyWrapper, tokenCreds)
+	if err == nil || !strings.Contains(err.Error(), "changed by someone else") {
+		t.Errorf("Expected concurrent edit to be detected, got: %v", err)
+	}
+	if f.data["AWS_SECRET_ACCESS_KEY"] != "old-secret" {
+		t.Errorf("Expected secret to be unchanged, got: %v", f.data)
+	}
+}
+
+var vaultReadRestoreTests = []struct {
+	data     map[string]interface{}
+	expected map[string]interface{}
+}{
+	// the key ID field didn't exist beforehand, so is removed
+	{map[string]interface{}{"AWS_SECRET_ACCESS_KEY": "old-secret"},
+		map[string]interface{}{"AWS_SECRET_ACCESS_KEY": "old-secret"}},
+	// values that aren't strings are restored as they were
+	{map[string]interface{}{"AWS_SECRET_ACCESS_KEY": map[string]interface{}{"enabled": true}, "AWS_ACCESS_KEY_ID": 42.5},
+		map[string]interface{}{"AWS_SECRET_ACCESS_KEY": map[string]interface{}{"enabled": true}, "AWS_ACCESS_KEY_ID": 42.5}},
+}
+
+func TestVaultReadRestore(t *testing.T) {
+	for _, test := range vaultReadRestoreTests {
+		f, server := newFakeVault(t, test.data, 1)
+		vault := Vault{Address: server.URL, Path: "my/path"}
+
+		snapshot, err := vault.Read("sa", "aws", tokenCreds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = vault.Write("sa", awsKeyWrapper, tokenCreds); err != nil {
+			t.Fatal(err)
+		}
+		if err = vault.Restore("sa", "aws", snapshot, tokenCreds); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(f.data, test.expected) {
+			t.Errorf("Incorrect restored secret data, want: %v, got: %v", test.expected, f.data)
+		}
+	}
+}
+
+func TestVaultLogsInOnce(t *testing.T) {
+	f, server := newFakeVault(t, nil, 0)
+	vault := Vault{Address: server.URL, Path: "my/path"}
+	creds := cred.Credentials{VaultAuth: cred.VaultAuth{RoleID: "role", SecretID: "secret"}}
+
+	snapshot, err := vault.Read("sa", "aws", creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = vault.Write("sa", awsKeyWrapper, creds); err != nil {
+		t.Fatal(err)
+	}
+	if err = vault.Restore("sa", "aws", snapshot, creds); err != nil {
+		t.Fatal(err)
+	}
+
+	// an AppRole SecretID may only have a limited number of uses
+	if f.loginCount != 1 {
+		t.Errorf("Expected a single login for read, write and restore, got: %d", f.loginCount)
+	}
+}
+
+func TestVaultWriteKVv1AppRole(t *testing.T) {
+	f, server := newFakeVault(t, nil, 0)
+	vault := Vault{Address: server.URL, Mount: "kv", Path: "/my/path/", KVVersion: 1,
+		KeyField: "secret", KeyIDField: "id", CredentialsRef: "team-a"}
+	creds := cred.Credentials{Vault: map[string]cred.VaultAuth{
+		"team-a": {RoleID: "role", SecretID: "secret"}}}
+
+	if _, err := vault.Write("sa", awsKeyWrapper, creds); err != nil {
+		t.Fatal(err)
+	}
+
+	if login := f.logins["/v1/auth/approle/login"]; login["role_id"] != "role" || login["secret_id"] != "secret" {
+		t.Errorf("Expected AppRole login, got: %v", f.logins)
+	}
+	expected := map[string]interface{}{"id": "new-id", "secret": "new-secret"}
+	if !reflect.DeepEqual(f.data, expected) {
+		t.Errorf("Incorrect secret data, want: %v, got: %v", expected, f.data)
+	}
+}
+
+func TestVaultWriteKubernetesAuth(t *testing.T) {
+	f, server := newFakeVault(t, nil, 0)
+	jwtPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(jwtPath, []byte("k8s-jwt\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	vault := Vault{Address: server.URL, Path: "my/path", FileType: "json"}
+	creds := cred.Credentials{VaultAuth: cred.VaultAuth{KubernetesRole: "ckr",
+		KubernetesJWTPath: jwtPath, AuthMount: "k8s-cluster-a"}}
+
+	updated, err := vault.Write("sa", KeyWrapper{Key: "new-secret", KeyID: "new-id", KeyProvider: "gcp"}, creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if login := f.logins["/v1/auth/k8s-cluster-a/login"]; login["role"] != "ckr" || login["jwt"] != "k8s-jwt" {
+		t.Errorf("Expected Kubernetes login, got: %v", f.logins)
+	}
+	// GCP keys are converted to a file, so there's no key ID field
+	if len(f.data) != 1 || f.data["GCLOUD_SERVICE_KEY"] == nil || f.casValues[0] != 0 {
+		t.Errorf("Incorrect secret data: %v", f.data)
+	}
+	if !reflect.DeepEqual(updated.LocationIDs, []string{"GCLOUD_SERVICE_KEY"}) {
+		t.Errorf("Incorrect location IDs: %v", updated.LocationIDs)
+	}
+}
+
+func TestVaultWriteNoCredentials(t *testing.T) {
+	_, server := newFakeVault(t, nil, 0)
+	vault := Vault{Address: server.URL, Path: "my/path"}
+	if _, err := vault.Write("sa", awsKeyWrapper, cred.Credentials{}); err == nil {
+		t.Error("Expected error without Vault credentials")
+	}
+	if _, err := vault.Write("sa", awsKeyWrapper, cred.Credentials{VaultAuth: cred.VaultAuth{Token: "wrong"}}); err == nil ||
+		!strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Expected permission denied error, got: %v", err)
+	}
+}
+
+func TestVaultNotFound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vaultErrorResponse(w, http.StatusNotFound)
+	}))
+	t.Cleanup(server.Close)
+	vault := Vault{Address: server.URL, Path: "my/path"}
+
+	// a missing secret can be read, as it may be about to be created
+	if snapshot, err := vault.Read("sa", "aws", tokenCreds); err != nil || snapshot["AWS_SECRET_ACCESS_KEY"] != nil {
+		t.Errorf("Expected empty snapshot of missing secret, got: %v, %v", snapshot, err)
+	}
+	if _, err := vault.Write("sa", awsKeyWrapper, tokenCreds); err == nil {
+		t.Error("Expected error for write that isn't found, e.g. to a mount that doesn't exist")
+	}
+	appRoleCreds := cred.Credentials{VaultAuth: cred.VaultAuth{RoleID: "role", SecretID: "secret"}}
+	if _, err := vault.Write("sa", awsKeyWrapper, appRoleCreds); err == nil ||
+		!strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected error for login that isn't found, got: %v", err)
+	}
+}
@@ -0,0 +1,423 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/ovotech/cloud-key-rotator/pkg/log"
+	"google.golang.org/api/googleapi"
+)
+
+var logger = log.StdoutLogger().Sugar()
+
+// readLockFile reads a lock file. It's replaced in tests, to widen the window
+// in which runs that have read an expired lock could race to take it over.
+var readLockFile = ioutil.ReadFile
+
+// Lock interface is implemented by the places a run lock can be held, so
+// that only one run at a time rotates keys
+type Lock interface {
+	// Acquire takes the lock, returning a HeldError if another run holds it
+	// and its lock hasn't expired. An expired lock is taken over.
+	Acquire() error
+	// Release releases the lock, if it's still held by this run
+	Release() error
+}
+
+// Holder type describes the run holding a lock
+type Holder struct {
+	ID         string
+	Host       string
+	PID        int
+	AcquiredAt time.Time
+	ExpiresAt  time.Time
+}
+
+// HeldError type is returned when a lock is held by another run
+type HeldError struct {
+	Holder Holder
+}
+
+func (h HeldError) Error() string {
+	return fmt.Sprintf("Run lock is held by another run (host: %s, pid: %d) since %s, until %s",
+		h.Holder.Host, h.Holder.PID, h.Holder.AcquiredAt.Format(time.RFC3339),
+		h.Holder.ExpiresAt.Format(time.RFC3339))
+}
+
+// NewLock returns the Lock for the URI supplied, which is one of:
+// file:///path/to/ckr.lock, gs://bucket/object or dynamodb://table/lock-id
+// (with an optional region query parameter, e.g.
+// dynamodb://table/lock-id?region=eu-west-1). The DynamoDB table needs a
+// string partition key named LockID. Locks expire after the ttl supplied.
+func NewLock(uri string, ttl time.Duration) (lock Lock, err error) {
+	var u *url.URL
+	if u, err = url.Parse(uri); err != nil {
+		return
+	}
+	objectName := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "file":
+		lock = &fileLock{path: u.Path, ttl: ttl}
+	case "gs":
+		lock = &gcsLock{bucketName: u.Host, objectName: objectName, ttl: ttl}
+	case "dynamodb":
+		lock = &dynamoDBLock{tableName: u.Host, lockID: objectName, region: u.Query().Get("region"), ttl: ttl}
+	default:
+		err = fmt.Errorf("Run lock URI scheme: %s is not supported", u.Scheme)
+	}
+	return
+}
+
+// newHolder returns a Holder describing this run, whose lock expires after
+// the ttl
+func newHolder(ttl time.Duration) (holder Holder, err error) {
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return
+	}
+	host, _ := os.Hostname()
+	now := time.Now().UTC()
+	holder = Holder{
+		ID:         hex.EncodeToString(id),
+		Host:       host,
+		PID:        os.Getpid(),
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+	return
+}
+
+func (h Holder) expired() bool {
+	return time.Now().After(h.ExpiresAt)
+}
+
+func (h Holder) encode() []byte {
+	data, _ := json.Marshal(h)
+	return data
+}
+
+// decodeHolder decodes the Holder of a lock. A lock that can't be decoded
+// (e.g. because its holder crashed while writing it) is treated as expired.
+func decodeHolder(data []byte) (holder Holder) {
+	json.Unmarshal(data, &holder)
+	return
+}
+
+// logStale reports that a stale lock is being taken over
+func logStale(holder Holder) {
+	logger.Warnw("Taking over expired run lock, its holder may have crashed or overrun",
+		"holderHost", holder.Host,
+		"holderPID", holder.PID,
+		"acquiredAt", holder.AcquiredAt,
+		"expiredAt", holder.ExpiresAt)
+}
+
+// logTakenOver reports that this run's lock was taken over by another run
+// before it was released
+func logTakenOver() {
+	logger.Warn("Run lock was taken over by another run before it was released, " +
+		"consider increasing RunLockTTLMins")
+}
+
+// fileLock type holds a run lock in a local file. Acquiring and releasing
+// the lock is done while holding an OS file lock on a guard file alongside
+// it, which is never removed, so that checking who holds the lock and
+// replacing it can't be interleaved with another run doing the same.
+type fileLock struct {
+	path   string
+	ttl    time.Duration
+	holder Holder
+}
+
+func (f *fileLock) Acquire() (err error) {
+	if f.holder, err = newHolder(f.ttl); err != nil {
+		return
+	}
+	return f.guarded(f.acquire)
+}
+
+func (f *fileLock) acquire() (err error) {
+	if err = f.create(); !os.IsExist(err) {
+		return
+	}
+	var data []byte
+	if data, err = readLockFile(f.path); err != nil {
+		return
+	}
+	existing := decodeHolder(data)
+	if !existing.expired() {
+		return HeldError{Holder: existing}
+	}
+	logStale(existing)
+	return f.replace()
+}
+
+// guarded calls fn while holding the guard file's OS lock, waiting for any
+// other run holding it to finish
+func (f *fileLock) guarded(fn func() error) (err error) {
+	var guard *os.File
+	if guard, err = os.OpenFile(f.path+".guard", os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		return
+	}
+	defer guard.Close()
+	if err = lockFile(guard); err != nil {
+		return fmt.Errorf("Unable to lock run lock guard: %s: %w", guard.Name(), err)
+	}
+	defer unlockFile(guard)
+	return fn()
+}
+
+// create creates the lock file, failing if it already exists
+func (f *fileLock) create() (err error) {
+	var file *os.File
+	if file, err = os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+		return
+	}
+	if _, err = file.Write(f.holder.encode()); err != nil {
+		file.Close()
+		return
+	}
+	return file.Close()
+}
+
+// replace replaces the lock file by renaming a temp file over it, so the
+// lock file is never missing or partially written
+func (f *fileLock) replace() (err error) {
+	var file *os.File
+	if file, err = ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".*"); err != nil {
+		return
+	}
+	defer os.Remove(file.Name())
+	if _, err = file.Write(f.holder.encode()); err != nil {
+		file.Close()
+		return
+	}
+	if err = file.Close(); err != nil {
+		return
+	}
+	return os.Rename(file.Name(), f.path)
+}
+
+func (f *fileLock) Release() (err error) {
+	return f.guarded(f.release)
+}
+
+func (f *fileLock) release() (err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(f.path); err != nil {
+		if os.IsNotExist(err) {
+			logTakenOver()
+			err = nil
+		}
+		return
+	}
+	if decodeHolder(data).ID != f.holder.ID {
+		logTakenOver()
+		return
+	}
+	return os.Remove(f.path)
+}
+
+// gcsLock type holds a run lock in a GCS object, using generation
+// preconditions so only one run can create or take over the object
+type gcsLock struct {
+	bucketName string
+	objectName string
+	ttl        time.Duration
+	holder     Holder
+	generation int64
+}
+
+func (g *gcsLock) Acquire() (err error) {
+	if g.holder, err = newHolder(g.ttl); err != nil {
+		return
+	}
+	ctx := context.Background()
+	var client *storage.Client
+	if client, err = storage.NewClient(ctx); err != nil {
+		return
+	}
+	defer client.Close()
+	obj := client.Bucket(g.bucketName).Object(g.objectName)
+	if err = g.write(ctx, obj.If(storage.Conditions{DoesNotExist: true})); !preconditionFailed(err) {
+		return
+	}
+	var rc *storage.Reader
+	if rc, err = obj.NewReader(ctx); err != nil {
+		return
+	}
+	defer rc.Close()
+	var data []byte
+	if data, err = ioutil.ReadAll(rc); err != nil {
+		return
+	}
+	existing := decodeHolder(data)
+	if !existing.expired() {
+		return HeldError{Holder: existing}
+	}
+	logStale(existing)
+	if err = g.write(ctx, obj.If(storage.Conditions{GenerationMatch: rc.Attrs.Generation})); preconditionFailed(err) {
+		err = errors.New("Run lock was taken over by another run first")
+	}
+	return
+}
+
+// write writes the lock object, recording its generation
+func (g *gcsLock) write(ctx context.Context, obj *storage.ObjectHandle) (err error) {
+	w := obj.NewWriter(ctx)
+	w.ContentType = "application/json"
+	if _, err = w.Write(g.holder.encode()); err != nil {
+		w.Close()
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	g.generation = w.Attrs().Generation
+	return
+}
+
+func (g *gcsLock) Release() (err error) {
+	ctx := context.Background()
+	var client *storage.Client
+	if client, err = storage.NewClient(ctx); err != nil {
+		return
+	}
+	defer client.Close()
+	err = client.Bucket(g.bucketName).Object(g.objectName).
+		If(storage.Conditions{GenerationMatch: g.generation}).Delete(ctx)
+	if preconditionFailed(err) || errors.Is(err, storage.ErrObjectNotExist) {
+		logTakenOver()
+		err = nil
+	}
+	return
+}
+
+// preconditionFailed returns true if the error is a GCS precondition failure
+func preconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
+
+// dynamoDBLock type holds a run lock in a DynamoDB item, using conditional
+// writes so only one run can create or take over the item
+type dynamoDBLock struct {
+	tableName string
+	lockID    string
+	region    string
+	ttl       time.Duration
+	holder    Holder
+}
+
+func (d *dynamoDBLock) client() *dynamodb.DynamoDB {
+	config := aws.NewConfig()
+	if len(d.region) > 0 {
+		config = config.WithRegion(d.region)
+	}
+	return dynamodb.New(session.New(), config)
+}
+
+func (d *dynamoDBLock) Acquire() (err error) {
+	if d.holder, err = newHolder(d.ttl); err != nil {
+		return
+	}
+	client := d.client()
+	if err = d.put(client, "attribute_not_exists(LockID)", nil); !conditionFailed(err) {
+		return
+	}
+	var output *dynamodb.GetItemOutput
+	if output, err = client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(d.tableName),
+		Key:            d.key(),
+		ConsistentRead: aws.Bool(true),
+	}); err != nil {
+		return
+	}
+	var existing Holder
+	if holder, ok := output.Item["Holder"]; ok {
+		existing = decodeHolder([]byte(aws.StringValue(holder.S)))
+	}
+	if !existing.expired() {
+		return HeldError{Holder: existing}
+	}
+	logStale(existing)
+	if err = d.put(client, "HolderID = :holderID", map[string]*dynamodb.AttributeValue{
+		":holderID": {S: aws.String(existing.ID)},
+	}); conditionFailed(err) {
+		err = errors.New("Run lock was taken over by another run first")
+	}
+	return
+}
+
+func (d *dynamoDBLock) key() map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{"LockID": {S: aws.String(d.lockID)}}
+}
+
+// put writes the lock item, if the condition is met
+func (d *dynamoDBLock) put(client *dynamodb.DynamoDB, condition string,
+	values map[string]*dynamodb.AttributeValue) (err error) {
+	_, err = client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(d.tableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"LockID":   {S: aws.String(d.lockID)},
+			"HolderID": {S: aws.String(d.holder.ID)},
+			"Holder":   {S: aws.String(string(d.holder.encode()))},
+		},
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeValues: values,
+	})
+	return
+}
+
+func (d *dynamoDBLock) Release() (err error) {
+	_, err = d.client().DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           aws.String(d.tableName),
+		Key:                 d.key(),
+		ConditionExpression: aws.String("HolderID = :holderID"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":holderID": {S: aws.String(d.holder.ID)},
+		},
+	})
+	if conditionFailed(err) {
+		logTakenOver()
+		err = nil
+	}
+	return
+}
+
+// conditionFailed returns true if the error is a DynamoDB conditional check
+// failure
+func conditionFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
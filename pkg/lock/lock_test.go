@@ -0,0 +1,153 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var newLockTests = []struct {
+	uri      string
+	expected Lock
+	errors   bool
+}{
+	{"file:///tmp/ckr.lock", &fileLock{path: "/tmp/ckr.lock", ttl: time.Hour}, false},
+	{"gs://my-bucket/locks/ckr.lock", &gcsLock{bucketName: "my-bucket", objectName: "locks/ckr.lock",
+		ttl: time.Hour}, false},
+	{"dynamodb://ckr-locks/prod?region=eu-west-1", &dynamoDBLock{tableName: "ckr-locks", lockID: "prod",
+		region: "eu-west-1", ttl: time.Hour}, false},
+	{"s3://my-bucket/ckr.lock", nil, true},
+}
+
+func TestNewLock(t *testing.T) {
+	for _, newLockTest := range newLockTests {
+		lock, err := NewLock(newLockTest.uri, time.Hour)
+		if (err != nil) != newLockTest.errors {
+			t.Errorf("Incorrect error behaviour for %s: %v", newLockTest.uri, err)
+		}
+		if !reflect.DeepEqual(lock, newLockTest.expected) {
+			t.Errorf("Incorrect lock for %s, want: %v, got: %v", newLockTest.uri, newLockTest.expected, lock)
+		}
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ckr.lock")
+	first := &fileLock{path: path, ttl: time.Hour}
+	second := &fileLock{path: path, ttl: time.Hour}
+	if err := first.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	err := second.Acquire()
+	var heldErr HeldError
+	if !errors.As(err, &heldErr) || heldErr.Holder.ID != first.holder.ID {
+		t.Fatalf("Expected lock to be held by first run, got: %v", err)
+	}
+	// releasing a lock that's held by another run leaves it in place
+	if err = second.Release(); err != nil {
+		t.Error(err)
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Errorf("Lock held by first run should still exist: %v", err)
+	}
+	if err = first.Release(); err != nil {
+		t.Error(err)
+	}
+	if err = second.Acquire(); err != nil {
+		t.Errorf("Expected released lock to be acquired, got: %v", err)
+	}
+}
+
+func TestFileLockStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ckr.lock")
+	stale := &fileLock{path: path, ttl: -time.Minute}
+	if err := stale.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	current := &fileLock{path: path, ttl: time.Hour}
+	if err := current.Acquire(); err != nil {
+		t.Fatalf("Expected expired lock to be taken over, got: %v", err)
+	}
+	if err := stale.Release(); err != nil {
+		t.Error(err)
+	}
+	if err := (&fileLock{path: path, ttl: time.Hour}).Acquire(); err == nil {
+		t.Error("Lock taken over shouldn't be released by its previous holder")
+	}
+
+	// a lock file that can't be decoded is treated as expired
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&fileLock{path: path, ttl: time.Hour}).Acquire(); err != nil {
+		t.Errorf("Expected corrupt lock to be taken over, got: %v", err)
+	}
+}
+
+func TestFileLockConcurrentTakeover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ckr.lock")
+	if err := (&fileLock{path: path, ttl: -time.Minute}).Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	// give every run the chance to see the expired lock before any of them
+	// takes it over
+	readLockFile = func(path string) ([]byte, error) {
+		data, err := ioutil.ReadFile(path)
+		time.Sleep(20 * time.Millisecond)
+		return data, err
+	}
+	t.Cleanup(func() { readLockFile = ioutil.ReadFile })
+
+	runs := make([]*fileLock, 10)
+	errs := make([]error, len(runs))
+	var wg sync.WaitGroup
+	for i := range runs {
+		runs[i] = &fileLock{path: path, ttl: time.Hour}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = runs[i].Acquire()
+		}(i)
+	}
+	wg.Wait()
+
+	var holders []string
+	for i, err := range errs {
+		var heldErr HeldError
+		switch {
+		case err == nil:
+			holders = append(holders, runs[i].holder.ID)
+		case !errors.As(err, &heldErr):
+			t.Errorf("Expected lock to be held by another run, got: %v", err)
+		}
+	}
+	if len(holders) != 1 {
+		t.Fatalf("Expected exactly one run to take over the expired lock, got: %d", len(holders))
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decodeHolder(data).ID != holders[0] {
+		t.Errorf("Lock should be held by the run that took it over, got: %s", data)
+	}
+}
@@ -14,13 +14,35 @@
 
 package log
 
-import "go.uber.org/zap"
+import (
+	"sync"
 
-// StdoutLogger creates a stdout logger
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	stdoutLogger     *zap.Logger
+	stdoutLoggerOnce sync.Once
+	stdoutLevel      = zap.NewAtomicLevelAt(zapcore.InfoLevel)
+)
+
+// StdoutLogger returns a stdout logger. The same logger is shared by every
+// caller, so that writes to stdout from concurrent rotations are serialised
+// rather than interleaved.
 func StdoutLogger() (logger *zap.Logger) {
-	config := zap.NewProductionConfig()
-	config.OutputPaths = []string{"stdout"}
-	config.ErrorOutputPaths = []string{"stdout"}
-	logger, _ = config.Build()
-	return
+	stdoutLoggerOnce.Do(func() {
+		config := zap.NewProductionConfig()
+		config.Level = stdoutLevel
+		config.OutputPaths = []string{"stdout"}
+		config.ErrorOutputPaths = []string{"stdout"}
+		stdoutLogger, _ = config.Build()
+	})
+	return stdoutLogger
+}
+
+// SetStdoutLevel sets the minimum level of the entries written by the stdout
+// logger, e.g. so they don't get mixed up with a report written to stdout
+func SetStdoutLevel(level zapcore.Level) {
+	stdoutLevel.SetLevel(level)
 }
@@ -0,0 +1,106 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotate
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+)
+
+// rateLimiter type spaces out calls to each provider's API by the interval
+// configured for the provider. It's safe for concurrent use.
+type rateLimiter struct {
+	mutex     sync.Mutex
+	intervals map[string]time.Duration
+	next      map[string]time.Time
+}
+
+// apiRateLimiter limits calls to create and delete keys
+var apiRateLimiter = &rateLimiter{}
+
+// configure sets the interval to leave between calls to each provider's API,
+// based on config values
+func (r *rateLimiter) configure(c config.Config) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.intervals = map[string]time.Duration{}
+	for _, limit := range c.ProviderLimits {
+		if limit.APICallIntervalMillis > 0 {
+			r.intervals[limit.Provider] = time.Duration(limit.APICallIntervalMillis) * time.Millisecond
+		}
+	}
+	if r.next == nil {
+		r.next = map[string]time.Time{}
+	}
+}
+
+// wait blocks until a call may be made to the provider's API
+func (r *rateLimiter) wait(provider string) {
+	r.mutex.Lock()
+	interval := r.intervals[provider]
+	if interval == 0 {
+		r.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	callAt := r.next[provider]
+	if callAt.Before(now) {
+		callAt = now
+	}
+	r.next[provider] = callAt.Add(interval)
+	r.mutex.Unlock()
+	time.Sleep(callAt.Sub(now))
+}
+
+// limitRotations orders the rotation candidates oldest-first, so the most
+// overdue keys are rotated first, then drops any beyond MaxRotationsPerRun or
+// their provider's MaxRotationsPerRun, returning a result for each
+func limitRotations(rotationCandidates []rotationCandidate,
+	c config.Config) (limited []rotationCandidate, accountResults []AccountResult) {
+	sorted := append([]rotationCandidate{}, rotationCandidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].key.Age > sorted[j].key.Age
+	})
+	providerMax := map[string]int{}
+	for _, limit := range c.ProviderLimits {
+		if limit.MaxRotationsPerRun > 0 {
+			providerMax[limit.Provider] = limit.MaxRotationsPerRun
+		}
+	}
+	providerCount := map[string]int{}
+	for _, rc := range sorted {
+		key := rc.key
+		provider := key.Provider.Provider
+		var reason string
+		if c.MaxRotationsPerRun > 0 && len(limited) >= c.MaxRotationsPerRun {
+			reason = fmt.Sprintf("rotation budget of %d per run has been used", c.MaxRotationsPerRun)
+		} else if providerLimit, ok := providerMax[provider]; ok && providerCount[provider] >= providerLimit {
+			reason = fmt.Sprintf("rotation budget of %d per run for %s has been used", providerLimit, provider)
+		}
+		if len(reason) > 0 {
+			logger.Infof("Skipping SA: %s, key: %s as the %s",
+				key.FullAccount, obfuscate(key.ID), reason)
+			accountResults = append(accountResults, newAccountResult(key, StatusSkipped, reason))
+			continue
+		}
+		limited = append(limited, rc)
+		providerCount[provider]++
+	}
+	return
+}
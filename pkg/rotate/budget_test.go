@@ -0,0 +1,90 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotate
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	keys "github.com/ovotech/cloud-key-client"
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+)
+
+func budgetCandidate(provider, account string, age float64) rotationCandidate {
+	return rotationCandidate{key: keys.Key{Account: account, FullAccount: account, Age: age,
+		Provider: keys.Provider{Provider: provider}}}
+}
+
+var budgetCandidates = []rotationCandidate{
+	budgetCandidate("gcp", "gcp-young", 100),
+	budgetCandidate("aws", "aws-old", 500),
+	budgetCandidate("gcp", "gcp-old", 400),
+	budgetCandidate("aws", "aws-young", 200),
+	budgetCandidate("gcp", "gcp-oldest", 900),
+}
+
+var limitRotationsTests = []struct {
+	maxRotationsPerRun int
+	providerLimits     []config.ProviderLimit
+	expectedAccounts   []string
+}{
+	{0, nil, []string{"gcp-oldest", "aws-old", "gcp-old", "aws-young", "gcp-young"}},
+	{2, nil, []string{"gcp-oldest", "aws-old"}},
+	{0, []config.ProviderLimit{{Provider: "gcp", MaxRotationsPerRun: 1}},
+		[]string{"gcp-oldest", "aws-old", "aws-young"}},
+	{3, []config.ProviderLimit{{Provider: "aws", MaxRotationsPerRun: 1}},
+		[]string{"gcp-oldest", "aws-old", "gcp-old"}},
+}
+
+func TestLimitRotations(t *testing.T) {
+	for _, limitRotationsTest := range limitRotationsTests {
+		limited, accountResults := limitRotations(budgetCandidates, config.Config{
+			MaxRotationsPerRun: limitRotationsTest.maxRotationsPerRun,
+			ProviderLimits:     limitRotationsTest.providerLimits,
+		})
+		var accounts []string
+		for _, rc := range limited {
+			accounts = append(accounts, rc.key.Account)
+		}
+		if !reflect.DeepEqual(accounts, limitRotationsTest.expectedAccounts) {
+			t.Errorf("Incorrect rotation candidates, want: %v, got: %v",
+				limitRotationsTest.expectedAccounts, accounts)
+		}
+		if len(limited)+len(accountResults) != len(budgetCandidates) {
+			t.Errorf("Expected a skipped result for each dropped candidate, got: %+v", accountResults)
+		}
+		for _, accountResult := range accountResults {
+			if accountResult.Status != StatusSkipped {
+				t.Errorf("Incorrect status for dropped candidate: %s", accountResult.Status)
+			}
+		}
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	limiter := &rateLimiter{}
+	limiter.configure(config.Config{ProviderLimits: []config.ProviderLimit{
+		{Provider: "gcp", APICallIntervalMillis: 50},
+	}})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		limiter.wait("gcp")
+		limiter.wait("aws")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Calls weren't spaced out, 3 calls took: %s", elapsed)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotate
+
+import (
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+	"github.com/ovotech/cloud-key-rotator/pkg/cred"
+	"github.com/ovotech/cloud-key-rotator/pkg/location"
+)
+
+// Secret references in credentials are resolved lazily, when the provider or
+// location that uses them is reached, so that a reference that can't be
+// resolved only fails the runs (and locations) that actually need it.
+
+// resolveProviderSecrets resolves the secret references in the credentials
+// used to list and delete keys, i.e. the Aiven API token, if Aiven is one of
+// the providers the run covers
+func resolveProviderSecrets(c *config.Config, provider string) (err error) {
+	for _, keyProvider := range keyProviders(provider, "", *c) {
+		if keyProvider.Provider == "aiven" {
+			c.Credentials.AivenAPIToken, err = config.ResolveSecret(c.Credentials.AivenAPIToken)
+			return
+		}
+	}
+	return
+}
+
+// datadogAPIKey returns the API key to post key age metrics to Datadog with,
+// resolving its secret reference
+func datadogAPIKey(c config.Config) (string, error) {
+	if isDatadogKeySet(c.DatadogAPIKey) {
+		return config.ResolveSecret(c.DatadogAPIKey)
+	}
+	return config.ResolveSecret(c.Credentials.Datadog.APIKey)
+}
+
+// locationCredentials returns a copy of the credentials in which the secret
+// references in just the fields the location uses have been resolved. Named
+// credentials are narrowed down to the one the location refers to.
+func locationCredentials(keyWriter location.KeyWriter, creds cred.Credentials) (resolved cred.Credentials, err error) {
+	resolved = creds
+	switch kw := keyWriter.(type) {
+	case location.Atlas:
+		err = resolveNamed(kw.CredentialsRef, creds.AtlasKeysFor, &resolved.AtlasKeys, &resolved.Atlas)
+	case location.CircleCI:
+		err = resolveNamed(kw.CredentialsRef, creds.CircleCIAPITokenFor, &resolved.CircleCIAPIToken,
+			&resolved.CircleCI)
+	case location.CircleCIContext:
+		err = resolveNamed(kw.CredentialsRef, creds.CircleCIAPITokenFor, &resolved.CircleCIAPIToken,
+			&resolved.CircleCI)
+	case location.Datadog:
+		err = config.ResolveSecretsIn(&resolved.Datadog)
+	case location.Git:
+		if err = resolveNamed(kw.CredentialsRef, creds.GitAccountFor, &resolved.GitAccount,
+			&resolved.Git); err != nil {
+			return
+		}
+		for _, field := range []*string{&resolved.AkrPass, &resolved.AkrPath, &resolved.KmsKey} {
+			if err = config.ResolveSecretsIn(field); err != nil {
+				return
+			}
+		}
+		if kw.VerifyCircleCISuccess {
+			err = config.ResolveSecretsIn(&resolved.CircleCIAPIToken)
+		}
+	case location.GitHub:
+		err = resolveNamed(kw.CredentialsRef, creds.GitHubAPITokenFor, &resolved.GitHubAPIToken,
+			&resolved.GitHub)
+	case location.Gocd:
+		err = resolveNamed(kw.CredentialsRef, creds.GocdServerFor, &resolved.GocdServer, &resolved.Gocd)
+	case location.Vault:
+		err = resolveNamed(kw.CredentialsRef, creds.VaultAuthFor, &resolved.VaultAuth, &resolved.Vault)
+	}
+	return
+}
+
+// resolveNamed looks up the credentials a location's CredentialsRef refers
+// to (or the default credentials, if it's empty) and resolves their secret
+// references, setting them as both the default and the only named credentials
+func resolveNamed[T any](ref string, lookup func(string) (T, error), defaultCreds *T,
+	namedCreds *map[string]T) (err error) {
+	var value T
+	if value, err = lookup(ref); err != nil {
+		return
+	}
+	if err = config.ResolveSecretsIn(&value); err != nil {
+		return
+	}
+	*defaultCreds = value
+	*namedCreds = nil
+	if len(ref) > 0 {
+		*namedCreds = map[string]T{ref: value}
+	}
+	return
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotate
+
+import (
+	"reflect"
+	"testing"
+
+	keys "github.com/ovotech/cloud-key-client"
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+	"github.com/ovotech/cloud-key-rotator/pkg/cred"
+	"github.com/ovotech/cloud-key-rotator/pkg/location"
+)
+
+// lazyCreds holds secret references, of which only the CircleCI ones can be
+// resolved
+var lazyCreds = cred.Credentials{
+	CircleCIAPIToken: "env://CKR_TEST_CIRCLECI_TOKEN",
+	CircleCI:         map[string]string{"org-b": "env://CKR_TEST_CIRCLECI_TOKEN_B"},
+	GitHubAPIToken:   "env://CKR_TEST_NOT_SET",
+	AivenAPIToken:    "env://CKR_TEST_NOT_SET",
+	Datadog:          cred.Datadog{APIKey: "env://CKR_TEST_NOT_SET"},
+}
+
+var locationCredentialsTests = []struct {
+	keyWriter     location.KeyWriter
+	expectedCreds cred.Credentials
+	shouldError   bool
+}{
+	{location.CircleCI{}, cred.Credentials{CircleCIAPIToken: "token-a"}, false},
+	{location.CircleCIContext{CredentialsRef: "org-b"},
+		cred.Credentials{CircleCIAPIToken: "token-b", CircleCI: map[string]string{"org-b": "token-b"}}, false},
+	{location.CircleCI{CredentialsRef: "org-c"}, cred.Credentials{}, true},
+	{location.GitHub{}, cred.Credentials{}, true},
+	{location.Datadog{}, cred.Credentials{}, true},
+}
+
+func TestLocationCredentials(t *testing.T) {
+	t.Setenv("CKR_TEST_CIRCLECI_TOKEN", "token-a")
+	t.Setenv("CKR_TEST_CIRCLECI_TOKEN_B", "token-b")
+
+	for _, test := range locationCredentialsTests {
+		creds, err := locationCredentials(test.keyWriter, lazyCreds)
+		if actual := err != nil; actual != test.shouldError {
+			t.Errorf("Incorrect error behaviour for %s: %v", location.Describe(test.keyWriter, "aws"), err)
+		}
+		if err != nil {
+			continue
+		}
+		// only the fields the location uses are resolved
+		if creds.CircleCIAPIToken != test.expectedCreds.CircleCIAPIToken ||
+			!reflect.DeepEqual(creds.CircleCI, test.expectedCreds.CircleCI) ||
+			creds.GitHubAPIToken != lazyCreds.GitHubAPIToken {
+			t.Errorf("Incorrect credentials for %s: %+v", location.Describe(test.keyWriter, "aws"), creds)
+		}
+	}
+}
+
+func TestReportWithUnusedUnresolvableSecret(t *testing.T) {
+	var m MockProvider
+	keys.RegisterProvider("mockProvider", &m)
+
+	// none of the credentials are used by the mock provider, so a run can
+	// go ahead even though they can't be resolved
+	if _, err := Report("account1", "mockProvider", "project1",
+		config.Config{Credentials: lazyCreds}); err != nil {
+		t.Errorf("Unused secret references shouldn't be resolved, got: %v", err)
+	}
+
+	if _, err := Report("", "aiven", "", config.Config{Credentials: lazyCreds}); err == nil {
+		t.Error("Expected error for the Aiven API token, which is used")
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotate
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+	keys "github.com/ovotech/cloud-key-client"
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+	"github.com/ovotech/cloud-key-rotator/pkg/state"
+	"google.golang.org/api/googleapi"
+)
+
+// deferredDeletions type tracks old keys whose deletion has been deferred
+// until their grace period has passed. It's safe for concurrent use.
+type deferredDeletions struct {
+	mutex   sync.Mutex
+	store   state.Store
+	state   state.State
+	deleted map[string]bool
+}
+
+// loadDeferredDeletions loads the keys pending deletion from the configured
+// state store. Nil is returned if no grace period is configured.
+func loadDeferredDeletions(c config.Config) (deferred *deferredDeletions, err error) {
+	if !gracePeriodConfigured(c) {
+		return
+	}
+	if len(c.StateStore) == 0 {
+		err = errors.New("StateStore must be set in config when a grace period is configured")
+		return
+	}
+	var store state.Store
+	if store, err = state.NewStore(c.StateStore); err != nil {
+		return
+	}
+	deferred = &deferredDeletions{store: store, deleted: map[string]bool{}}
+	if deferred.state, err = store.Load(); err != nil {
+		return
+	}
+	logger.Infof("Loaded %d keys pending deletion from state store",
+		len(deferred.state.PendingDeletions))
+	return
+}
+
+// gracePeriodConfigured returns true if a grace period is configured either
+// globally or for any account
+func gracePeriodConfigured(c config.Config) bool {
+	if c.GracePeriodMins > 0 {
+		return true
+	}
+	for _, keyLocation := range c.AccountKeyLocations {
+		if keyLocation.GracePeriodMins > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// gracePeriod returns the grace period to give the old key of an account
+// before it's deleted, based on config values
+func gracePeriod(keyLocation config.KeyLocations, c config.Config) (gracePeriodMins int) {
+	gracePeriodMins = c.GracePeriodMins
+	if keyLocation.GracePeriodMins > 0 {
+		gracePeriodMins = keyLocation.GracePeriodMins
+	}
+	return
+}
+
+// pending returns true if the key is awaiting deletion, or has been deleted
+// during this run. Such keys shouldn't be rotated again.
+func (d *deferredDeletions) pending(key keys.Key) bool {
+	if d == nil {
+		return false
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.deleted[pendingDeletionID(key.Provider.Provider, key.Provider.GcpProject,
+		key.FullAccount, key.ID)] {
+		return true
+	}
+	for _, pd := range d.state.PendingDeletions {
+		if pd.Provider == key.Provider.Provider &&
+			pd.Project == key.Provider.GcpProject &&
+			pd.Account == key.FullAccount &&
+			pd.KeyID == key.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// add records the key as pending deletion once the grace period has passed,
+// saving the state straight away so the key can't be forgotten about
+func (d *deferredDeletions) add(key keys.Key, gracePeriodMins int) (deleteAfter time.Time, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	replacedAt := time.Now().UTC()
+	deleteAfter = replacedAt.Add(time.Duration(gracePeriodMins) * time.Minute)
+	d.state.PendingDeletions = append(d.state.PendingDeletions, state.PendingDeletion{
+		Provider:    key.Provider.Provider,
+		Project:     key.Provider.GcpProject,
+		Account:     key.FullAccount,
+		KeyID:       key.ID,
+		ReplacedAt:  replacedAt,
+		DeleteAfter: deleteAfter,
+	})
+	err = d.store.Save(d.state)
+	return
+}
+
+// remove removes the key from those pending deletion, e.g. because it's been
+// revoked, saving the state if it was pending
+func (d *deferredDeletions) remove(key keys.Key) (err error) {
+	if d == nil {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var stillPending []state.PendingDeletion
+	for _, pd := range d.state.PendingDeletions {
+		if pd.Provider == key.Provider.Provider &&
+			pd.Project == key.Provider.GcpProject &&
+			pd.Account == key.FullAccount &&
+			pd.KeyID == key.ID {
+			continue
+		}
+		stillPending = append(stillPending, pd)
+	}
+	if len(stillPending) == len(d.state.PendingDeletions) {
+		return
+	}
+	d.state.PendingDeletions = stillPending
+	return d.store.Save(d.state)
+}
+
+// deleteDue deletes the keys within the run's scope whose grace period has
+// passed, returning a result for each, and an error if any of them couldn't
+// be deleted. Keys that have already been deleted (e.g. manually) are no
+// longer pending. In plan mode, nothing is deleted.
+func (d *deferredDeletions) deleteDue(now time.Time, token string, plan bool,
+	inScope func(state.PendingDeletion) bool) (accountResults []AccountResult, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var stillPending []state.PendingDeletion
+	var failed int
+	for _, pd := range d.state.PendingDeletions {
+		if now.Before(pd.DeleteAfter) || !inScope(pd) {
+			stillPending = append(stillPending, pd)
+			continue
+		}
+		key := keys.Key{
+			FullAccount: pd.Account,
+			ID:          pd.KeyID,
+			Provider: keys.Provider{
+				Provider:   pd.Provider,
+				GcpProject: pd.Project,
+				Token:      token,
+			},
+		}
+		reason := fmt.Sprintf("grace period ended at %s", pd.DeleteAfter.Format(time.RFC3339))
+		if plan {
+			logger.Infow("Deletion of old key planned",
+				"keyProvider", pd.Provider,
+				"account", pd.Account,
+				"keyID", obfuscate(pd.KeyID),
+				"reason", reason)
+			accountResults = append(accountResults, newAccountResult(key, StatusPlanned, reason))
+			stillPending = append(stillPending, pd)
+			continue
+		}
+		if deleteErr := deleteKey(key, pd.Provider); isKeyNotFound(deleteErr) {
+			logger.Infow("Old key has already been deleted, so is no longer pending deletion",
+				"keyProvider", pd.Provider,
+				"account", pd.Account,
+				"keyID", obfuscate(pd.KeyID))
+			reason += ", key already deleted"
+		} else if deleteErr != nil {
+			logger.Errorw("Failed to delete old key after grace period, will retry on next run",
+				"keyProvider", pd.Provider,
+				"account", pd.Account,
+				"keyID", obfuscate(pd.KeyID),
+				"error", deleteErr)
+			accountResult := newAccountResult(key, StatusFailed, reason)
+			accountResult.Error = deleteErr.Error()
+			accountResults = append(accountResults, accountResult)
+			stillPending = append(stillPending, pd)
+			failed++
+			continue
+		}
+		d.deleted[pendingDeletionID(pd.Provider, pd.Project, pd.Account, pd.KeyID)] = true
+		accountResults = append(accountResults, newAccountResult(key, StatusDeleted, reason))
+	}
+	d.state.PendingDeletions = stillPending
+	if failed > 0 {
+		err = fmt.Errorf("Failed to delete %d old keys whose grace period has passed", failed)
+	}
+	return
+}
+
+// save saves the current state to the state store
+func (d *deferredDeletions) save() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.store.Save(d.state)
+}
+
+func pendingDeletionID(provider, project, account, keyID string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", provider, project, account, keyID)
+}
+
+// deletionScope returns a function reporting whether a pending deletion falls
+// within the scope of this run. Its account must have keys that passed the
+// run's account, provider and project filters, and the schedules that apply
+// to the account (with the blackouts of the freeze files supplied) must allow
+// changes to it now.
+func deletionScope(accountKeys []keys.Key, c config.Config, frozen freezeFiles,
+	now time.Time) func(state.PendingDeletion) bool {
+	accounts := map[string]keys.Key{}
+	for _, key := range accountKeys {
+		accounts[pendingDeletionID(key.Provider.Provider, key.Provider.GcpProject, key.FullAccount, "")] = key
+	}
+	return func(pd state.PendingDeletion) bool {
+		key, ok := accounts[pendingDeletionID(pd.Provider, pd.Project, pd.Account, "")]
+		if !ok {
+			return false
+		}
+		globalSchedule, err := newSchedule(c.Schedule, frozen)
+		var locationSchedule schedule
+		if err == nil {
+			var locations config.KeyLocations
+			if locations, err = accountKeyLocation(key, c.AccountKeyLocations); err == nil {
+				locationSchedule, err = newSchedule(locations.Schedule, frozen)
+			}
+		}
+		if err != nil {
+			logger.Errorw("Unable to check schedule for deletion of old key, will retry on next run",
+				"keyProvider", pd.Provider,
+				"account", pd.Account,
+				"keyID", obfuscate(pd.KeyID),
+				"error", err)
+			return false
+		}
+		if allowed, reason := scheduleAllows(now, globalSchedule, locationSchedule); !allowed {
+			logger.Infow("Deletion of old key deferred, as it's outside the rotation window",
+				"keyProvider", pd.Provider,
+				"account", pd.Account,
+				"keyID", obfuscate(pd.KeyID),
+				"reason", reason)
+			return false
+		}
+		return true
+	}
+}
+
+// isKeyNotFound returns true if the error from deleting a key shows that the
+// key doesn't exist
+func isKeyNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusNotFound
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return awsErr.Code() == iam.ErrCodeNoSuchEntityException
+	}
+	// Aiven API errors only carry the HTTP status in their message
+	return err != nil && strings.Contains(err.Error(), fmt.Sprintf("status: %d", http.StatusNotFound))
+}
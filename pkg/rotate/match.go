@@ -0,0 +1,230 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/template"
+
+	keys "github.com/ovotech/cloud-key-client"
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+)
+
+// Tiers of match between an account and a KeyLocations element, from least
+// to most specific
+const (
+	noMatch = iota
+	regexMatch
+	globMatch
+	exactMatch
+)
+
+// errNoAccountKeyLocation is returned when no keyLocation element in config
+// matches an account
+var errNoAccountKeyLocation = errors.New("No account key locations (in config) mapped to SA")
+
+// locationMatch type holds how specifically a KeyLocations element matches
+// an account
+type locationMatch struct {
+	tier     int
+	literals int
+}
+
+// moreSpecificThan returns true if m is a more specific match than other
+func (m locationMatch) moreSpecificThan(other locationMatch) bool {
+	if m.tier != other.tier {
+		return m.tier > other.tier
+	}
+	return m.literals > other.literals
+}
+
+// locationTemplateData type holds the values available to templates in
+// location fields, e.g. {{.Account}}
+type locationTemplateData struct {
+	Account  string
+	Provider string
+	Project  string
+}
+
+// accountKeyLocation gets the keyLocation element defined in config for the
+// key's account. An exact ServiceAccountName match wins, then the glob with
+// the most literal characters, then the first ServiceAccountNameRegex that
+// matches. Templates in the returned copy's location fields are rendered.
+func accountKeyLocation(key keys.Key,
+	keyLocations []config.KeyLocations) (accountKeyLocation config.KeyLocations, err error) {
+	var best locationMatch
+	for _, keyLocation := range keyLocations {
+		var match locationMatch
+		if match, err = matchKeyLocation(key.Account, keyLocation); err != nil {
+			return
+		}
+		if match.moreSpecificThan(best) {
+			best = match
+			accountKeyLocation = keyLocation
+		}
+	}
+	if best.tier == noMatch {
+		err = fmt.Errorf("%w: %s", errNoAccountKeyLocation, key.Account)
+		return
+	}
+	return renderKeyLocation(accountKeyLocation, locationTemplateData{
+		Account:  key.Account,
+		Provider: key.Provider.Provider,
+		Project:  key.Provider.GcpProject,
+	})
+}
+
+// matchKeyLocation returns how specifically the keyLocation element matches
+// the account, using its ServiceAccountName (an exact name or glob) and
+// ServiceAccountNameRegex (which has to match the whole account)
+func matchKeyLocation(account string, keyLocation config.KeyLocations) (match locationMatch, err error) {
+	if name := keyLocation.ServiceAccountName; len(name) > 0 {
+		if name == account {
+			match = locationMatch{tier: exactMatch, literals: len(name)}
+			return
+		}
+		var matched bool
+		if matched, err = path.Match(name, account); err != nil {
+			err = fmt.Errorf("Invalid ServiceAccountName glob: %s: %w", name, err)
+			return
+		}
+		if matched {
+			match = locationMatch{tier: globMatch, literals: globLiterals(name)}
+			return
+		}
+	}
+	if expr := keyLocation.ServiceAccountNameRegex; len(expr) > 0 {
+		var re *regexp.Regexp
+		if re, err = regexp.Compile("^(?:" + expr + ")$"); err != nil {
+			err = fmt.Errorf("Invalid ServiceAccountNameRegex: %s: %w", expr, err)
+			return
+		}
+		if re.MatchString(account) {
+			match = locationMatch{tier: regexMatch}
+		}
+	}
+	return
+}
+
+// globLiterals returns the number of characters in the glob that have to be
+// matched literally
+func globLiterals(glob string) (literals int) {
+	inClass := false
+	escaped := false
+	for _, r := range glob {
+		switch {
+		case escaped:
+			escaped = false
+			if !inClass {
+				literals++
+			}
+		case r == '\\':
+			escaped = true
+		case inClass:
+			inClass = r != ']'
+		case r == '[':
+			inClass = true
+		case r != '*' && r != '?':
+			literals++
+		}
+	}
+	return
+}
+
+// renderKeyLocation returns a copy of the keyLocation element, with its
+// ServiceAccountName set to the matched account, and the templates in all of
+// its location fields rendered with the data supplied
+func renderKeyLocation(keyLocation config.KeyLocations,
+	data locationTemplateData) (rendered config.KeyLocations, err error) {
+	rendered = keyLocation
+	rendered.ServiceAccountName = data.Account
+	v := reflect.ValueOf(&rendered).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		switch v.Type().Field(i).Name {
+		case "ServiceAccountName", "ServiceAccountNameRegex":
+			continue
+		}
+		if err = renderTemplates(v.Field(i), data); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// renderTemplates renders the templates in all string fields reachable from
+// v. Slices and maps are copied before being rendered, so the config the value
+// came from isn't modified.
+func renderTemplates(v reflect.Value, data locationTemplateData) (err error) {
+	switch v.Kind() {
+	case reflect.String:
+		if !strings.Contains(v.String(), "{{") {
+			return
+		}
+		var tmpl *template.Template
+		if tmpl, err = template.New("location").Option("missingkey=error").Parse(v.String()); err != nil {
+			return
+		}
+		var b bytes.Buffer
+		if err = tmpl.Execute(&b, data); err != nil {
+			return
+		}
+		v.SetString(b.String())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Field(i).CanSet() {
+				continue
+			}
+			if err = renderTemplates(v.Field(i), data); err != nil {
+				return
+			}
+		}
+	case reflect.Slice:
+		if v.IsNil() {
+			return
+		}
+		copied := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(copied, v)
+		v.Set(copied)
+		for i := 0; i < v.Len(); i++ {
+			if err = renderTemplates(v.Index(i), data); err != nil {
+				return
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			return
+		}
+		// map values aren't addressable, so each is rendered in a copy, which
+		// is put into a copy of the map
+		copied := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(iter.Value())
+			if err = renderTemplates(value, data); err != nil {
+				return
+			}
+			copied.SetMapIndex(iter.Key(), value)
+		}
+		v.Set(copied)
+	}
+	return
+}
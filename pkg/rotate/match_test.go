@@ -0,0 +1,127 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotate
+
+import (
+	"testing"
+
+	keys "github.com/ovotech/cloud-key-client"
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+	"github.com/ovotech/cloud-key-rotator/pkg/location"
+)
+
+var matchKeyLocations = []config.KeyLocations{
+	{ServiceAccountNameRegex: "team-[a-z]+-.*", RotationAgeThresholdMins: 1},
+	{ServiceAccountName: "team-*", RotationAgeThresholdMins: 2},
+	{ServiceAccountName: "team-a-*", RotationAgeThresholdMins: 3},
+	{ServiceAccountName: "team-a-deployer", RotationAgeThresholdMins: 4},
+	{ServiceAccountName: "team-?-deployer", RotationAgeThresholdMins: 5},
+}
+
+var accountKeyLocationTests = []struct {
+	account           string
+	expectedThreshold int
+	shouldError       bool
+}{
+	{"team-a-deployer", 4, false},   // exact match wins
+	{"team-b-deployer", 5, false},   // glob with the most literals wins
+	{"team-a-reader", 3, false},     // more specific glob wins
+	{"team-b-reader", 2, false},     // only one glob matches
+	{"team-a-reader/x", 1, false},   // globs don't match "/", so only the regex does
+	{"team-ab-deployerx", 2, false}, // more specific globs don't match
+	{"other-deployer", 0, true},     // nothing matches
+}
+
+func TestAccountKeyLocation(t *testing.T) {
+	for _, accountKeyLocationTest := range accountKeyLocationTests {
+		key := keys.Key{Account: accountKeyLocationTest.account}
+		keyLocation, err := accountKeyLocation(key, matchKeyLocations)
+		if actual := err != nil; actual != accountKeyLocationTest.shouldError {
+			t.Errorf("Incorrect error behaviour for %s: %v", accountKeyLocationTest.account, err)
+		}
+		if keyLocation.RotationAgeThresholdMins != accountKeyLocationTest.expectedThreshold {
+			t.Errorf("Incorrect key location matched for %s, want threshold: %d, got: %d",
+				accountKeyLocationTest.account, accountKeyLocationTest.expectedThreshold,
+				keyLocation.RotationAgeThresholdMins)
+		}
+		if !accountKeyLocationTest.shouldError && keyLocation.ServiceAccountName != accountKeyLocationTest.account {
+			t.Errorf("Incorrect ServiceAccountName, want: %s, got: %s",
+				accountKeyLocationTest.account, keyLocation.ServiceAccountName)
+		}
+	}
+}
+
+func TestAccountKeyLocationInvalidPatterns(t *testing.T) {
+	key := keys.Key{Account: "team-a-deployer"}
+	for _, keyLocation := range []config.KeyLocations{
+		{ServiceAccountName: "team-[a"},
+		{ServiceAccountNameRegex: "team-(a"},
+	} {
+		if _, err := accountKeyLocation(key, []config.KeyLocations{keyLocation}); err == nil {
+			t.Errorf("Expected error for invalid pattern in %+v", keyLocation)
+		}
+	}
+}
+
+func TestAccountKeyLocationTemplates(t *testing.T) {
+	keyLocations := []config.KeyLocations{{
+		ServiceAccountName: "team-*",
+		K8s:                []location.K8s{{SecretName: "{{.Account}}-key"}},
+		SSM:                []location.Ssm{{KeyParamName: "/ckr/{{.Provider}}/{{.Project}}/{{.Account}}"}},
+	}}
+	key := keys.Key{Account: "team-a", Provider: keys.Provider{Provider: "gcp", GcpProject: "my-project"}}
+	keyLocation, err := accountKeyLocation(key, keyLocations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := keyLocation.K8s[0].SecretName; actual != "team-a-key" {
+		t.Errorf("Incorrect K8s SecretName, want: team-a-key, got: %s", actual)
+	}
+	if actual := keyLocation.SSM[0].KeyParamName; actual != "/ckr/gcp/my-project/team-a" {
+		t.Errorf("Incorrect SSM KeyParamName, want: /ckr/gcp/my-project/team-a, got: %s", actual)
+	}
+	// the config itself mustn't be modified, so it can be rendered for other accounts
+	if actual := keyLocations[0].K8s[0].SecretName; actual != "{{.Account}}-key" {
+		t.Errorf("Config was modified by rendering, got K8s SecretName: %s", actual)
+	}
+
+	keyLocations[0].K8s[0].SecretName = "{{.Team}}-key"
+	if _, err = accountKeyLocation(key, keyLocations); err == nil {
+		t.Error("Expected error for template referring to unknown field")
+	}
+}
+
+func TestAccountKeyLocationMapTemplates(t *testing.T) {
+	keyLocations := []config.KeyLocations{{
+		ServiceAccountName: "team-*",
+		K8s: []location.K8s{{SecretName: "key", Labels: map[string]string{"account": "{{.Account}}"},
+			Annotations: map[string]string{"ckr/provider": "{{.Provider}}"}}},
+	}}
+	key := keys.Key{Account: "team-a", Provider: keys.Provider{Provider: "gcp", GcpProject: "my-project"}}
+	keyLocation, err := accountKeyLocation(key, keyLocations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := keyLocation.K8s[0].Labels["account"]; actual != "team-a" {
+		t.Errorf("Incorrect K8s label, want: team-a, got: %s", actual)
+	}
+	if actual := keyLocation.K8s[0].Annotations["ckr/provider"]; actual != "gcp" {
+		t.Errorf("Incorrect K8s annotation, want: gcp, got: %s", actual)
+	}
+	// the config's maps mustn't be modified, so they can be rendered for other accounts
+	if actual := keyLocations[0].K8s[0].Labels["account"]; actual != "{{.Account}}" {
+		t.Errorf("Config was modified by rendering, got K8s label: %s", actual)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotate
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	keys "github.com/ovotech/cloud-key-client"
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+)
+
+// Report formats
+const (
+	ReportFormatTable = "table"
+	ReportFormatJSON  = "json"
+	ReportFormatCSV   = "csv"
+)
+
+// KeyReport type holds the details of a single key, and how it relates to
+// the app config
+type KeyReport struct {
+	Provider              string
+	Project               string
+	Account               string
+	KeyID                 string
+	AgeMins               float64
+	Status                string
+	RotationThresholdMins int
+	Overdue               bool
+	Locations             []string
+}
+
+var reportHeader = []string{"PROVIDER", "PROJECT", "ACCOUNT", "KEY ID", "AGE (MINS)",
+	"STATUS", "THRESHOLD (MINS)", "OVERDUE", "LOCATIONS"}
+
+// Report returns a KeyReport for each of the keys found in the configured
+// providers, after filtering
+func Report(account, provider, project string, c config.Config) (keyReports []KeyReport, err error) {
+	if err = validateFlags(account, provider, project); err != nil {
+		return
+	}
+	if err = resolveProviderSecrets(&c, provider); err != nil {
+		return
+	}
+	var providerKeys []keys.Key
+	if providerKeys, err = keysOfProviders(account, provider, project, c); err != nil {
+		return
+	}
+	defaultRotationAgeThresholdMins := defaultRotationAgeThreshold(c)
+	for _, key := range providerKeys {
+		var keyReport KeyReport
+		if keyReport, err = reportKey(key, c, defaultRotationAgeThresholdMins); err != nil {
+			return
+		}
+		keyReports = append(keyReports, keyReport)
+	}
+	return
+}
+
+// reportKey returns the KeyReport for the key. Keys without locations
+// configured are reported against the default age threshold.
+func reportKey(key keys.Key, c config.Config,
+	defaultRotationAgeThresholdMins int) (keyReport KeyReport, err error) {
+	keyReport = KeyReport{
+		Provider:              key.Provider.Provider,
+		Project:               key.Provider.GcpProject,
+		Account:               key.FullAccount,
+		KeyID:                 obfuscate(key.ID),
+		AgeMins:               key.Age,
+		Status:                key.Status,
+		RotationThresholdMins: defaultRotationAgeThresholdMins,
+	}
+	var keyLocation config.KeyLocations
+	if keyLocation, err = accountKeyLocation(key, c.AccountKeyLocations); err == nil {
+		keyReport.RotationThresholdMins = rotationAgeThreshold(keyLocation, defaultRotationAgeThresholdMins)
+		kws, _ := keyWriters(keyLocation)
+		for _, kw := range kws {
+			keyReport.Locations = append(keyReport.Locations,
+				strings.TrimPrefix(fmt.Sprintf("%T", kw), "location."))
+		}
+	} else if errors.Is(err, errNoAccountKeyLocation) {
+		err = nil
+	} else {
+		return
+	}
+	keyReport.Overdue = key.Age >= float64(keyReport.RotationThresholdMins)
+	return
+}
+
+// WriteReport writes the key reports to w, in the format specified
+func WriteReport(w io.Writer, keyReports []KeyReport, format string) (err error) {
+	switch format {
+	case ReportFormatTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(reportHeader, "\t"))
+		for _, keyReport := range keyReports {
+			fmt.Fprintln(tw, strings.Join(keyReport.fields(), "\t"))
+		}
+		err = tw.Flush()
+	case ReportFormatJSON:
+		if keyReports == nil {
+			keyReports = []KeyReport{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(keyReports)
+	case ReportFormatCSV:
+		cw := csv.NewWriter(w)
+		if err = cw.Write(reportHeader); err != nil {
+			return
+		}
+		for _, keyReport := range keyReports {
+			if err = cw.Write(keyReport.fields()); err != nil {
+				return
+			}
+		}
+		cw.Flush()
+		err = cw.Error()
+	default:
+		err = fmt.Errorf("Report format: %s is not supported", format)
+	}
+	return
+}
+
+// fields returns the values of the key report, in the order of reportHeader
+func (k KeyReport) fields() []string {
+	return []string{
+		k.Provider,
+		k.Project,
+		k.Account,
+		k.KeyID,
+		strconv.FormatFloat(k.AgeMins, 'f', 0, 64),
+		k.Status,
+		strconv.Itoa(k.RotationThresholdMins),
+		strconv.FormatBool(k.Overdue),
+		strings.Join(k.Locations, ";"),
+	}
+}
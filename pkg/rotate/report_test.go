@@ -0,0 +1,111 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotate
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	keys "github.com/ovotech/cloud-key-client"
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+	"github.com/ovotech/cloud-key-rotator/pkg/location"
+)
+
+var reportTests = []struct {
+	keyLocations      []config.KeyLocations
+	expectedThreshold int
+	expectedOverdue   bool
+	expectedLocations []string
+}{
+	{nil, defaultRotationAgeThreshold(config.Config{}), true, nil},
+	{[]config.KeyLocations{{ServiceAccountName: "account1", RotationAgeThresholdMins: shortRotationPeriod,
+		GCS: []location.Gcs{{BucketName: "bucket"}}, SSM: []location.Ssm{{KeyParamName: "key"}}}},
+		shortRotationPeriod, true, []string{"Gcs", "Ssm"}},
+	{[]config.KeyLocations{{ServiceAccountName: "account*", RotationAgeThresholdMins: longRotationPeriod}},
+		longRotationPeriod, false, nil},
+}
+
+func TestReport(t *testing.T) {
+	var m MockProvider
+	keys.RegisterProvider("mockProvider", &m)
+
+	for _, reportTest := range reportTests {
+		keyReports, err := Report("account1", "mockProvider", "project1",
+			config.Config{AccountKeyLocations: reportTest.keyLocations})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keyReports) != 1 {
+			t.Fatalf("Expected 1 key report, got: %d", len(keyReports))
+		}
+		keyReport := keyReports[0]
+		if keyReport.RotationThresholdMins != reportTest.expectedThreshold ||
+			keyReport.Overdue != reportTest.expectedOverdue ||
+			!reflect.DeepEqual(keyReport.Locations, reportTest.expectedLocations) {
+			t.Errorf("Incorrect key report: %+v", keyReport)
+		}
+		if keyReport.KeyID != "****1234" {
+			t.Errorf("Key ID should be obfuscated, got: %s", keyReport.KeyID)
+		}
+	}
+	if m.created || m.deleted {
+		t.Error("Key should not have been created or deleted by a report")
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	keyReports := []KeyReport{{Provider: "gcp", Project: "project1", Account: "account1",
+		KeyID: "****1234", AgeMins: 1000.4, Status: "Active", RotationThresholdMins: 900,
+		Overdue: true, Locations: []string{"Gcs", "Ssm"}}}
+
+	var b bytes.Buffer
+	if err := WriteReport(&b, keyReports, ReportFormatCSV); err != nil {
+		t.Fatal(err)
+	}
+	expectedCSV := "PROVIDER,PROJECT,ACCOUNT,KEY ID,AGE (MINS),STATUS,THRESHOLD (MINS),OVERDUE,LOCATIONS\n" +
+		"gcp,project1,account1,****1234,1000,Active,900,true,Gcs;Ssm\n"
+	if b.String() != expectedCSV {
+		t.Errorf("Incorrect CSV report, want: %q, got: %q", expectedCSV, b.String())
+	}
+
+	b.Reset()
+	if err := WriteReport(&b, keyReports, ReportFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []KeyReport
+	if err := json.Unmarshal(b.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, keyReports) {
+		t.Errorf("Incorrect JSON report, want: %+v, got: %+v", keyReports, decoded)
+	}
+
+	b.Reset()
+	if err := WriteReport(&b, keyReports, ReportFormatTable); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "PROVIDER  PROJECT") ||
+		!strings.Contains(lines[1], "account1") {
+		t.Errorf("Incorrect table report: %q", b.String())
+	}
+
+	if err := WriteReport(&b, keyReports, "xml"); err == nil {
+		t.Error("Expected error for unsupported report format")
+	}
+}
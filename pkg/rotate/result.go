@@ -0,0 +1,96 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotate
+
+import (
+	"fmt"
+	"strings"
+
+	keys "github.com/ovotech/cloud-key-client"
+	"github.com/ovotech/cloud-key-rotator/pkg/location"
+)
+
+// Statuses of an AccountResult
+const (
+	StatusRotated = "rotated"
+	StatusPlanned = "planned"
+	StatusSkipped = "skipped"
+	StatusDeleted = "deleted"
+	StatusRevoked = "revoked"
+	StatusFailed  = "failed"
+)
+
+// Result type holds the outcome of a call to Rotate for each of the accounts
+// that were considered for rotation
+type Result struct {
+	Accounts []AccountResult
+}
+
+// AccountResult type holds the outcome for a single account. When a rotation
+// fails, UpdatedLocations holds the locations that were updated before the
+// failure, and UnrestoredLocations those that couldn't then be rolled back.
+type AccountResult struct {
+	Provider            string
+	Project             string
+	Account             string
+	KeyID               string
+	Status              string
+	Reason              string `json:",omitempty"`
+	Error               string `json:",omitempty"`
+	UpdatedLocations    []location.UpdatedLocation
+	UnrestoredLocations []string
+}
+
+// newAccountResult creates an AccountResult for the key, with an obfuscated
+// key ID
+func newAccountResult(key keys.Key, status, reason string) AccountResult {
+	return AccountResult{
+		Provider: key.Provider.Provider,
+		Project:  key.Provider.GcpProject,
+		Account:  key.FullAccount,
+		KeyID:    obfuscate(key.ID),
+		Status:   status,
+		Reason:   reason,
+	}
+}
+
+// Failed returns true if the rotation of any account failed
+func (r Result) Failed() bool {
+	return r.Summary()[StatusFailed] > 0
+}
+
+// failedError returns an error naming the accounts that failed, or nil if
+// none did, so a run that carried on past failures still fails overall
+func (r Result) failedError() error {
+	var failed []string
+	for _, account := range r.Accounts {
+		if account.Status == StatusFailed {
+			failed = append(failed, account.Account)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d accounts failed: %s", len(failed), strings.Join(failed, ", "))
+}
+
+// Summary returns the number of accounts with each status
+func (r Result) Summary() (summary map[string]int) {
+	summary = map[string]int{}
+	for _, account := range r.Accounts {
+		summary[account.Status]++
+	}
+	return
+}
@@ -0,0 +1,179 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	keys "github.com/ovotech/cloud-key-client"
+	"github.com/ovotech/cloud-key-rotator/pkg/build"
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+	"github.com/ovotech/cloud-key-rotator/pkg/location"
+)
+
+// auditEventKeyRevoked is the audit event logged when a key is revoked
+const auditEventKeyRevoked = "KeyRevoked"
+
+// Revoke immediately deletes a compromised key of the account, regardless of
+// its age, schedule or grace period. Unless replace is false, a new key is
+// created and written to the account's locations first, and the compromised
+// key isn't deleted if that fails. The key ID only needs supplying when the
+// account has more than one key.
+func Revoke(account, provider, project, keyID string, replace bool,
+	c config.Config) (result Result, err error) {
+	defer logger.Sync()
+
+	logger.Infof("cloud-key-rotator %s revoke called", build.Version)
+	if len(account) == 0 {
+		err = errors.New("Account flag must be set to revoke a key")
+		return
+	}
+	if err = validateFlags(account, provider, project); err != nil {
+		return
+	}
+	if err = resolveProviderSecrets(&c, provider); err != nil {
+		return
+	}
+	var releaseRunLock func()
+	if releaseRunLock, err = acquireRunLock(c); err != nil {
+		return
+	}
+	defer releaseRunLock()
+	var key keys.Key
+	if key, err = compromisedKey(account, provider, project, keyID, c); err != nil {
+		return
+	}
+	reason := "key revoked without replacement"
+	if replace {
+		reason = "key revoked and replaced"
+	}
+	accountResult := newAccountResult(key, StatusFailed, reason)
+	defer func() {
+		if err != nil {
+			accountResult.Error = err.Error()
+		}
+		result.Accounts = append(result.Accounts, accountResult)
+	}()
+	var deferred *deferredDeletions
+	if deferred, err = loadDeferredDeletions(c); err != nil {
+		return
+	}
+	var newKeyID string
+	if replace {
+		if newKeyID, accountResult.UpdatedLocations, accountResult.UnrestoredLocations,
+			err = replaceKey(key, c); err != nil {
+			err = fmt.Errorf("Failed to replace key, so it hasn't been revoked "+
+				"(use --no-replace to revoke it regardless): %w", err)
+			return
+		}
+	}
+	if err = deleteKey(key, key.Provider.Provider); err != nil {
+		return
+	}
+	if err = deferred.remove(key); err != nil {
+		err = fmt.Errorf("Key revoked, but failed to remove it from state store: %w", err)
+		return
+	}
+	accountResult.Status = StatusRevoked
+	auditRevocation(key, newKeyID, accountResult.UpdatedLocations)
+	return
+}
+
+// compromisedKey returns the key of the account with the key ID supplied, or
+// the account's only key if no key ID is supplied
+func compromisedKey(account, provider, project, keyID string,
+	c config.Config) (key keys.Key, err error) {
+	var providerKeys []keys.Key
+	// inactive keys are included, as they can be reactivated
+	if providerKeys, err = keys.Keys(keyProviders(provider, project, c), true); err != nil {
+		return
+	}
+	var accountKeys []keys.Key
+	for _, providerKey := range providerKeys {
+		if providerKey.Account != account {
+			continue
+		}
+		if providerKey.ID == keyID {
+			key = providerKey
+			return
+		}
+		accountKeys = append(accountKeys, providerKey)
+	}
+	switch {
+	case len(keyID) > 0:
+		err = fmt.Errorf("Key: %s of account: %s not found", obfuscate(keyID), account)
+	case len(accountKeys) == 0:
+		err = fmt.Errorf("No keys found for account: %s", account)
+	case len(accountKeys) > 1:
+		err = fmt.Errorf("Account: %s has %d keys, use --key-id to choose which to revoke",
+			account, len(accountKeys))
+	default:
+		key = accountKeys[0]
+	}
+	return
+}
+
+// replaceKey creates a new key for the account of the key being revoked,
+// verifies it and writes it to the account's locations. The new key is
+// deleted again if any of that fails, unless it's held by locations that
+// couldn't be rolled back.
+func replaceKey(key keys.Key, c config.Config) (newKeyID string,
+	updatedLocations []location.UpdatedLocation, unrestoredLocations []string, err error) {
+	keyProvider := key.Provider.Provider
+	var keyLocation config.KeyLocations
+	if keyLocation, err = accountKeyLocation(key, c.AccountKeyLocations); err != nil {
+		return
+	}
+	if keyProvider == "gcp" {
+		ensureGoogleAppCreds()
+	}
+	var newKey string
+	if newKeyID, newKey, err = createKey(key, keyProvider); err != nil {
+		return
+	}
+	if err = verifyNewKey(key, newKeyID, newKey, c); err != nil {
+		discardNewKey(key, newKeyID, keyProvider)
+		return
+	}
+	keyWrapper := location.KeyWrapper{Key: newKey, KeyID: newKeyID, KeyProvider: keyProvider}
+	if updatedLocations, unrestoredLocations, err = updateKeyLocation(key.FullAccount,
+		keyLocation, keyWrapper, c.Credentials); err != nil {
+		err = discardUnheldNewKey(key, newKeyID, keyProvider, unrestoredLocations, err)
+	}
+	return
+}
+
+// auditRevocation logs the audit event for a revoked key, so revocations can
+// be told apart from routine rotations
+func auditRevocation(key keys.Key, newKeyID string, updatedLocations []location.UpdatedLocation) {
+	host, _ := os.Hostname()
+	fields := []interface{}{
+		"auditEvent", auditEventKeyRevoked,
+		"keyProvider", key.Provider.Provider,
+		"project", key.Provider.GcpProject,
+		"account", key.FullAccount,
+		"keyID", obfuscate(key.ID),
+		"replaced", len(newKeyID) > 0,
+		"host", host,
+	}
+	if len(newKeyID) > 0 {
+		fields = append(fields,
+			"newKeyID", obfuscate(newKeyID),
+			"keyLocationUpdates", updatedLocations)
+	}
+	logger.Warnw("Key revoked", fields...)
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotate
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	keys "github.com/ovotech/cloud-key-client"
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+	"github.com/ovotech/cloud-key-rotator/pkg/state"
+)
+
+var revokeConfig = config.Config{AccountKeyLocations: []config.KeyLocations{
+	// the threshold would prevent a rotation, but not a revocation
+	{RotationAgeThresholdMins: longRotationPeriod, ServiceAccountName: "account1"}}}
+
+var revokeTests = []struct {
+	name            string
+	keyID           string
+	replace         bool
+	c               config.Config
+	shouldError     bool
+	expectedCreated bool
+	expectedDeleted []string
+}{
+	{"replace", "", true, revokeConfig, false, true, []string{"abcd1234"}},
+	{"replaceKeyID", "abcd1234", true, revokeConfig, false, true, []string{"abcd1234"}},
+	{"noReplace", "", false, config.Config{}, false, false, []string{"abcd1234"}},
+	{"unknownKeyID", "wxyz9876", true, revokeConfig, true, false, nil},
+	// the key is left alone if it can't be replaced
+	{"noLocations", "", true, config.Config{}, true, false, nil},
+}
+
+func TestRevoke(t *testing.T) {
+	for _, test := range revokeTests {
+		var m MockProvider
+		keys.RegisterProvider("mockProvider", &m)
+		result, err := Revoke("account1", "mockProvider", "project1", test.keyID, test.replace, test.c)
+		if (err != nil) != test.shouldError {
+			t.Errorf("%s: incorrect error behaviour: %v", test.name, err)
+		}
+		if m.created != test.expectedCreated || !reflect.DeepEqual(m.deletedKeyIDs, test.expectedDeleted) {
+			t.Errorf("%s: incorrect keys created (%t) or deleted (%v)", test.name, m.created, m.deletedKeyIDs)
+		}
+		if !test.shouldError && result.Summary()[StatusRevoked] != 1 {
+			t.Errorf("%s: expected key to be revoked, got result: %v", test.name, result)
+		}
+	}
+}
+
+func TestRevokeRequiresAccount(t *testing.T) {
+	var m MockProvider
+	keys.RegisterProvider("mockProvider", &m)
+	if _, err := Revoke("", "mockProvider", "project1", "", false, config.Config{}); err == nil || m.deleted {
+		t.Error("Expected revocation without an account to be refused")
+	}
+}
+
+func TestRevokePendingDeletion(t *testing.T) {
+	var m MockProvider
+	keys.RegisterProvider("mockProvider", &m)
+	stateStore := "file://" + filepath.Join(t.TempDir(), "state.json")
+	var locations config.KeyLocations = config.KeyLocations{RotationAgeThresholdMins: shortRotationPeriod, ServiceAccountName: "account1"}
+	c := config.Config{RotationMode: true, GracePeriodMins: 60, StateStore: stateStore,
+		AccountKeyLocations: []config.KeyLocations{locations}}
+
+	// the old key is pending deletion after being rotated
+	if _, err := Rotate("account1", "mockProvider", "project1", c); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Revoke("account1", "mockProvider", "project1", "abcd1234", false, c); err != nil {
+		t.Error(err)
+	}
+
+	store, _ := state.NewStore(stateStore)
+	if s, _ := store.Load(); len(s.PendingDeletions) != 0 {
+		t.Errorf("Expected revoked key to no longer be pending deletion, got: %v", s.PendingDeletions)
+	}
+}
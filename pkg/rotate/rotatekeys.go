@@ -24,6 +24,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	keys "github.com/ovotech/cloud-key-client"
@@ -40,11 +41,23 @@ type rotationCandidate struct {
 	key                   keys.Key
 	keyLocation           config.KeyLocations
 	rotationThresholdMins int
+	gracePeriodMins       int
+	self                  bool
+}
+
+// writtenLocation type holds a location that's been written to, along with
+// the values it held beforehand (if the location is able to restore itself)
+// and the credentials it was written with
+type writtenLocation struct {
+	keyWriter location.KeyWriter
+	snapshot  location.Snapshot
+	creds     cred.Credentials
 }
 
 var (
 	logger                    = log.StdoutLogger().Sugar()
 	provisionedGoogleAppCreds = false
+	googleAppCredsMutex       sync.Mutex
 )
 
 const (
@@ -93,28 +106,44 @@ func keysOfProviders(account, provider, project string, c config.Config) (accoun
 	return filterKeys(accountKeys, c, account)
 }
 
-// Rotate rotates those keys..
-func Rotate(account, provider, project string, c config.Config) (err error) {
+// Rotate rotates those keys, returning the outcome for each account that was
+// considered for rotation
+func Rotate(account, provider, project string, c config.Config) (result Result, err error) {
 	defer logger.Sync()
 
 	logger.Infof("cloud-key-rotator %s rotate called", build.Version)
 	if err = validateFlags(account, provider, project); err != nil {
 		return
 	}
+	if err = resolveProviderSecrets(&c, provider); err != nil {
+		return
+	}
+	if c.Plan {
+		// a plan should report exactly what a rotation would do, so keys need
+		// to be filtered as they would be in rotation mode
+		c.RotationMode = true
+	} else if c.RotationMode {
+		// keys are listed after taking the lock, so an overlapping run can't
+		// rotate them while this run acts on them
+		var releaseRunLock func()
+		if releaseRunLock, err = acquireRunLock(c); err != nil {
+			return
+		}
+		defer releaseRunLock()
+	}
 	var providerKeys []keys.Key
 	if providerKeys, err = keysOfProviders(account, provider, project, c); err != nil {
 		return
 	}
 	logger.Infof("Filtered down to %d keys based on current app config", len(providerKeys))
-	ddAPIKey := ""
-	if isDatadogKeySet(c.DatadogAPIKey) {
-		ddAPIKey = c.DatadogAPIKey
-	} else if isDatadogKeySet(c.Credentials.Datadog.APIKey) {
-		ddAPIKey = c.Credentials.Datadog.APIKey
-	}
-	if ddAPIKey != "" && c.Datadog != (config.Datadog{}) {
-		if metricErr := postMetric(providerKeys, ddAPIKey, c.Datadog); metricErr != nil {
+	// a plan is a dry run, so it mustn't post metrics
+	if c.Datadog != (config.Datadog{}) && !c.Plan {
+		if ddAPIKey, metricErr := datadogAPIKey(c); metricErr != nil {
 			logger.Infow("Posting metrics errored", metricErr)
+		} else if ddAPIKey != "" {
+			if metricErr = postMetric(providerKeys, ddAPIKey, c.Datadog); metricErr != nil {
+				logger.Infow("Posting metrics errored", metricErr)
+			}
 		}
 	}
 	if !c.RotationMode {
@@ -128,17 +157,45 @@ func Rotate(account, provider, project string, c config.Config) (err error) {
 		}
 		return
 	}
-	var rc []rotationCandidate
-	var defaultAgeThreshold int
-	if c.DefaultRotationAgeThresholdMins > 0 {
-		defaultAgeThreshold = c.DefaultRotationAgeThresholdMins
-	} else {
-		defaultAgeThreshold = 5
+	apiRateLimiter.configure(c)
+	var deferred *deferredDeletions
+	if deferred, err = loadDeferredDeletions(c); err != nil {
+		return
 	}
-	if rc, err = rotationCandidates(providerKeys, c.AccountKeyLocations,
-		c.Credentials, defaultAgeThreshold); err != nil {
+	frozen := readFreezeFiles(c)
+	// a failure to delete old keys doesn't stop the rotation of others, but
+	// still fails the run
+	var deletionResults []AccountResult
+	var deleteErr error
+	if deferred != nil {
+		deletionResults, deleteErr = deferred.deleteDue(time.Now(), c.Credentials.AivenAPIToken, c.Plan,
+			deletionScope(providerKeys, c, frozen, time.Now()))
+		result.Accounts = append(result.Accounts, deletionResults...)
+		if !c.Plan {
+			defer func() {
+				if saveErr := deferred.save(); saveErr != nil {
+					logger.Errorw("Failed to save state", "error", saveErr)
+					if err == nil {
+						err = saveErr
+					}
+				}
+			}()
+		}
+	}
+	var rc []rotationCandidate
+	var accountResults []AccountResult
+	rc, accountResults, err = rotationCandidates(providerKeys, c, frozen, deferred, time.Now())
+	result.Accounts = append(result.Accounts, accountResults...)
+	if err != nil {
 		return
 	}
+	// failed deletions are reported by deleteErr, the summary of other
+	// failures only needs to cover the accounts considered for rotation
+	failedErr := func() error {
+		return errors.Join(deleteErr, Result{Accounts: result.Accounts[len(deletionResults):]}.failedError())
+	}
+	rc, accountResults = limitRotations(rc, c)
+	result.Accounts = append(result.Accounts, accountResults...)
 
 	var rcStrings []string
 	for _, rcKey := range rc {
@@ -148,14 +205,28 @@ func Rotate(account, provider, project string, c config.Config) (err error) {
 	logger.Infof("Finalised %d keys that are candidates for rotation: %v",
 		len(rc), rcStrings)
 
-	return rotateKeys(rc, c.Credentials)
+	if c.Plan {
+		result.Accounts = append(result.Accounts, planRotations(rc)...)
+		err = failedErr()
+		return
+	}
+
+	accountResults, err = rotateKeys(rc, c, deferred)
+	result.Accounts = append(result.Accounts, accountResults...)
+	if err == nil {
+		err = failedErr()
+	}
+	return
 }
 
 // rotateKey creates a new key for the rotation candidate, updates its key locations,
-// and deletes the old key iff the key location update is successful
-func rotateKey(rotationCandidate rotationCandidate, creds cred.Credentials) (err error) {
+// and deletes the old key iff the key location update is successful. If the
+// candidate has a grace period, deletion of the old key is deferred instead.
+func rotateKey(rotationCandidate rotationCandidate, c config.Config,
+	deferred *deferredDeletions) (accountResult AccountResult, err error) {
 	key := rotationCandidate.key
 	keyProvider := key.Provider.Provider
+	accountResult = newAccountResult(key, StatusFailed, rotationReason(rotationCandidate))
 	if keyProvider == "gcp" {
 		ensureGoogleAppCreds()
 	}
@@ -164,11 +235,33 @@ func rotateKey(rotationCandidate rotationCandidate, creds cred.Credentials) (err
 	if newKeyID, newKey, err = createKey(key, keyProvider); err != nil {
 		return
 	}
+	// don't distribute the new key until it's been proven usable
+	if err = verifyNewKey(key, newKeyID, newKey, c); err != nil {
+		discardNewKey(key, newKeyID, keyProvider)
+		return
+	}
 	keyWrapper := location.KeyWrapper{Key: newKey, KeyID: newKeyID, KeyProvider: keyProvider}
-	if err = updateKeyLocation(key.FullAccount, rotationCandidate.keyLocation, keyWrapper, creds); err != nil {
+	if accountResult.UpdatedLocations, accountResult.UnrestoredLocations, err = updateKeyLocation(key.FullAccount,
+		rotationCandidate.keyLocation, keyWrapper, c.Credentials); err != nil {
+		err = discardUnheldNewKey(key, newKeyID, keyProvider, accountResult.UnrestoredLocations, err)
 		return
 	}
-	return deleteKey(key, keyProvider)
+	if rotationCandidate.gracePeriodMins > 0 {
+		var deleteAfter time.Time
+		if deleteAfter, err = deferred.add(key, rotationCandidate.gracePeriodMins); err != nil {
+			err = fmt.Errorf("Key rotated, but failed to record deferred deletion of old key: %w", err)
+			return
+		}
+		logger.Infow("Old key deletion deferred",
+			"keyProvider", keyProvider,
+			"account", key.FullAccount,
+			"keyID", obfuscate(key.ID),
+			"deleteAfter", deleteAfter.Format(time.RFC3339))
+	} else if err = deleteKey(key, keyProvider); err != nil {
+		return
+	}
+	accountResult.Status = StatusRotated
+	return
 }
 
 // rotationAgeThreshold calculates the key age rotation threshold based on config values
@@ -180,43 +273,192 @@ func rotationAgeThreshold(keyLocation config.KeyLocations, defaultRotationAgeThr
 	return
 }
 
-// rotateKeys iterates over the rotation candidates, invoking the func that actually
-// performs the rotation
-func rotateKeys(rotationCandidates []rotationCandidate, creds cred.Credentials) (err error) {
+// defaultRotationAgeThreshold returns the key age rotation threshold to use
+// when one isn't set for an account
+func defaultRotationAgeThreshold(c config.Config) int {
+	if c.DefaultRotationAgeThresholdMins > 0 {
+		return c.DefaultRotationAgeThresholdMins
+	}
+	return 5
+}
+
+// rotationReason describes why the rotation candidate is due to be rotated
+func rotationReason(rc rotationCandidate) string {
+	return fmt.Sprintf("key age of %.2f mins exceeds threshold of %d mins",
+		rc.key.Age, rc.rotationThresholdMins)
+}
+
+// rotateKeys rotates the rotation candidates, with up to concurrency of them
+// being rotated in parallel. Candidates that are the rotator's own ('self')
+// keys are rotated strictly last, one at a time, once all other rotations
+// have finished. Unless ContinueOnError is set, no more rotations are started
+// after the first failure. Otherwise, every candidate is attempted, and any
+// failures are only recorded in the results.
+func rotateKeys(rotationCandidates []rotationCandidate, c config.Config,
+	deferred *deferredDeletions) (accountResults []AccountResult, err error) {
+	continueOnError := c.ContinueOnError
+	var otherCandidates []rotationCandidate
+	var selfCandidates []rotationCandidate
+	for _, rc := range rotationCandidates {
+		if rc.self {
+			selfCandidates = append(selfCandidates, rc)
+		} else {
+			otherCandidates = append(otherCandidates, rc)
+		}
+	}
+	accountResults, err = rotateBatch(otherCandidates, c, deferred, c.Concurrency)
+	if err == nil || continueOnError {
+		selfResults, selfErr := rotateBatch(selfCandidates, c, deferred, 1)
+		accountResults = append(accountResults, selfResults...)
+		if err == nil {
+			err = selfErr
+		}
+	}
+	if continueOnError {
+		// the failures are recorded in the results, which Rotate summarises
+		err = nil
+	}
+	return
+}
+
+// rotateBatch rotates the rotation candidates using a pool of up to
+// concurrency workers, returning the first error encountered. Unless
+// ContinueOnError is set, no more rotations are started after a failure.
+func rotateBatch(rotationCandidates []rotationCandidate, c config.Config,
+	deferred *deferredDeletions, concurrency int) (accountResults []AccountResult, err error) {
+	continueOnError := c.ContinueOnError
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]*AccountResult, len(rotationCandidates))
+	workers := make(chan struct{}, concurrency)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i, rc := range rotationCandidates {
+		workers <- struct{}{}
+		mutex.Lock()
+		stop := err != nil && !continueOnError
+		mutex.Unlock()
+		if stop {
+			<-workers
+			break
+		}
+		wg.Add(1)
+		go func(i int, rc rotationCandidate) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			key := rc.key
+			logger.Infow("Rotation process started",
+				"keyProvider", key.Provider.Provider,
+				"account", key.FullAccount,
+				"keyID", obfuscate(key.ID),
+				"keyAge", fmt.Sprintf("%f", key.Age),
+				"keyAgeThreshold", strconv.Itoa(rc.rotationThresholdMins))
+
+			accountResult, rotateErr := rotateKey(rc, c, deferred)
+			if rotateErr != nil {
+				accountResult.Error = rotateErr.Error()
+				if continueOnError {
+					logger.Errorw("Rotation failed, continuing with remaining accounts",
+						"keyProvider", key.Provider.Provider,
+						"account", key.FullAccount,
+						"error", rotateErr)
+				}
+				mutex.Lock()
+				if err == nil {
+					err = rotateErr
+				}
+				mutex.Unlock()
+			}
+			results[i] = &accountResult
+		}(i, rc)
+	}
+	wg.Wait()
+	for _, accountResult := range results {
+		if accountResult != nil {
+			accountResults = append(accountResults, *accountResult)
+		}
+	}
+	return
+}
+
+// planRotations logs what rotateKeys would do for each rotation candidate,
+// i.e. which key would be replaced, why, and which locations would be written
+// to, without creating, writing or deleting anything
+func planRotations(rotationCandidates []rotationCandidate) (accountResults []AccountResult) {
 	for _, rc := range rotationCandidates {
 		key := rc.key
-		logger.Infow("Rotation process started",
+		logger.Infow("Rotation planned",
 			"keyProvider", key.Provider.Provider,
+			"project", key.Provider.GcpProject,
 			"account", key.FullAccount,
 			"keyID", obfuscate(key.ID),
 			"keyAge", fmt.Sprintf("%f", key.Age),
-			"keyAgeThreshold", strconv.Itoa(rc.rotationThresholdMins))
-
-		if err = rotateKey(rc, creds); err != nil {
-			return
-		}
+			"keyAgeThreshold", strconv.Itoa(rc.rotationThresholdMins),
+			"reason", rotationReason(rc),
+			"keyLocations", locationDescriptions(rc.keyLocation, key.Provider.Provider))
+		accountResults = append(accountResults, newAccountResult(key, StatusPlanned, rotationReason(rc)))
 	}
+	logger.Infof("Plan complete, %d keys would be rotated", len(rotationCandidates))
+	return
+}
 
+// locationDescriptions returns a description of each of the locations that
+// would be updated with a key from the provider, for the keyLocation supplied
+func locationDescriptions(keyLocation config.KeyLocations, provider string) (descriptions []string) {
+	kws, _ := keyWriters(keyLocation)
+	for _, locationToUpdate := range kws {
+		descriptions = append(descriptions, location.Describe(locationToUpdate, provider))
+	}
 	return
 }
 
-// rotatekeys runs through the end to end process of rotating a slice of keys:
-// filter down to subset of target keys, generate new key for each, update the
-// key's locations and finally delete the existing/old key
-func rotationCandidates(accountKeys []keys.Key, keyLoc []config.KeyLocations,
-	creds cred.Credentials, defaultRotationAgeThresholdMins int) (rotationCandidates []rotationCandidate, err error) {
+// rotationCandidates filters the keys down to those that are due to be
+// rotated, and whose schedules (with the blackouts of the freeze files
+// supplied) allow rotation now, returning a result for each key that's been
+// skipped. Unless ContinueOnError is set, a key with no locations (or an
+// invalid schedule) configured is an error.
+func rotationCandidates(accountKeys []keys.Key, c config.Config, frozen freezeFiles,
+	deferred *deferredDeletions, now time.Time) (rotationCandidates []rotationCandidate,
+	accountResults []AccountResult, err error) {
 	processedItems := make([]string, 0)
+	defaultRotationAgeThresholdMins := defaultRotationAgeThreshold(c)
+	var globalSchedule schedule
+	if globalSchedule, err = newSchedule(c.Schedule, frozen); err != nil {
+		return
+	}
 	for _, key := range accountKeys {
-		keyAccount := key.Account
 		var locations config.KeyLocations
 
-		if locations, err = accountKeyLocation(keyAccount, keyLoc); err != nil {
-			return
+		if deferred.pending(key) {
+			logger.Infof("Skipping SA: %s, key: %s as it's already been replaced and is awaiting deletion",
+				key.FullAccount, obfuscate(key.ID))
+			accountResults = append(accountResults, newAccountResult(key, StatusSkipped,
+				"key has already been replaced and is awaiting deletion"))
+			continue
 		}
 
 		if contains(processedItems, key.FullAccount) {
 			logger.Infof("Skipping SA: %s, key: %s as a key for this account has already been added as a candidate for rotation",
 				key.FullAccount, obfuscate(key.ID))
+			accountResults = append(accountResults, newAccountResult(key, StatusSkipped,
+				"another key for this account is already a candidate for rotation"))
+			continue
+		}
+
+		var locationSchedule schedule
+		if locations, err = accountKeyLocation(key, c.AccountKeyLocations); err == nil {
+			locationSchedule, err = newSchedule(locations.Schedule, frozen)
+		}
+		if err != nil {
+			if !c.ContinueOnError {
+				return
+			}
+			logger.Error(err)
+			accountResult := newAccountResult(key, StatusFailed, "")
+			accountResult.Error = err.Error()
+			accountResults = append(accountResults, accountResult)
+			err = nil
 			continue
 		}
 
@@ -224,12 +466,24 @@ func rotationCandidates(accountKeys []keys.Key, keyLoc []config.KeyLocations,
 		if float64(rotationThresholdMins) > key.Age {
 			logger.Infof("Skipping SA: %s, key: %s as it's only %f minutes old (threshold: %d mins)",
 				key.FullAccount, obfuscate(key.ID), key.Age, rotationThresholdMins)
+			accountResults = append(accountResults, newAccountResult(key, StatusSkipped,
+				fmt.Sprintf("key age of %.2f mins is within threshold of %d mins", key.Age, rotationThresholdMins)))
+			continue
+		}
+
+		if allowed, reason := scheduleAllows(now, globalSchedule, locationSchedule); !allowed {
+			logger.Infof("Skipping SA: %s, key: %s as it's outside the rotation window: %s",
+				key.FullAccount, obfuscate(key.ID), reason)
+			accountResults = append(accountResults, newAccountResult(key, StatusSkipped,
+				"outside window: "+reason))
 			continue
 		}
 
 		rotationCandidates = append(rotationCandidates, rotationCandidate{key: key,
 			keyLocation:           locations,
-			rotationThresholdMins: rotationThresholdMins})
+			rotationThresholdMins: rotationThresholdMins,
+			gracePeriodMins:       gracePeriod(locations, c),
+			self:                  isSelf(c, key)})
 		processedItems = append(processedItems, key.FullAccount)
 	}
 
@@ -238,6 +492,7 @@ func rotationCandidates(accountKeys []keys.Key, keyLoc []config.KeyLocations,
 
 // createKey creates a new key with the provider specified
 func createKey(key keys.Key, keyProvider string) (newKeyID, newKey string, err error) {
+	apiRateLimiter.wait(keyProvider)
 	if newKeyID, newKey, err = keys.CreateKey(key); err != nil {
 		logger.Error(err)
 		return
@@ -251,6 +506,7 @@ func createKey(key keys.Key, keyProvider string) (newKeyID, newKey string, err e
 
 // deletekey deletes the key
 func deleteKey(key keys.Key, keyProvider string) (err error) {
+	apiRateLimiter.wait(keyProvider)
 	if err = keys.DeleteKey(key); err != nil {
 		return
 	}
@@ -261,19 +517,46 @@ func deleteKey(key keys.Key, keyProvider string) (err error) {
 	return
 }
 
-// accountKeyLocation gets the keyLocation element defined in config for the
-// specified account
-func accountKeyLocation(account string,
-	keyLocations []config.KeyLocations) (accountKeyLocation config.KeyLocations, err error) {
-	err = errors.New("No account key locations (in config) mapped to SA: " + account)
-	for _, keyLocation := range keyLocations {
-		if account == keyLocation.ServiceAccountName {
-			err = nil
-			accountKeyLocation = keyLocation
-			break
-		}
+// discardNewKey deletes a newly created key that's no longer required, e.g.
+// after a failure to verify it or update its locations. Failures are logged rather than
+// returned, so as not to mask the error that caused the discard.
+func discardNewKey(key keys.Key, newKeyID, keyProvider string) {
+	newKey := key
+	newKey.ID = newKeyID
+	apiRateLimiter.wait(keyProvider)
+	if err := keys.DeleteKey(newKey); err != nil {
+		logger.Errorw("Failed to delete new key, it will need deleting manually",
+			"keyProvider", keyProvider,
+			"account", key.FullAccount,
+			"keyID", obfuscate(newKeyID),
+			"error", err)
+		return
 	}
-	return
+	logger.Infow("New key deleted",
+		"keyProvider", keyProvider,
+		"account", key.FullAccount,
+		"keyID", obfuscate(newKeyID))
+}
+
+// discardUnheldNewKey handles the new key after a failure to update its
+// locations. If they've all been rolled back to the old key, the new key would
+// otherwise be orphaned, so it's discarded. Locations that couldn't be rolled
+// back still hold the new key though, so in that case it's kept (along with
+// the old key), and the error returned names those locations.
+func discardUnheldNewKey(key keys.Key, newKeyID, keyProvider string,
+	unrestoredLocations []string, updateErr error) error {
+	if len(unrestoredLocations) == 0 {
+		discardNewKey(key, newKeyID, keyProvider)
+		return updateErr
+	}
+	logger.Errorw("New key kept, as locations that couldn't be rolled back hold it",
+		"keyProvider", keyProvider,
+		"account", key.FullAccount,
+		"keyID", obfuscate(newKeyID),
+		"unrestoredLocations", unrestoredLocations)
+	return fmt.Errorf("%w (new key: %s has been kept along with the old key, as it's held by "+
+		"locations that couldn't be rolled back: %s)", updateErr, obfuscate(newKeyID),
+		strings.Join(unrestoredLocations, ", "))
 }
 
 // InLambda returns true if the AWS_LAMBDA_FUNCTION_NAME env var is set
@@ -285,6 +568,8 @@ func InLambda() (isLambda bool) {
 // The key could be used for various purposes, e.g. rotating a service account's key, writing
 // a new key to GCS, or writing a new key to a Secret in GKE.
 func ensureGoogleAppCreds() (err error) {
+	googleAppCredsMutex.Lock()
+	defer googleAppCredsMutex.Unlock()
 	if InLambda() && !provisionedGoogleAppCreds {
 		var secretValue string
 		if secretValue, err = config.GetSecret("ckr-gcp-key"); err != nil {
@@ -302,8 +587,17 @@ func ensureGoogleAppCreds() (err error) {
 // locationsToUpdate return a slice of structs that implement the keyWriter
 // interface, based on the keyLocations supplied
 func locationsToUpdate(keyLocation config.KeyLocations) (kws []location.KeyWriter) {
-
 	var googleAppCredsRequired bool
+	if kws, googleAppCredsRequired = keyWriters(keyLocation); googleAppCredsRequired {
+		ensureGoogleAppCreds()
+	}
+	return
+}
+
+// keyWriters returns the keyWriters for the keyLocations supplied, and
+// whether any of them require Google application credentials
+func keyWriters(keyLocation config.KeyLocations) (kws []location.KeyWriter,
+	googleAppCredsRequired bool) {
 
 	// read locations
 	for _, atlas := range keyLocation.Atlas {
@@ -327,6 +621,11 @@ func locationsToUpdate(keyLocation config.KeyLocations) (kws []location.KeyWrite
 		googleAppCredsRequired = true
 	}
 
+	for _, gcpSecretManager := range keyLocation.GcpSecretManager {
+		kws = append(kws, gcpSecretManager)
+		googleAppCredsRequired = true
+	}
+
 	if len(keyLocation.Git.OrgRepo) > 0 {
 		kws = append(kws, keyLocation.Git)
 	}
@@ -341,7 +640,9 @@ func locationsToUpdate(keyLocation config.KeyLocations) (kws []location.KeyWrite
 
 	for _, k8s := range keyLocation.K8s {
 		kws = append(kws, k8s)
-		googleAppCredsRequired = true
+		if k8s.InGKE() {
+			googleAppCredsRequired = true
+		}
 	}
 
 	for _, ssm := range keyLocation.SSM {
@@ -352,8 +653,8 @@ func locationsToUpdate(keyLocation config.KeyLocations) (kws []location.KeyWrite
 		kws = append(kws, secretsmanager)
 	}
 
-	if googleAppCredsRequired {
-		ensureGoogleAppCreds()
+	for _, vault := range keyLocation.Vault {
+		kws = append(kws, vault)
 	}
 
 	return
@@ -361,29 +662,108 @@ func locationsToUpdate(keyLocation config.KeyLocations) (kws []location.KeyWrite
 
 // updateKeyLocation updates locations specified in keyLocations with the new key, e.g. Git, CircleCI and K8s
 func updateKeyLocation(account string, keyLocations config.KeyLocations,
-	keyWrapper location.KeyWrapper, creds cred.Credentials) (err error) {
+	keyWrapper location.KeyWrapper, creds cred.Credentials) (updatedLocations []location.UpdatedLocation,
+	unrestoredLocations []string, err error) {
 
 	// update locations
-	var updatedLocations []location.UpdatedLocation
+	if updatedLocations, unrestoredLocations, err = writeLocations(keyLocations.ServiceAccountName,
+		locationsToUpdate(keyLocations), keyWrapper, creds); err != nil {
+		return
+	}
+
+	// all done
+	logger.Infow("Key locations updated",
+		"keyProvider", keyWrapper.KeyProvider,
+		"account", account,
+		"keyID", obfuscate(keyWrapper.KeyID),
+		"keyLocationUpdates", updatedLocations)
+
+	return
+}
+
+// writeLocations writes the new key to each location in turn, resolving the
+// secret references in the credentials it uses first. If that, or any read or
+// write, fails, the locations already written to (including the one that
+// failed, if it can be restored, as it may have been partially written to)
+// are rolled back, and those that couldn't be rolled back are returned
+func writeLocations(serviceAccountName string, keyWriters []location.KeyWriter,
+	keyWrapper location.KeyWrapper, creds cred.Credentials) (updatedLocations []location.UpdatedLocation,
+	unrestoredLocations []string, err error) {
+
+	var writtenLocations []writtenLocation
+
+	for _, keyWriter := range keyWriters {
+
+		written := writtenLocation{keyWriter: keyWriter}
+
+		if written.creds, err = locationCredentials(keyWriter, creds); err != nil {
+			unrestoredLocations = rollbackLocations(serviceAccountName, keyWrapper.KeyProvider,
+				writtenLocations)
+			return
+		}
 
-	for _, locationToUpdate := range locationsToUpdate(keyLocations) {
+		restorer, restorable := keyWriter.(location.KeyRestorer)
+		if restorable {
+			if written.snapshot, err = restorer.Read(serviceAccountName,
+				keyWrapper.KeyProvider, written.creds); err != nil {
+				unrestoredLocations = rollbackLocations(serviceAccountName, keyWrapper.KeyProvider,
+					writtenLocations)
+				return
+			}
+			// a failed write may have partially updated the location, which
+			// restoring undoes
+			writtenLocations = append(writtenLocations, written)
+		}
 
 		var updated location.UpdatedLocation
 
-		if updated, err = locationToUpdate.Write(keyLocations.ServiceAccountName, keyWrapper, creds); err != nil {
+		if updated, err = keyWriter.Write(serviceAccountName, keyWrapper, written.creds); err != nil {
+			unrestoredLocations = rollbackLocations(serviceAccountName, keyWrapper.KeyProvider,
+				writtenLocations)
 			return
 		}
 
+		if !restorable {
+			// a location that can't be restored is only counted as holding
+			// the new key once it's been written to, so that a location
+			// whose write fails outright doesn't keep the new key alive
+			writtenLocations = append(writtenLocations, written)
+		}
 		updatedLocations = append(updatedLocations, updated)
 	}
 
-	// all done
-	logger.Infow("Key locations updated",
-		"keyProvider", keyWrapper.KeyProvider,
-		"account", account,
-		"keyID", obfuscate(keyWrapper.KeyID),
-		"keyLocationUpdates", updatedLocations)
+	return
+}
 
+// rollbackLocations restores written locations, in reverse order, to the
+// values they held before being written to. Locations that can't be rolled
+// back are logged and returned, as they'll need to be fixed manually.
+func rollbackLocations(serviceAccountName, keyProvider string,
+	writtenLocations []writtenLocation) (unrestoredLocations []string) {
+	for i := len(writtenLocations) - 1; i >= 0; i-- {
+		keyWriter := writtenLocations[i].keyWriter
+		locationType := location.Describe(keyWriter, keyProvider)
+		restorer, ok := keyWriter.(location.KeyRestorer)
+		if !ok {
+			logger.Errorw("Unable to roll back location, it may need fixing manually",
+				"account", serviceAccountName,
+				"keyLocation", locationType)
+			unrestoredLocations = append(unrestoredLocations, locationType)
+			continue
+		}
+		if err := restorer.Restore(serviceAccountName, keyProvider,
+			writtenLocations[i].snapshot, writtenLocations[i].creds); err != nil {
+			logger.Errorw("Failed to roll back location, it may need fixing manually",
+				"account", serviceAccountName,
+				"keyLocation", locationType,
+				"error", err)
+			unrestoredLocations = append(unrestoredLocations, locationType)
+			continue
+		}
+		logger.Infow("Location rolled back",
+			"account", serviceAccountName,
+			"keyLocation", locationType)
+	}
 	return
 }
 
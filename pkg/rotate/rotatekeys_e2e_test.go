@@ -1,16 +1,33 @@
 package rotate
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	keys "github.com/ovotech/cloud-key-client"
 	"github.com/ovotech/cloud-key-rotator/pkg/config"
+	"github.com/ovotech/cloud-key-rotator/pkg/cred"
+	"github.com/ovotech/cloud-key-rotator/pkg/location"
+	"github.com/ovotech/cloud-key-rotator/pkg/lock"
+	"github.com/ovotech/cloud-key-rotator/pkg/state"
+	"google.golang.org/api/googleapi"
 )
 
 // MockProvider configuration, which keys library uses instead of AWS, GCP, etc. when accessing service account keys
 type MockProvider struct {
-	created bool
-	deleted bool
+	created       bool
+	deleted       bool
+	deletedKeyIDs []string
+	createErr     error
+	deleteErr     error
 }
 
 func (m *MockProvider) Keys(project string, includeInactiveKeys bool, token string) (keysArr []keys.Key, err error) {
@@ -22,11 +39,15 @@ func (m *MockProvider) Keys(project string, includeInactiveKeys bool, token stri
 
 func (m *MockProvider) CreateKey(project, account, token string) (keyID, newKey string, err error) {
 	m.created = true
+	keyID = "efgh5678"
+	err = m.createErr
 	return
 }
 
 func (m *MockProvider) DeleteKey(project, account, keyID, token string) (err error) {
 	m.deleted = true
+	m.deletedKeyIDs = append(m.deletedKeyIDs, keyID)
+	err = m.deleteErr
 	return
 }
 
@@ -40,7 +61,7 @@ func TestMetricsOnly(t *testing.T) {
 	keys.RegisterProvider("mockProvider", &m)
 
 	var locations config.KeyLocations = config.KeyLocations{RotationAgeThresholdMins: shortRotationPeriod, ServiceAccountName: "account1"}
-	err := Rotate("account1", "mockProvider", "project1", config.Config{RotationMode: false, EnableKeyAgeLogging: true,
+	_, err := Rotate("account1", "mockProvider", "project1", config.Config{RotationMode: false, EnableKeyAgeLogging: true,
 		AccountKeyLocations: []config.KeyLocations{locations}})
 
 	if err != nil {
@@ -58,7 +79,7 @@ func TestRotateWithinThreshold(t *testing.T) {
 	keys.RegisterProvider("mockProvider", &m)
 
 	var locations config.KeyLocations = config.KeyLocations{RotationAgeThresholdMins: longRotationPeriod, ServiceAccountName: "account1"}
-	err := Rotate("account1", "mockProvider", "project1", config.Config{RotationMode: true,
+	_, err := Rotate("account1", "mockProvider", "project1", config.Config{RotationMode: true,
 		AccountKeyLocations: []config.KeyLocations{locations}})
 
 	if err != nil {
@@ -76,7 +97,7 @@ func TestRotateOutsideThreshold(t *testing.T) {
 	keys.RegisterProvider("mockProvider", &m)
 
 	var locations config.KeyLocations = config.KeyLocations{RotationAgeThresholdMins: shortRotationPeriod, ServiceAccountName: "account1"}
-	err := Rotate("account1", "mockProvider", "project1", config.Config{RotationMode: true,
+	result, err := Rotate("account1", "mockProvider", "project1", config.Config{RotationMode: true,
 		AccountKeyLocations: []config.KeyLocations{locations}})
 
 	if err != nil {
@@ -86,4 +107,466 @@ func TestRotateOutsideThreshold(t *testing.T) {
 	if !m.created || !m.deleted {
 		t.Error("Key should have been created and deleted, as age outside threshold")
 	}
+
+	if result.Summary()[StatusRotated] != 1 {
+		t.Errorf("Expected 1 rotated account, got result: %v", result)
+	}
+}
+
+func TestRotateContinueOnError(t *testing.T) {
+
+	m := MockProvider{createErr: errors.New("create failed")}
+	keys.RegisterProvider("mockProvider", &m)
+
+	var locations config.KeyLocations = config.KeyLocations{RotationAgeThresholdMins: shortRotationPeriod, ServiceAccountName: "account1"}
+	result, err := Rotate("account1", "mockProvider", "project1", config.Config{RotationMode: true,
+		ContinueOnError: true, AccountKeyLocations: []config.KeyLocations{locations}})
+
+	if err == nil {
+		t.Error("Expected error, got nil")
+	}
+
+	if m.deleted {
+		t.Error("Key should not have been deleted, as key creation failed")
+	}
+
+	if !result.Failed() || result.Accounts[0].Error != "create failed" {
+		t.Errorf("Expected failed account with error, got result: %v", result)
+	}
+}
+
+func TestRotateContinueOnErrorNoKeyLocation(t *testing.T) {
+
+	var m MockProvider
+	keys.RegisterProvider("mockProvider", &m)
+
+	// account1 has no key location, so fails before any rotation is attempted
+	var locations config.KeyLocations = config.KeyLocations{RotationAgeThresholdMins: shortRotationPeriod, ServiceAccountName: "account2"}
+	result, err := Rotate("account1", "mockProvider", "project1", config.Config{RotationMode: true,
+		ContinueOnError: true, AccountKeyLocations: []config.KeyLocations{locations}})
+
+	if err == nil || !strings.HasPrefix(err.Error(), "1 accounts failed") {
+		t.Errorf("Expected error summarising the failed account, got: %v", err)
+	}
+
+	if m.created || m.deleted {
+		t.Error("Key should not have been created or deleted, as it has no key location")
+	}
+
+	if !result.Failed() {
+		t.Errorf("Expected failed account, got result: %v", result)
+	}
+}
+
+func TestPlanOutsideThreshold(t *testing.T) {
+
+	var m MockProvider
+	keys.RegisterProvider("mockProvider", &m)
+
+	var locations config.KeyLocations = config.KeyLocations{RotationAgeThresholdMins: shortRotationPeriod, ServiceAccountName: "account1"}
+	_, err := Rotate("account1", "mockProvider", "project1", config.Config{Plan: true,
+		AccountKeyLocations: []config.KeyLocations{locations}})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if m.created || m.deleted {
+		t.Error("Key should not have been created or deleted, as in plan mode")
+	}
+}
+
+// OrderedMockProvider records the order in which accounts' keys are deleted
+type OrderedMockProvider struct {
+	mutex   sync.Mutex
+	deleted []string
+}
+
+func (m *OrderedMockProvider) Keys(project string, includeInactiveKeys bool, token string) (keysArr []keys.Key, err error) {
+	return
+}
+
+func (m *OrderedMockProvider) CreateKey(project, account, token string) (keyID, newKey string, err error) {
+	time.Sleep(10 * time.Millisecond)
+	return
+}
+
+func (m *OrderedMockProvider) DeleteKey(project, account, keyID, token string) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.deleted = append(m.deleted, account)
+	return
+}
+
+func TestRotateKeysConcurrentlySelfLast(t *testing.T) {
+
+	var m OrderedMockProvider
+	keys.RegisterProvider("orderedMockProvider", &m)
+
+	var rcs []rotationCandidate
+	for _, account := range []string{"self", "a", "b", "c", "d", "e"} {
+		rcs = append(rcs, rotationCandidate{
+			key: keys.Key{FullAccount: account, ID: account,
+				Provider: keys.Provider{Provider: "orderedMockProvider"}},
+			self: account == "self"})
+	}
+	result, err := rotateKeys(rcs, config.Config{Concurrency: 3}, nil)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(result) != len(rcs) || len(m.deleted) != len(rcs) {
+		t.Errorf("Expected %d rotations, got: %v", len(rcs), m.deleted)
+	}
+
+	if m.deleted[len(m.deleted)-1] != "self" {
+		t.Errorf("Expected self key to be rotated last, got: %v", m.deleted)
+	}
+}
+
+// BlockingMockProvider blocks each CreateKey call until inFlight calls are in
+// progress at the same time, so a test only passes if that many keys are
+// rotated concurrently. A call fails if the others don't arrive in time.
+type BlockingMockProvider struct {
+	mutex       sync.Mutex
+	inFlight    int
+	current     int
+	maxInFlight int
+	ready       chan struct{}
+	released    bool
+}
+
+func (m *BlockingMockProvider) Keys(project string, includeInactiveKeys bool, token string) (keysArr []keys.Key, err error) {
+	return
+}
+
+func (m *BlockingMockProvider) CreateKey(project, account, token string) (keyID, newKey string, err error) {
+	m.mutex.Lock()
+	m.current++
+	if m.current > m.maxInFlight {
+		m.maxInFlight = m.current
+	}
+	if m.current == m.inFlight && !m.released {
+		close(m.ready)
+		m.released = true
+	}
+	m.mutex.Unlock()
+	select {
+	case <-m.ready:
+	case <-time.After(5 * time.Second):
+		err = fmt.Errorf("Timed out waiting for %d CreateKey calls to be in flight", m.inFlight)
+	}
+	m.mutex.Lock()
+	m.current--
+	m.mutex.Unlock()
+	return
+}
+
+func (m *BlockingMockProvider) DeleteKey(project, account, keyID, token string) (err error) {
+	return
+}
+
+func TestRotateKeysConcurrently(t *testing.T) {
+	m := BlockingMockProvider{inFlight: 3, ready: make(chan struct{})}
+	keys.RegisterProvider("blockingMockProvider", &m)
+
+	var rcs []rotationCandidate
+	for _, account := range []string{"a", "b", "c", "d", "e"} {
+		rcs = append(rcs, rotationCandidate{
+			key: keys.Key{FullAccount: account, ID: account,
+				Provider: keys.Provider{Provider: "blockingMockProvider"}}})
+	}
+	result, err := rotateKeys(rcs, config.Config{Concurrency: 3}, nil)
+
+	if err != nil {
+		t.Error(err)
+	}
+	if len(result) != len(rcs) {
+		t.Errorf("Expected %d rotations, got: %v", len(rcs), result)
+	}
+	if m.maxInFlight != 3 {
+		t.Errorf("Expected 3 keys to be rotated at once, got: %d", m.maxInFlight)
+	}
+}
+
+func TestRotateWithGracePeriod(t *testing.T) {
+
+	var m MockProvider
+	keys.RegisterProvider("mockProvider", &m)
+
+	stateStore := "file://" + filepath.Join(t.TempDir(), "state.json")
+	var locations config.KeyLocations = config.KeyLocations{RotationAgeThresholdMins: shortRotationPeriod, ServiceAccountName: "account1"}
+	c := config.Config{RotationMode: true, GracePeriodMins: 60, StateStore: stateStore,
+		AccountKeyLocations: []config.KeyLocations{locations}}
+
+	if _, err := Rotate("account1", "mockProvider", "project1", c); err != nil {
+		t.Error(err)
+	}
+
+	if !m.created || m.deleted {
+		t.Error("Key should have been created but not deleted, as within grace period")
+	}
+
+	// the old key is now pending deletion, so shouldn't be rotated again
+	m = MockProvider{}
+	if _, err := Rotate("account1", "mockProvider", "project1", c); err != nil {
+		t.Error(err)
+	}
+
+	if m.created || m.deleted {
+		t.Error("Key should not have been created or deleted, as already pending deletion")
+	}
+
+	// once the grace period has passed, the old key is deleted
+	store, _ := state.NewStore(stateStore)
+	s, _ := store.Load()
+	s.PendingDeletions[0].DeleteAfter = time.Now().Add(-time.Minute)
+	store.Save(s)
+	result, err := Rotate("account1", "mockProvider", "project1", c)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !m.deleted || result.Summary()[StatusDeleted] != 1 {
+		t.Errorf("Key should have been deleted, as grace period has passed, got result: %v", result)
+	}
+
+	if s, _ = store.Load(); len(s.PendingDeletions) != 0 {
+		t.Errorf("Expected no keys pending deletion, got: %v", s.PendingDeletions)
+	}
+}
+
+func TestRotateRunLock(t *testing.T) {
+
+	var m MockProvider
+	keys.RegisterProvider("mockProvider", &m)
+
+	lockURI := "file://" + filepath.Join(t.TempDir(), "ckr.lock")
+	heldLock, err := lock.NewLock(lockURI, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = heldLock.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+
+	var locations config.KeyLocations = config.KeyLocations{RotationAgeThresholdMins: shortRotationPeriod, ServiceAccountName: "account1"}
+	c := config.Config{RotationMode: true, RunLock: lockURI, AccountKeyLocations: []config.KeyLocations{locations}}
+	_, err = Rotate("account1", "mockProvider", "project1", c)
+	var heldErr lock.HeldError
+	if !errors.As(err, &heldErr) {
+		t.Errorf("Expected rotation to be refused while the run lock is held, got: %v", err)
+	}
+	if m.created || m.deleted {
+		t.Error("Key should not have been created or deleted, as run lock is held")
+	}
+
+	if err = heldLock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Rotate("account1", "mockProvider", "project1", c); err != nil {
+		t.Error(err)
+	}
+	if !m.created || !m.deleted {
+		t.Error("Key should have been created and deleted, once run lock was released")
+	}
+	if err = heldLock.Acquire(); err != nil {
+		t.Errorf("Expected run lock to have been released by rotation, got: %v", err)
+	}
+}
+
+// fakeCircleCITransport answers CircleCI env var requests as if they'd
+// succeeded (unless circleCIDown is set), and fails every other request
+type fakeCircleCITransport struct {
+	circleCIDown bool
+}
+
+func (f fakeCircleCITransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	status, body := http.StatusInternalServerError, `{"errors": ["unavailable"]}`
+	if req.URL.Host == "circleci.com" && !f.circleCIDown {
+		status, body = http.StatusOK, `{"name": "KEY"}`
+		if req.Method == http.MethodGet {
+			body = `[{"name": "KEY_ID"}, {"name": "KEY"}]`
+		}
+	}
+	return &http.Response{StatusCode: status, Header: http.Header{"Content-Type": {"application/json"}},
+		Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+}
+
+func TestRotateKeepsNewKeyHeldByUnrestoredLocation(t *testing.T) {
+
+	var m MockProvider
+	keys.RegisterProvider("mockProvider", &m)
+
+	transport := http.DefaultTransport
+	http.DefaultTransport = fakeCircleCITransport{}
+	t.Cleanup(func() { http.DefaultTransport = transport })
+
+	// CircleCI is written to successfully but can't be rolled back, once the
+	// write to Vault fails
+	var locations config.KeyLocations = config.KeyLocations{RotationAgeThresholdMins: shortRotationPeriod,
+		ServiceAccountName: "account1",
+		CircleCI: []location.CircleCI{{UsernameProject: "ovotech/my-repo", KeyIDEnvVar: "KEY_ID",
+			KeyEnvVar: "KEY"}},
+		Vault: []location.Vault{{Address: "https://vault.example.com", Path: "team-a/key",
+			KeyField: "KEY", KeyIDField: "KEY_ID"}},
+	}
+	result, err := Rotate("account1", "mockProvider", "project1", config.Config{RotationMode: true,
+		AccountKeyLocations: []config.KeyLocations{locations},
+		Credentials:         cred.Credentials{CircleCIAPIToken: "token", VaultAuth: cred.VaultAuth{Token: "token"}}})
+
+	if err == nil || !strings.Contains(err.Error(), "has been kept") {
+		t.Errorf("Expected error saying new key has been kept, got: %v", err)
+	}
+
+	if !m.created || m.deleted {
+		t.Errorf("New key should have been created and neither key deleted, got deletions: %v", m.deletedKeyIDs)
+	}
+
+	expectedUnrestored := []string{"CircleCI (ovotech/my-repo)"}
+	if !result.Failed() || !reflect.DeepEqual(result.Accounts[0].UnrestoredLocations, expectedUnrestored) {
+		t.Errorf("Expected failed account with unrestored locations: %v, got result: %+v",
+			expectedUnrestored, result)
+	}
+}
+
+func TestRotateDiscardsNewKeyNotWritten(t *testing.T) {
+
+	var m MockProvider
+	keys.RegisterProvider("mockProvider", &m)
+
+	transport := http.DefaultTransport
+	http.DefaultTransport = fakeCircleCITransport{circleCIDown: true}
+	t.Cleanup(func() { http.DefaultTransport = transport })
+
+	// CircleCI can't be rolled back, but its write fails, so it doesn't hold
+	// the new key
+	var locations config.KeyLocations = config.KeyLocations{RotationAgeThresholdMins: shortRotationPeriod,
+		ServiceAccountName: "account1",
+		CircleCI: []location.CircleCI{{UsernameProject: "ovotech/my-repo", KeyIDEnvVar: "KEY_ID",
+			KeyEnvVar: "KEY"}},
+	}
+	result, err := Rotate("account1", "mockProvider", "project1", config.Config{RotationMode: true,
+		AccountKeyLocations: []config.KeyLocations{locations},
+		Credentials:         cred.Credentials{CircleCIAPIToken: "token"}})
+
+	if err == nil || strings.Contains(err.Error(), "has been kept") {
+		t.Errorf("Expected error without the new key being kept, got: %v", err)
+	}
+
+	if !reflect.DeepEqual(m.deletedKeyIDs, []string{"efgh5678"}) {
+		t.Errorf("Only the new key should have been deleted, got deletions: %v", m.deletedKeyIDs)
+	}
+
+	if !result.Failed() || len(result.Accounts[0].UnrestoredLocations) > 0 {
+		t.Errorf("Expected failed account without unrestored locations, got result: %+v", result)
+	}
+}
+
+// pendingDeletionState returns the URI of a state store holding the pending
+// deletions supplied
+func pendingDeletionState(t *testing.T, pendingDeletions ...state.PendingDeletion) string {
+	stateStore := "file://" + filepath.Join(t.TempDir(), "state.json")
+	store, err := state.NewStore(stateStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Save(state.State{PendingDeletions: pendingDeletions}); err != nil {
+		t.Fatal(err)
+	}
+	return stateStore
+}
+
+func TestRotateGracePeriodScope(t *testing.T) {
+
+	var m MockProvider
+	keys.RegisterProvider("mockProvider", &m)
+
+	due := time.Now().Add(-time.Minute)
+	stateStore := pendingDeletionState(t,
+		state.PendingDeletion{Provider: "mockProvider", KeyID: "old1", DeleteAfter: due},
+		state.PendingDeletion{Provider: "mockProvider", Account: "account2@example.com", KeyID: "old2",
+			DeleteAfter: due},
+	)
+	var locations config.KeyLocations = config.KeyLocations{RotationAgeThresholdMins: longRotationPeriod, ServiceAccountName: "account1"}
+	c := config.Config{RotationMode: true, GracePeriodMins: 60, StateStore: stateStore,
+		AccountKeyLocations: []config.KeyLocations{locations}}
+
+	if _, err := Rotate("account1", "mockProvider", "project1", c); err != nil {
+		t.Error(err)
+	}
+
+	// only account1 is within the scope of the run, so account2's old key
+	// must be left alone
+	if !reflect.DeepEqual(m.deletedKeyIDs, []string{"old1"}) {
+		t.Errorf("Expected only account1's old key to be deleted, got: %v", m.deletedKeyIDs)
+	}
+	store, _ := state.NewStore(stateStore)
+	if s, _ := store.Load(); len(s.PendingDeletions) != 1 || s.PendingDeletions[0].KeyID != "old2" {
+		t.Errorf("Expected account2's old key to still be pending deletion, got: %v", s.PendingDeletions)
+	}
+}
+
+func TestRotateGracePeriodKeyAlreadyDeleted(t *testing.T) {
+
+	m := MockProvider{deleteErr: &googleapi.Error{Code: http.StatusNotFound, Message: "key not found"}}
+	keys.RegisterProvider("mockProvider", &m)
+
+	stateStore := pendingDeletionState(t,
+		state.PendingDeletion{Provider: "mockProvider", KeyID: "old1", DeleteAfter: time.Now().Add(-time.Minute)})
+	var locations config.KeyLocations = config.KeyLocations{RotationAgeThresholdMins: longRotationPeriod, ServiceAccountName: "account1"}
+	c := config.Config{RotationMode: true, GracePeriodMins: 60, StateStore: stateStore,
+		AccountKeyLocations: []config.KeyLocations{locations}}
+
+	result, err := Rotate("account1", "mockProvider", "project1", c)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if result.Summary()[StatusDeleted] != 1 {
+		t.Errorf("Expected already deleted key to be reported as deleted, got result: %v", result)
+	}
+	store, _ := state.NewStore(stateStore)
+	if s, _ := store.Load(); len(s.PendingDeletions) != 0 {
+		t.Errorf("Expected no keys pending deletion, got: %v", s.PendingDeletions)
+	}
+}
+
+var rotateGracePeriodErrorTests = []struct {
+	deleteErr            error
+	serviceAccountName   string
+	expectedErr          string
+	unexpectedErr        string
+	expectedStillPending int
+}{
+	// the old key can't be deleted
+	{errors.New("delete failed"), "account1", "Failed to delete 1 old keys", "accounts failed", 1},
+	// account1 has no key location, which isn't a failure to delete old keys
+	{nil, "account2", "1 accounts failed", "Failed to delete", 1},
+}
+
+func TestRotateGracePeriodErrors(t *testing.T) {
+	for _, test := range rotateGracePeriodErrorTests {
+		m := MockProvider{deleteErr: test.deleteErr}
+		keys.RegisterProvider("mockProvider", &m)
+
+		stateStore := pendingDeletionState(t,
+			state.PendingDeletion{Provider: "mockProvider", KeyID: "old1", DeleteAfter: time.Now().Add(-time.Minute)})
+		var locations config.KeyLocations = config.KeyLocations{RotationAgeThresholdMins: longRotationPeriod,
+			ServiceAccountName: test.serviceAccountName}
+		c := config.Config{RotationMode: true, ContinueOnError: true, GracePeriodMins: 60,
+			StateStore: stateStore, AccountKeyLocations: []config.KeyLocations{locations}}
+
+		_, err := Rotate("account1", "mockProvider", "project1", c)
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) ||
+			strings.Contains(err.Error(), test.unexpectedErr) {
+			t.Errorf("Expected error containing %q and not %q, got: %v", test.expectedErr, test.unexpectedErr, err)
+		}
+		store, _ := state.NewStore(stateStore)
+		if s, _ := store.Load(); len(s.PendingDeletions) != test.expectedStillPending {
+			t.Errorf("Expected %d keys pending deletion, got: %v", test.expectedStillPending, s.PendingDeletions)
+		}
+	}
 }
@@ -15,10 +15,14 @@
 package rotate
 
 import (
+	"errors"
+	"reflect"
 	"testing"
 
 	keys "github.com/ovotech/cloud-key-client"
 	"github.com/ovotech/cloud-key-rotator/pkg/config"
+	"github.com/ovotech/cloud-key-rotator/pkg/cred"
+	"github.com/ovotech/cloud-key-rotator/pkg/location"
 )
 
 var includeFilterTests = []struct {
@@ -276,3 +280,121 @@ func TestObfuscate(t *testing.T) {
 		}
 	}
 }
+
+// mockKeyWriter records the calls made to it in the shared calls slice
+type mockKeyWriter struct {
+	name     string
+	writeErr error
+	calls    *[]string
+}
+
+func (m mockKeyWriter) Write(serviceAccountName string, keyWrapper location.KeyWrapper,
+	creds cred.Credentials) (location.UpdatedLocation, error) {
+	*m.calls = append(*m.calls, "write "+m.name)
+	return location.UpdatedLocation{LocationType: m.name}, m.writeErr
+}
+
+type mockKeyRestorer struct {
+	mockKeyWriter
+}
+
+func (m mockKeyRestorer) Read(serviceAccountName, keyProvider string,
+	creds cred.Credentials) (location.Snapshot, error) {
+	*m.calls = append(*m.calls, "read "+m.name)
+	return location.Snapshot{}, nil
+}
+
+func (m mockKeyRestorer) Restore(serviceAccountName, keyProvider string,
+	snapshot location.Snapshot, creds cred.Credentials) error {
+	*m.calls = append(*m.calls, "restore "+m.name)
+	return nil
+}
+
+func TestWriteLocationsSuccess(t *testing.T) {
+	var calls []string
+	keyWriters := []location.KeyWriter{
+		mockKeyRestorer{mockKeyWriter{name: "a", calls: &calls}},
+		mockKeyWriter{name: "b", calls: &calls},
+	}
+	updated, _, err := writeLocations("sa", keyWriters, location.KeyWrapper{}, cred.Credentials{})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(updated) != 2 {
+		t.Errorf("Incorrect number of updated locations, want: 2, got: %d", len(updated))
+	}
+	expected := []string{"read a", "write a", "write b"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Incorrect calls made, want: %v, got: %v", expected, calls)
+	}
+}
+
+func TestWriteLocationsRollback(t *testing.T) {
+	var calls []string
+	keyWriters := []location.KeyWriter{
+		mockKeyRestorer{mockKeyWriter{name: "a", calls: &calls}},
+		mockKeyWriter{name: "b", calls: &calls},
+		mockKeyRestorer{mockKeyWriter{name: "c", calls: &calls, writeErr: errors.New("write failed")}},
+		mockKeyWriter{name: "d", calls: &calls},
+	}
+	_, unrestored, err := writeLocations("sa", keyWriters, location.KeyWrapper{}, cred.Credentials{})
+	if err == nil {
+		t.Error("Expected error, got nil")
+	}
+	expected := []string{"read a", "write a", "write b", "read c", "write c", "restore c", "restore a"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Incorrect calls made, want: %v, got: %v", expected, calls)
+	}
+	expectedUnrestored := []string{"rotate.mockKeyWriter"}
+	if !reflect.DeepEqual(unrestored, expectedUnrestored) {
+		t.Errorf("Incorrect unrestored locations, want: %v, got: %v", expectedUnrestored, unrestored)
+	}
+}
+
+// mockKeyVerifier fails verification until it's been called more than
+// failures times
+type mockKeyVerifier struct {
+	failures int
+	calls    *int
+}
+
+func (m mockKeyVerifier) Verify(key keys.Key, newKeyID, newKey string) error {
+	*m.calls++
+	if *m.calls <= m.failures {
+		return errors.New("key not usable yet")
+	}
+	return nil
+}
+
+var verifyNewKeyTests = []struct {
+	failures          int
+	shouldError       bool
+	expectedDeletions []string
+}{
+	{0, false, []string{"abcd1234"}},
+	{1, false, []string{"abcd1234"}},
+	{1000, true, []string{"efgh5678"}},
+}
+
+func TestRotateVerifyNewKey(t *testing.T) {
+	for _, verifyNewKeyTest := range verifyNewKeyTests {
+		var m MockProvider
+		keys.RegisterProvider("mockProvider", &m)
+		var calls int
+		keyVerifiers["mockProvider"] = mockKeyVerifier{failures: verifyNewKeyTest.failures, calls: &calls}
+
+		locations := config.KeyLocations{RotationAgeThresholdMins: shortRotationPeriod, ServiceAccountName: "account1"}
+		_, err := Rotate("account1", "mockProvider", "project1", config.Config{RotationMode: true,
+			VerifyNewKeys: true, VerifyNewKeyTimeoutSecs: 1,
+			AccountKeyLocations: []config.KeyLocations{locations}})
+
+		if actual := err != nil; actual != verifyNewKeyTest.shouldError {
+			t.Errorf("Incorrect error behaviour encountered: %v", err)
+		}
+		if !reflect.DeepEqual(m.deletedKeyIDs, verifyNewKeyTest.expectedDeletions) {
+			t.Errorf("Incorrect keys deleted, want: %v, got: %v",
+				verifyNewKeyTest.expectedDeletions, m.deletedKeyIDs)
+		}
+	}
+	delete(keyVerifiers, "mockProvider")
+}
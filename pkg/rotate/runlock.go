@@ -0,0 +1,55 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotate
+
+import (
+	"time"
+
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+	"github.com/ovotech/cloud-key-rotator/pkg/lock"
+)
+
+// defaultRunLockTTLMins is how long a run lock is held for, if not configured
+const defaultRunLockTTLMins = 60
+
+// acquireRunLock takes the run lock configured, so that overlapping runs
+// (e.g. a retried Lambda invocation) can't rotate the same keys. The function
+// returned releases it. Nothing is locked if no RunLock is configured.
+func acquireRunLock(c config.Config) (release func(), err error) {
+	release = func() {}
+	if len(c.RunLock) == 0 {
+		return
+	}
+	ttlMins := c.RunLockTTLMins
+	if ttlMins == 0 {
+		ttlMins = defaultRunLockTTLMins
+	}
+	var runLock lock.Lock
+	if runLock, err = lock.NewLock(c.RunLock, time.Duration(ttlMins)*time.Minute); err != nil {
+		return
+	}
+	if err = runLock.Acquire(); err != nil {
+		return
+	}
+	logger.Infof("Acquired run lock: %s", c.RunLock)
+	release = func() {
+		if releaseErr := runLock.Release(); releaseErr != nil {
+			logger.Errorw("Failed to release run lock", "lock", c.RunLock, "error", releaseErr)
+			return
+		}
+		logger.Infof("Released run lock: %s", c.RunLock)
+	}
+	return
+}
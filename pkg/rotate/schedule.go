@@ -0,0 +1,258 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotate
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+)
+
+const (
+	dateLayout   = "2006-01-02"
+	clockLayout  = "15:04"
+	minutesInDay = 24 * 60
+)
+
+// schedule type holds parsed schedule rules
+type schedule struct {
+	location  *time.Location
+	weekdays  map[time.Weekday]bool
+	windows   []window
+	blackouts []blackout
+}
+
+// window type holds a time of day window, in minutes since midnight
+type window struct {
+	start int
+	end   int
+}
+
+// blackout type holds a period in which rotation mustn't happen
+type blackout struct {
+	start  time.Time
+	end    time.Time
+	reason string
+}
+
+// freezeFile type holds the blackouts read from a freeze file, or the error
+// reading it
+type freezeFile struct {
+	blackouts []config.Blackout
+	err       error
+}
+
+// freezeFiles type holds the freeze files of a run's schedules, keyed by path
+type freezeFiles map[string]freezeFile
+
+// readFreezeFiles reads each of the freeze files set in the global and
+// account schedules once, so they're read a single time per run however many
+// keys are checked against them
+func readFreezeFiles(c config.Config) (frozen freezeFiles) {
+	frozen = freezeFiles{}
+	schedules := []config.Schedule{c.Schedule}
+	for _, locations := range c.AccountKeyLocations {
+		schedules = append(schedules, locations.Schedule)
+	}
+	for _, s := range schedules {
+		if _, read := frozen[s.FreezeFile]; len(s.FreezeFile) == 0 || read {
+			continue
+		}
+		var f freezeFile
+		f.blackouts, f.err = config.GetFreezeFile(s.FreezeFile)
+		frozen[s.FreezeFile] = f
+	}
+	return
+}
+
+// newSchedule parses the schedule rules in config, including the blackouts
+// of the freeze file if one is set (which must be in the freeze files
+// supplied). An empty config.Schedule allows rotation at any time.
+func newSchedule(s config.Schedule, frozen freezeFiles) (sched schedule, err error) {
+	sched.location = time.UTC
+	if len(s.TimeZone) > 0 {
+		if sched.location, err = time.LoadLocation(s.TimeZone); err != nil {
+			return
+		}
+	}
+	if len(s.Weekdays) > 0 {
+		sched.weekdays = map[time.Weekday]bool{}
+		for _, day := range s.Weekdays {
+			var weekday time.Weekday
+			if weekday, err = parseWeekday(day); err != nil {
+				return
+			}
+			sched.weekdays[weekday] = true
+		}
+	}
+	for _, w := range s.Windows {
+		var parsed window
+		if parsed, err = parseWindow(w); err != nil {
+			return
+		}
+		sched.windows = append(sched.windows, parsed)
+	}
+	blackouts := s.Blackouts
+	if len(s.FreezeFile) > 0 {
+		f, read := frozen[s.FreezeFile]
+		if !read {
+			err = fmt.Errorf("Freeze file: %s hasn't been read", s.FreezeFile)
+			return
+		}
+		if err = f.err; err != nil {
+			return
+		}
+		blackouts = append(append([]config.Blackout{}, blackouts...), f.blackouts...)
+	}
+	for _, b := range blackouts {
+		var parsed blackout
+		if parsed, err = parseBlackout(b, sched.location); err != nil {
+			return
+		}
+		sched.blackouts = append(sched.blackouts, parsed)
+	}
+	return
+}
+
+// allows returns true if rotation may happen at the time supplied, otherwise
+// the reason it may not
+func (s schedule) allows(t time.Time) (allowed bool, reason string) {
+	for _, b := range s.blackouts {
+		if !t.Before(b.start) && t.Before(b.end) {
+			reason = fmt.Sprintf("blackout until %s", b.end.Format(time.RFC3339))
+			if len(b.reason) > 0 {
+				reason = fmt.Sprintf("%s (%s)", reason, b.reason)
+			}
+			return
+		}
+	}
+	local := t.In(s.location)
+	if s.weekdays != nil && !s.weekdays[local.Weekday()] {
+		reason = fmt.Sprintf("%s is not an allowed weekday (%s)", local.Weekday(), s.location)
+		return
+	}
+	if len(s.windows) > 0 {
+		minute := local.Hour()*60 + local.Minute()
+		inWindow := false
+		for _, w := range s.windows {
+			if w.contains(minute) {
+				inWindow = true
+				break
+			}
+		}
+		if !inWindow {
+			reason = fmt.Sprintf("%s is not within an allowed time window (%s)",
+				local.Format(clockLayout), s.location)
+			return
+		}
+	}
+	allowed = true
+	return
+}
+
+// scheduleAllows returns true if all of the schedules allow rotation at the
+// time supplied, otherwise the reason the first that doesn't gives
+func scheduleAllows(t time.Time, schedules ...schedule) (allowed bool, reason string) {
+	allowed = true
+	for _, s := range schedules {
+		if allowed, reason = s.allows(t); !allowed {
+			return
+		}
+	}
+	return
+}
+
+// contains returns true if the minute since midnight is within the window
+func (w window) contains(minute int) bool {
+	if w.end < w.start {
+		return minute >= w.start || minute < w.end
+	}
+	return minute >= w.start && minute < w.end
+}
+
+// parseWeekday parses a full or abbreviated weekday name, e.g. Mon or Monday
+func parseWeekday(day string) (weekday time.Weekday, err error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(day, d.String()) || strings.EqualFold(day, d.String()[:3]) {
+			weekday = d
+			return
+		}
+	}
+	err = fmt.Errorf("Invalid weekday in schedule: %s", day)
+	return
+}
+
+// parseWindow parses a time of day window. An End of 24:00 means midnight at
+// the end of the day.
+func parseWindow(w config.Window) (parsed window, err error) {
+	if parsed.start, err = parseClock(w.Start); err != nil {
+		return
+	}
+	if w.End == "24:00" {
+		parsed.end = minutesInDay
+	} else if parsed.end, err = parseClock(w.End); err != nil {
+		return
+	}
+	if parsed.start == parsed.end {
+		err = fmt.Errorf("Schedule window %s-%s is empty", w.Start, w.End)
+	}
+	return
+}
+
+// parseClock parses a time of day in 15:04 format into minutes since midnight
+func parseClock(clock string) (minute int, err error) {
+	var t time.Time
+	if t, err = time.Parse(clockLayout, clock); err != nil {
+		err = fmt.Errorf("Invalid time of day in schedule: %s", clock)
+		return
+	}
+	minute = t.Hour()*60 + t.Minute()
+	return
+}
+
+// parseBlackout parses a blackout period. Dates are in the location
+// supplied, with the whole of the End date included in the period.
+func parseBlackout(b config.Blackout, location *time.Location) (parsed blackout, err error) {
+	parsed.reason = b.Reason
+	var endIsDate bool
+	if parsed.start, _, err = parseBlackoutTime(b.Start, location); err != nil {
+		return
+	}
+	if parsed.end, endIsDate, err = parseBlackoutTime(b.End, location); err != nil {
+		return
+	}
+	if endIsDate {
+		parsed.end = parsed.end.AddDate(0, 0, 1)
+	}
+	if !parsed.end.After(parsed.start) {
+		err = fmt.Errorf("Schedule blackout ends (%s) before it starts (%s)", b.End, b.Start)
+	}
+	return
+}
+
+// parseBlackoutTime parses either a date or an RFC3339 time
+func parseBlackoutTime(value string, location *time.Location) (t time.Time, isDate bool, err error) {
+	if t, err = time.ParseInLocation(dateLayout, value, location); err == nil {
+		isDate = true
+		return
+	}
+	if t, err = time.Parse(time.RFC3339, value); err != nil {
+		err = fmt.Errorf("Invalid blackout time in schedule: %s, expected %s or RFC3339",
+			value, dateLayout)
+	}
+	return
+}
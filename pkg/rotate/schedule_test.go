@@ -0,0 +1,170 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	keys "github.com/ovotech/cloud-key-client"
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+)
+
+var officeHours = config.Schedule{
+	TimeZone: "Europe/London",
+	Weekdays: []string{"Mon", "tuesday", "Wed", "Thu", "Fri"},
+	Windows:  []config.Window{{Start: "09:00", End: "12:00"}, {Start: "14:00", End: "17:00"}},
+	Blackouts: []config.Blackout{
+		{Start: "2026-12-21", End: "2027-01-01", Reason: "christmas freeze"},
+		{Start: "2026-10-14T15:00:00Z", End: "2026-10-14T15:30:00Z"},
+	},
+}
+
+var scheduleTests = []struct {
+	schedule config.Schedule
+	time     string
+	allowed  bool
+	reason   string
+}{
+	{config.Schedule{}, "2026-10-17T03:00:00Z", true, ""},
+	{officeHours, "2026-10-12T09:30:00+01:00", true, ""},
+	{officeHours, "2026-10-12T12:30:00+01:00", false, "12:30 is not within an allowed time window (Europe/London)"},
+	{officeHours, "2026-10-17T10:00:00+01:00", false, "Saturday is not an allowed weekday (Europe/London)"},
+	{officeHours, "2026-12-22T10:00:00Z", false, "blackout until 2027-01-02T00:00:00Z (christmas freeze)"},
+	{officeHours, "2027-01-01T23:59:00Z", false, "blackout until 2027-01-02T00:00:00Z (christmas freeze)"},
+	{officeHours, "2027-01-04T10:00:00Z", true, ""},
+	{officeHours, "2026-10-14T15:10:00Z", false, "blackout until 2026-10-14T15:30:00Z"},
+	// in UTC this is 08:30, but in Europe/London it's 09:30
+	{officeHours, "2026-10-13T08:30:00Z", true, ""},
+	{config.Schedule{Windows: []config.Window{{Start: "22:00", End: "02:00"}}}, "2026-10-13T01:00:00Z", true, ""},
+	{config.Schedule{Windows: []config.Window{{Start: "22:00", End: "02:00"}}}, "2026-10-13T03:00:00Z", false,
+		"03:00 is not within an allowed time window (UTC)"},
+	{config.Schedule{Windows: []config.Window{{Start: "22:00", End: "24:00"}}}, "2026-10-13T23:59:00Z", true, ""},
+}
+
+func TestScheduleAllows(t *testing.T) {
+	for _, scheduleTest := range scheduleTests {
+		sched, err := newSchedule(scheduleTest.schedule, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now, err := time.Parse(time.RFC3339, scheduleTest.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		allowed, reason := sched.allows(now)
+		if allowed != scheduleTest.allowed || reason != scheduleTest.reason {
+			t.Errorf("Incorrect schedule evaluation at %s, want: %t (%s), got: %t (%s)",
+				scheduleTest.time, scheduleTest.allowed, scheduleTest.reason, allowed, reason)
+		}
+	}
+}
+
+var invalidSchedules = []config.Schedule{
+	{TimeZone: "Not/AZone"},
+	{Weekdays: []string{"Funday"}},
+	{Windows: []config.Window{{Start: "9am", End: "17:00"}}},
+	{Windows: []config.Window{{Start: "09:00", End: "09:00"}}},
+	{Blackouts: []config.Blackout{{Start: "2026-12-21", End: "soon"}}},
+	{Blackouts: []config.Blackout{{Start: "2026-12-21", End: "2026-12-01"}}},
+	{FreezeFile: "/does/not/exist.json"},
+}
+
+func TestNewScheduleInvalid(t *testing.T) {
+	for _, invalidSchedule := range invalidSchedules {
+		frozen := readFreezeFiles(config.Config{Schedule: invalidSchedule})
+		if _, err := newSchedule(invalidSchedule, frozen); err == nil {
+			t.Errorf("Expected error for invalid schedule: %+v", invalidSchedule)
+		}
+	}
+}
+
+func TestScheduleFreezeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ckr-schedule-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	freezeFile := filepath.Join(dir, "freeze.json")
+	if err = ioutil.WriteFile(freezeFile, []byte(`{"Blackouts": [
+		{"Start": "2026-10-16", "End": "2026-10-16", "Reason": "release day"}
+	]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	schedule := config.Schedule{FreezeFile: freezeFile}
+	frozen := readFreezeFiles(config.Config{Schedule: schedule,
+		AccountKeyLocations: []config.KeyLocations{{Schedule: schedule}, {Schedule: schedule}}})
+	// the freeze file has been read once for the run, so isn't read again
+	// for each schedule
+	if err = os.Remove(freezeFile); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		sched, err := newSchedule(schedule, frozen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed, _ := sched.allows(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)); allowed {
+			t.Error("Expected rotation to be blocked by the freeze file")
+		}
+		if allowed, _ := sched.allows(time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)); !allowed {
+			t.Error("Expected rotation to be allowed after the freeze")
+		}
+	}
+}
+
+func TestRotationCandidatesOutsideWindow(t *testing.T) {
+	key := keys.Key{Account: "account1", FullAccount: "account1", ID: "abcd1234", Age: 1000,
+		Provider: keys.Provider{Provider: "mockProvider"}}
+	c := config.Config{
+		Schedule: config.Schedule{Weekdays: []string{"Mon", "Tue", "Wed", "Thu", "Fri"}},
+		AccountKeyLocations: []config.KeyLocations{{
+			ServiceAccountName:       "account1",
+			RotationAgeThresholdMins: shortRotationPeriod,
+			Schedule:                 config.Schedule{Windows: []config.Window{{Start: "02:00", End: "04:00"}}},
+		}},
+	}
+	var candidateTests = []struct {
+		now        time.Time
+		candidates int
+		reason     string
+	}{
+		{time.Date(2026, 10, 13, 3, 0, 0, 0, time.UTC), 1, ""},
+		{time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC), 0, "outside window: Saturday"},
+		{time.Date(2026, 10, 13, 5, 0, 0, 0, time.UTC), 0, "outside window: 05:00"},
+	}
+	for _, candidateTest := range candidateTests {
+		rcs, accountResults, err := rotationCandidates([]keys.Key{key}, c, nil, nil, candidateTest.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rcs) != candidateTest.candidates {
+			t.Errorf("Incorrect number of candidates at %s, want: %d, got: %d",
+				candidateTest.now, candidateTest.candidates, len(rcs))
+		}
+		if candidateTest.candidates > 0 {
+			continue
+		}
+		if len(accountResults) != 1 || accountResults[0].Status != StatusSkipped ||
+			!strings.HasPrefix(accountResults[0].Reason, candidateTest.reason) {
+			t.Errorf("Incorrect results at %s, want skipped with reason: %s, got: %+v",
+				candidateTest.now, candidateTest.reason, accountResults)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotate
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/cenkalti/backoff/v4"
+	keys "github.com/ovotech/cloud-key-client"
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+	"golang.org/x/oauth2/google"
+)
+
+// keyVerifier interface is implemented for each provider whose new keys can
+// be proven usable before they're written to any locations
+type keyVerifier interface {
+	Verify(key keys.Key, newKeyID, newKey string) error
+}
+
+const (
+	aivenMeEndpoint                = "https://api.aiven.io/v1/me"
+	defaultVerifyNewKeyTimeoutSecs = 120
+)
+
+// keyVerifiers maps each provider to its keyVerifier. Providers without one
+// don't have their new keys verified.
+var keyVerifiers = map[string]keyVerifier{
+	"aiven": aivenKeyVerifier{},
+	"aws":   awsKeyVerifier{},
+	"gcp":   gcpKeyVerifier{},
+}
+
+// verifyNewKey retries verification of the new key, with exponential backoff,
+// until it succeeds or the configured timeout is reached. This allows for
+// eventual consistency in the provider, e.g. AWS IAM.
+func verifyNewKey(key keys.Key, newKeyID, newKey string, c config.Config) (err error) {
+	verifier, ok := keyVerifiers[key.Provider.Provider]
+	if !c.VerifyNewKeys || !ok {
+		return
+	}
+	timeoutSecs := defaultVerifyNewKeyTimeoutSecs
+	if c.VerifyNewKeyTimeoutSecs > 0 {
+		timeoutSecs = c.VerifyNewKeyTimeoutSecs
+	}
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = time.Duration(timeoutSecs) * time.Second
+	operation := func() error {
+		verifyErr := verifier.Verify(key, newKeyID, newKey)
+		if verifyErr != nil {
+			logger.Infow("New key not yet verified, retrying",
+				"keyProvider", key.Provider.Provider,
+				"account", key.FullAccount,
+				"keyID", obfuscate(newKeyID),
+				"error", verifyErr)
+		}
+		return verifyErr
+	}
+	if err = backoff.Retry(operation, b); err != nil {
+		err = fmt.Errorf("Unable to verify new key within %d secs: %w", timeoutSecs, err)
+		return
+	}
+	logger.Infow("New key verified",
+		"keyProvider", key.Provider.Provider,
+		"account", key.FullAccount,
+		"keyID", obfuscate(newKeyID))
+	return
+}
+
+// awsKeyVerifier verifies AWS access keys by calling STS GetCallerIdentity
+type awsKeyVerifier struct{}
+
+func (v awsKeyVerifier) Verify(key keys.Key, newKeyID, newKey string) (err error) {
+	var sess *session.Session
+	if sess, err = session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials(newKeyID, newKey, ""),
+		Region:      aws.String("us-east-1"),
+	}); err != nil {
+		return
+	}
+	var identity *sts.GetCallerIdentityOutput
+	if identity, err = sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{}); err != nil {
+		return
+	}
+	if !strings.HasSuffix(aws.StringValue(identity.Arn), "/"+key.FullAccount) {
+		err = fmt.Errorf("New key belongs to %s, not %s", aws.StringValue(identity.Arn), key.FullAccount)
+	}
+	return
+}
+
+// gcpKeyVerifier verifies GCP service account keys by exchanging them for an
+// access token
+type gcpKeyVerifier struct{}
+
+func (v gcpKeyVerifier) Verify(key keys.Key, newKeyID, newKey string) (err error) {
+	var keyJSON []byte
+	if keyJSON, err = b64.StdEncoding.DecodeString(newKey); err != nil {
+		return
+	}
+	ctx := context.Background()
+	var creds *google.Credentials
+	if creds, err = google.CredentialsFromJSON(ctx, keyJSON,
+		"https://www.googleapis.com/auth/cloud-platform"); err != nil {
+		return
+	}
+	_, err = creds.TokenSource.Token()
+	return
+}
+
+// aivenKeyVerifier verifies Aiven API tokens by looking up the token's user
+type aivenKeyVerifier struct{}
+
+func (v aivenKeyVerifier) Verify(key keys.Key, newKeyID, newKey string) (err error) {
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodGet, aivenMeEndpoint, nil); err != nil {
+		return
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", newKey))
+	var resp *http.Response
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("non-200 status code (%d) returned by Aiven", resp.StatusCode)
+	}
+	return
+}
@@ -0,0 +1,314 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serve
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+	"github.com/ovotech/cloud-key-rotator/pkg/log"
+	"github.com/ovotech/cloud-key-rotator/pkg/rotate"
+	"github.com/robfig/cron/v3"
+)
+
+var logger = log.StdoutLogger().Sugar()
+
+// defaultAddress is the address the HTTP API listens on if none is configured
+const defaultAddress = ":8080"
+
+// errRotationRunning is returned when a rotation is requested while another
+// is still running
+var errRotationRunning = errors.New("A rotation is already running")
+
+// Server type runs rotations on a cron schedule, and serves an HTTP API for
+// health checks, metrics, key age reports and ad-hoc rotations. Only one
+// rotation runs at a time.
+type Server struct {
+	c        config.Config
+	apiToken string
+	cron     *cron.Cron
+	// rotate and report are rotate.Rotate and rotate.Report, other than in
+	// tests
+	rotate  func(account, provider, project string, c config.Config) (rotate.Result, error)
+	report  func(account, provider, project string, c config.Config) ([]rotate.KeyReport, error)
+	running sync.Mutex
+	metrics metrics
+}
+
+// metrics type holds the counts and timings exposed on /metrics
+type metrics struct {
+	sync.Mutex
+	runs            map[string]int
+	overlapped      int
+	accounts        map[string]int
+	lastRun         time.Time
+	lastRunDuration time.Duration
+	lastRunFailed   bool
+}
+
+// NewServer returns a Server that rotates keys according to the config
+func NewServer(c config.Config) (s *Server, err error) {
+	s = &Server{
+		c:       c,
+		rotate:  rotate.Rotate,
+		report:  rotate.Report,
+		metrics: metrics{runs: map[string]int{}, accounts: map[string]int{}},
+	}
+	if s.apiToken, err = config.ResolveSecret(c.Credentials.ServerAPIToken); err != nil {
+		return
+	}
+	if len(c.Server.Cron) > 0 {
+		s.cron = cron.New()
+		if _, err = s.cron.AddFunc(c.Server.Cron, s.scheduledRotation); err != nil {
+			err = fmt.Errorf("Invalid Server.Cron schedule: %s: %w", c.Server.Cron, err)
+			return
+		}
+	}
+	return
+}
+
+// ListenAndServe starts the cron schedule and serves the HTTP API, until the
+// context is done. A rotation that's running then is allowed to finish.
+func (s *Server) ListenAndServe(ctx context.Context) (err error) {
+	address := s.c.Server.Address
+	if len(address) == 0 {
+		address = defaultAddress
+	}
+	httpServer := &http.Server{Addr: address, Handler: s.Handler()}
+	if s.cron != nil {
+		s.cron.Start()
+		logger.Infof("Rotations scheduled: %s", s.c.Server.Cron)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		logger.Infof("Listening on %s", address)
+		errs <- httpServer.ListenAndServe()
+	}()
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		logger.Info("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		err = httpServer.Shutdown(shutdownCtx)
+	}
+	if s.cron != nil {
+		<-s.cron.Stop().Done()
+	}
+	s.running.Lock()
+	defer s.running.Unlock()
+	return
+}
+
+// Handler returns the handler of the HTTP API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/metrics", s.writeMetrics)
+	mux.HandleFunc("/keys", s.keys)
+	mux.HandleFunc("/rotate", s.adHocRotation)
+	return mux
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// keys writes a report of the keys found, in the format requested (JSON by
+// default), optionally for a single account
+func (s *Server) keys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	format := query.Get("format")
+	if len(format) == 0 {
+		format = rotate.ReportFormatJSON
+	}
+	var contentType string
+	switch format {
+	case rotate.ReportFormatJSON:
+		contentType = "application/json"
+	case rotate.ReportFormatCSV:
+		contentType = "text/csv"
+	case rotate.ReportFormatTable:
+		contentType = "text/plain; charset=utf-8"
+	default:
+		http.Error(w, fmt.Sprintf("Report format: %s is not supported", format), http.StatusBadRequest)
+		return
+	}
+	keyReports, err := s.report(query.Get("account"), query.Get("provider"), query.Get("project"), s.c)
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if err = rotate.WriteReport(w, keyReports, format); err != nil {
+		logger.Error(err)
+	}
+}
+
+// adHocRotation runs a rotation, optionally of a single account, and writes
+// its result. Requests must have a bearer token matching
+// Credentials.ServerAPIToken.
+func (s *Server) adHocRotation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(s.apiToken) == 0 {
+		http.Error(w, "Ad-hoc rotation is disabled, as Credentials.ServerAPIToken isn't set",
+			http.StatusForbidden)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.apiToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+	c := s.c
+	if query.Get("plan") == "true" {
+		c.Plan = true
+	}
+	account := query.Get("account")
+	logger.Infow("Ad-hoc rotation requested", "account", account, "remoteAddr", r.RemoteAddr)
+	result, err := s.runRotation(account, query.Get("provider"), query.Get("project"), c)
+	response := struct {
+		Status string        `json:"status"`
+		Error  string        `json:"error,omitempty"`
+		Report rotate.Result `json:"report"`
+	}{Status: "success", Report: result}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		response.Status = "fail"
+		response.Error = err.Error()
+		if errors.Is(err, errRotationRunning) {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+	if encodeErr := json.NewEncoder(w).Encode(response); encodeErr != nil {
+		logger.Error(encodeErr)
+	}
+}
+
+// scheduledRotation runs a rotation of all accounts, on the cron schedule
+func (s *Server) scheduledRotation() {
+	logger.Info("Scheduled rotation starting")
+	result, err := s.runRotation("", "", "", s.c)
+	if err != nil {
+		logger.Errorw("Scheduled rotation failed", "error", err, "summary", result.Summary())
+		return
+	}
+	logger.Infow("Rotation report",
+		"summary", result.Summary(),
+		"accounts", result.Accounts)
+}
+
+// runRotation runs a rotation, unless one is already running, and records
+// its outcome in the metrics. A plan doesn't change anything, so it can run
+// alongside a rotation, and isn't counted in the metrics.
+func (s *Server) runRotation(account, provider, project string, c config.Config) (result rotate.Result, err error) {
+	if c.Plan {
+		return s.rotate(account, provider, project, c)
+	}
+	if !s.running.TryLock() {
+		s.metrics.Lock()
+		s.metrics.overlapped++
+		s.metrics.Unlock()
+		logger.Warn("Not starting rotation, as a rotation is already running")
+		err = errRotationRunning
+		return
+	}
+	defer s.running.Unlock()
+	start := time.Now()
+	result, err = s.rotate(account, provider, project, c)
+	s.metrics.record(start, result, err)
+	return
+}
+
+// record records the outcome of a rotation that started at the time supplied
+func (m *metrics) record(start time.Time, result rotate.Result, err error) {
+	m.Lock()
+	defer m.Unlock()
+	failed := err != nil || result.Failed()
+	if failed {
+		m.runs["fail"]++
+	} else {
+		m.runs["success"]++
+	}
+	for status, count := range result.Summary() {
+		m.accounts[status] += count
+	}
+	m.lastRun = start
+	m.lastRunDuration = time.Since(start)
+	m.lastRunFailed = failed
+}
+
+// writeMetrics writes the metrics in the Prometheus text format
+func (s *Server) writeMetrics(w http.ResponseWriter, r *http.Request) {
+	m := &s.metrics
+	m.Lock()
+	defer m.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP ckr_rotation_runs_total Rotation runs, by result.")
+	fmt.Fprintln(w, "# TYPE ckr_rotation_runs_total counter")
+	for _, result := range []string{"success", "fail"} {
+		fmt.Fprintf(w, "ckr_rotation_runs_total{result=%q} %d\n", result, m.runs[result])
+	}
+	fmt.Fprintln(w, "# HELP ckr_rotation_runs_overlapped_total Rotations not started, as one was already running.")
+	fmt.Fprintln(w, "# TYPE ckr_rotation_runs_overlapped_total counter")
+	fmt.Fprintf(w, "ckr_rotation_runs_overlapped_total %d\n", m.overlapped)
+	fmt.Fprintln(w, "# HELP ckr_rotation_accounts_total Accounts considered for rotation, by status.")
+	fmt.Fprintln(w, "# TYPE ckr_rotation_accounts_total counter")
+	statuses := make([]string, 0, len(m.accounts))
+	for status := range m.accounts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(w, "ckr_rotation_accounts_total{status=%q} %d\n", status, m.accounts[status])
+	}
+	if m.lastRun.IsZero() {
+		return
+	}
+	lastRunFailed := 0
+	if m.lastRunFailed {
+		lastRunFailed = 1
+	}
+	fmt.Fprintln(w, "# HELP ckr_last_rotation_timestamp_seconds Start time of the last rotation run.")
+	fmt.Fprintln(w, "# TYPE ckr_last_rotation_timestamp_seconds gauge")
+	fmt.Fprintf(w, "ckr_last_rotation_timestamp_seconds %d\n", m.lastRun.Unix())
+	fmt.Fprintln(w, "# HELP ckr_last_rotation_duration_seconds Duration of the last rotation run.")
+	fmt.Fprintln(w, "# TYPE ckr_last_rotation_duration_seconds gauge")
+	fmt.Fprintf(w, "ckr_last_rotation_duration_seconds %f\n", m.lastRunDuration.Seconds())
+	fmt.Fprintln(w, "# HELP ckr_last_rotation_failed Whether the last rotation run failed.")
+	fmt.Fprintln(w, "# TYPE ckr_last_rotation_failed gauge")
+	fmt.Fprintf(w, "ckr_last_rotation_failed %d\n", lastRunFailed)
+}
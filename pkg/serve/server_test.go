@@ -0,0 +1,232 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serve
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ovotech/cloud-key-rotator/pkg/config"
+	"github.com/ovotech/cloud-key-rotator/pkg/cred"
+	"github.com/ovotech/cloud-key-rotator/pkg/rotate"
+)
+
+const testAPIToken = "s3cret"
+
+// testServer returns a Server whose rotations call rotateFunc
+func testServer(t *testing.T, rotateFunc func(account, provider, project string,
+	c config.Config) (rotate.Result, error)) *Server {
+	s, err := NewServer(config.Config{Credentials: cred.Credentials{ServerAPIToken: testAPIToken}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.rotate = rotateFunc
+	s.report = func(account, provider, project string, c config.Config) ([]rotate.KeyReport, error) {
+		return []rotate.KeyReport{{Provider: "gcp", Account: "sa-1", KeyID: "...abcd", AgeMins: 90}}, nil
+	}
+	return s
+}
+
+func rotateRequest(token, query string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/rotate"+query, nil)
+	if len(token) > 0 {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestAdHocRotation(t *testing.T) {
+	var rotatedAccount string
+	s := testServer(t, func(account, provider, project string, c config.Config) (rotate.Result, error) {
+		rotatedAccount = account
+		return rotate.Result{Accounts: []rotate.AccountResult{{Account: account, Status: rotate.StatusRotated}}}, nil
+	})
+	handler := s.Handler()
+
+	for _, token := range []string{"", "wrong"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, rotateRequest(token, "?account=sa-1"))
+		if w.Code != http.StatusUnauthorized || len(rotatedAccount) > 0 {
+			t.Errorf("Expected rotation with token %q to be unauthorised, got: %d", token, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, rotateRequest(testAPIToken, "?account=sa-1&provider=gcp&project=my-project"))
+	if w.Code != http.StatusOK || rotatedAccount != "sa-1" {
+		t.Fatalf("Expected sa-1 to be rotated, got: %d %s", w.Code, w.Body)
+	}
+	var response struct {
+		Status string
+		Report rotate.Result
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != "success" || response.Report.Summary()[rotate.StatusRotated] != 1 {
+		t.Errorf("Incorrect response: %+v", response)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/rotate", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET /rotate to be rejected, got: %d", w.Code)
+	}
+}
+
+func TestAdHocRotationDisabled(t *testing.T) {
+	s, err := NewServer(config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, rotateRequest("", ""))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected rotation to be forbidden without an API token, got: %d", w.Code)
+	}
+}
+
+func TestNoOverlappingRotations(t *testing.T) {
+	started := make(chan bool)
+	finish := make(chan bool)
+	s := testServer(t, func(account, provider, project string, c config.Config) (rotate.Result, error) {
+		started <- true
+		<-finish
+		return rotate.Result{}, nil
+	})
+	handler := s.Handler()
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, rotateRequest(testAPIToken, ""))
+		done <- w.Code
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, rotateRequest(testAPIToken, ""))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected overlapping rotation to be refused, got: %d", w.Code)
+	}
+	// a scheduled rotation is skipped too, rather than waiting
+	s.scheduledRotation()
+
+	close(finish)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected first rotation to succeed, got: %d", code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, expected := range []string{
+		`ckr_rotation_runs_total{result="success"} 1`,
+		"ckr_rotation_runs_overlapped_total 2",
+		"ckr_last_rotation_failed 0",
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("Expected metrics to contain %s, got:\n%s", expected, w.Body)
+		}
+	}
+}
+
+func TestPlanDuringRotation(t *testing.T) {
+	started := make(chan bool)
+	finish := make(chan bool)
+	s := testServer(t, func(account, provider, project string, c config.Config) (rotate.Result, error) {
+		if c.Plan {
+			return rotate.Result{Accounts: []rotate.AccountResult{{Account: "sa-1", Status: rotate.StatusPlanned}}}, nil
+		}
+		started <- true
+		<-finish
+		return rotate.Result{}, nil
+	})
+	handler := s.Handler()
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, rotateRequest(testAPIToken, ""))
+		done <- w.Code
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, rotateRequest(testAPIToken, "?plan=true"))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected plan to run alongside rotation, got: %d %s", w.Code, w.Body)
+	}
+
+	close(finish)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected rotation to succeed, got: %d", code)
+	}
+
+	// the plan isn't a rotation run, so only the rotation is counted
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, expected := range []string{
+		`ckr_rotation_runs_total{result="success"} 1`,
+		"ckr_rotation_runs_overlapped_total 0",
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("Expected metrics to contain %s, got:\n%s", expected, w.Body)
+		}
+	}
+	if strings.Contains(w.Body.String(), "planned") {
+		t.Errorf("Expected planned accounts not to be counted, got:\n%s", w.Body)
+	}
+}
+
+func TestKeysAndHealthz(t *testing.T) {
+	handler := testServer(t, nil).Handler()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/keys", nil))
+	var keyReports []rotate.KeyReport
+	if err := json.NewDecoder(w.Body).Decode(&keyReports); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Content-Type") != "application/json" || len(keyReports) != 1 ||
+		keyReports[0].Account != "sa-1" {
+		t.Errorf("Incorrect key report: %v", keyReports)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/keys?format=csv", nil))
+	if body, _ := ioutil.ReadAll(w.Body); !strings.Contains(string(body), "sa-1") ||
+		w.Header().Get("Content-Type") != "text/csv" {
+		t.Errorf("Incorrect CSV key report: %s", body)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/keys?format=xml", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected unsupported format to be rejected, got: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected healthy, got: %d", w.Code)
+	}
+}
+
+func TestNewServerInvalidCron(t *testing.T) {
+	if _, err := NewServer(config.Config{Server: config.Server{Cron: "every day"}}); err == nil {
+		t.Error("Expected error for invalid cron schedule")
+	}
+}
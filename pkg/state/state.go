@@ -0,0 +1,207 @@
+// Copyright 2019 OVO Technology
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// State type holds everything that needs to be remembered between runs
+type State struct {
+	PendingDeletions []PendingDeletion
+}
+
+// PendingDeletion type holds an old key that's been replaced, and is due to
+// be deleted once its grace period has passed
+type PendingDeletion struct {
+	Provider    string
+	Project     string
+	Account     string
+	KeyID       string
+	ReplacedAt  time.Time
+	DeleteAfter time.Time
+}
+
+// Store interface is implemented by the places State can be kept
+type Store interface {
+	Load() (State, error)
+	Save(State) error
+}
+
+// NewStore returns the Store for the URI supplied, which is one of:
+// file:///path/to/state.json, gs://bucket/object or s3://bucket/key (with an
+// optional region query parameter, e.g. s3://bucket/key?region=eu-west-1)
+func NewStore(uri string) (store Store, err error) {
+	var u *url.URL
+	if u, err = url.Parse(uri); err != nil {
+		return
+	}
+	objectName := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "file":
+		store = fileStore{path: u.Path}
+	case "gs":
+		store = gcsStore{bucketName: u.Host, objectName: objectName}
+	case "s3":
+		store = s3Store{bucketName: u.Host, key: objectName, region: u.Query().Get("region")}
+	default:
+		err = fmt.Errorf("State store URI scheme: %s is not supported", u.Scheme)
+	}
+	return
+}
+
+// fileStore type keeps State in a local file
+type fileStore struct {
+	path string
+}
+
+func (f fileStore) Load() (state State, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(f.path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	return decode(data)
+}
+
+func (f fileStore) Save(state State) (err error) {
+	var data []byte
+	if data, err = json.MarshalIndent(state, "", "  "); err != nil {
+		return
+	}
+	return ioutil.WriteFile(f.path, data, 0600)
+}
+
+// gcsStore type keeps State in a GCS object
+type gcsStore struct {
+	bucketName string
+	objectName string
+}
+
+func (g gcsStore) Load() (state State, err error) {
+	ctx := context.Background()
+	var client *storage.Client
+	if client, err = storage.NewClient(ctx); err != nil {
+		return
+	}
+	defer client.Close()
+	var rc *storage.Reader
+	if rc, err = client.Bucket(g.bucketName).Object(g.objectName).NewReader(ctx); err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			err = nil
+		}
+		return
+	}
+	defer rc.Close()
+	var data []byte
+	if data, err = ioutil.ReadAll(rc); err != nil {
+		return
+	}
+	return decode(data)
+}
+
+func (g gcsStore) Save(state State) (err error) {
+	ctx := context.Background()
+	var client *storage.Client
+	if client, err = storage.NewClient(ctx); err != nil {
+		return
+	}
+	defer client.Close()
+	var data []byte
+	if data, err = json.Marshal(state); err != nil {
+		return
+	}
+	w := client.Bucket(g.bucketName).Object(g.objectName).NewWriter(ctx)
+	w.ContentType = "application/json"
+	if _, err = w.Write(data); err != nil {
+		w.Close()
+		return
+	}
+	return w.Close()
+}
+
+// s3Store type keeps State in an S3 object
+type s3Store struct {
+	bucketName string
+	key        string
+	region     string
+}
+
+func (s s3Store) client() *s3.S3 {
+	config := aws.NewConfig()
+	if len(s.region) > 0 {
+		config = config.WithRegion(s.region)
+	}
+	return s3.New(session.New(), config)
+}
+
+func (s s3Store) Load() (state State, err error) {
+	var output *s3.GetObjectOutput
+	if output, err = s.client().GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(s.key),
+	}); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			err = nil
+		}
+		return
+	}
+	defer output.Body.Close()
+	var data []byte
+	if data, err = ioutil.ReadAll(output.Body); err != nil {
+		return
+	}
+	return decode(data)
+}
+
+func (s s3Store) Save(state State) (err error) {
+	var data []byte
+	if data, err = json.Marshal(state); err != nil {
+		return
+	}
+	_, err = s.client().PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.bucketName),
+		Key:         aws.String(s.key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return
+}
+
+// decode decodes State from JSON, treating empty data as empty State
+func decode(data []byte) (state State, err error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return
+	}
+	err = json.Unmarshal(data, &state)
+	return
+}
@@ -0,0 +1,50 @@
+package state
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var newStoreTests = []struct {
+	uri      string
+	expected Store
+	errors   bool
+}{
+	{"file:///tmp/ckr-state.json", fileStore{path: "/tmp/ckr-state.json"}, false},
+	{"gs://my-bucket/path/to/state.json", gcsStore{bucketName: "my-bucket", objectName: "path/to/state.json"}, false},
+	{"s3://my-bucket/state.json?region=eu-west-1", s3Store{bucketName: "my-bucket", key: "state.json", region: "eu-west-1"}, false},
+	{"ftp://my-bucket/state.json", nil, true},
+}
+
+func TestNewStore(t *testing.T) {
+	for _, newStoreTest := range newStoreTests {
+		store, err := NewStore(newStoreTest.uri)
+		if (err != nil) != newStoreTest.errors {
+			t.Errorf("Incorrect error behaviour for %s: %v", newStoreTest.uri, err)
+		}
+		if !reflect.DeepEqual(store, newStoreTest.expected) {
+			t.Errorf("Incorrect store for %s, want: %v, got: %v", newStoreTest.uri, newStoreTest.expected, store)
+		}
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	store := fileStore{path: filepath.Join(t.TempDir(), "state.json")}
+	loaded, err := store.Load()
+	if err != nil || len(loaded.PendingDeletions) != 0 {
+		t.Errorf("Expected empty state from missing file, got: %v, %v", loaded, err)
+	}
+	saved := State{PendingDeletions: []PendingDeletion{{Provider: "gcp", Project: "my-project",
+		Account: "my-sa", KeyID: "abcd1234", DeleteAfter: time.Now().UTC().Round(time.Second)}}}
+	if err = store.Save(saved); err != nil {
+		t.Error(err)
+	}
+	if loaded, err = store.Load(); err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(loaded, saved) {
+		t.Errorf("Incorrect state loaded, want: %v, got: %v", saved, loaded)
+	}
+}